@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+// heldKey is the key a client held last and until when it may have it back
+// under AffinityWindow.
+type heldKey struct {
+	key   string
+	until time.Time
+}
+
+// rememberHeld notes that client gave up key at now, so a lease it takes
+// within AffinityWindow prefers that key. The caller must hold km.mu.
+func (km *KeyManager) rememberHeld(client, key string, now time.Time) {
+	if km.AffinityWindow <= 0 || client == "" {
+		return
+	}
+	km.lastHeld[client] = heldKey{key: key, until: now.Add(km.AffinityWindow)}
+}
+
+// affinityIndex returns the index in available of the key client held last,
+// if its AffinityWindow is still open and the key is among them. The caller
+// must hold km.mu.
+func (km *KeyManager) affinityIndex(client string, available []string, now time.Time) (int, bool) {
+	held, ok := km.lastHeld[client]
+	if !ok {
+		return 0, false
+	}
+	if now.After(held.until) {
+		delete(km.lastHeld, client)
+		return 0, false
+	}
+	for i, key := range available {
+		if key == held.key {
+			delete(km.lastHeld, client)
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// pruneAffinity drops the affinities whose window has closed, so clients
+// that never come back do not accumulate. The caller must hold km.mu.
+func (km *KeyManager) pruneAffinity(now time.Time) {
+	for client, held := range km.lastHeld {
+		if now.After(held.until) {
+			delete(km.lastHeld, client)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAffinity(t *testing.T) {
+	km, clock := newTestManager(t, Config{Strategy: StrategyFIFO, AffinityWindow: 10 * time.Second})
+	keys, err := km.GenerateKeys(4)
+	if err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	alice := ContextWithClient(context.Background(), "alice")
+	bob := ContextWithClient(context.Background(), "bob")
+	lease := func(ctx context.Context) Lease {
+		t.Helper()
+		lease, err := km.LeaseKeyCtx(ctx, 0)
+		if err != nil {
+			t.Fatalf("LeaseKeyCtx: %v", err)
+		}
+		return lease
+	}
+	release := func(lease Lease) {
+		t.Helper()
+		if err := km.ReleaseKey(lease.KeyID, lease.LeaseToken); err != nil {
+			t.Fatalf("ReleaseKey: %v", err)
+		}
+	}
+
+	lease(alice)
+	held := lease(alice)
+	if held.KeyID != keys[1] {
+		t.Fatalf("second FIFO lease got %q, want %q", held.KeyID, keys[1])
+	}
+	// The released key goes to the back of the line, behind keys[2].
+	release(held)
+
+	// Within the window alice gets her key back; others still go in order.
+	clock.Advance(5 * time.Second)
+	held = lease(alice)
+	if held.KeyID != keys[1] {
+		t.Fatalf("alice leased %q inside the window, want her last key %q", held.KeyID, keys[1])
+	}
+	release(held)
+	if got := lease(bob); got.KeyID != keys[2] {
+		t.Fatalf("bob leased %q, want the FIFO head %q", got.KeyID, keys[2])
+	}
+
+	// Once the window closes alice is served in order like anyone else.
+	clock.Advance(11 * time.Second)
+	if got := lease(alice); got.KeyID != keys[3] {
+		t.Fatalf("alice leased %q after the window, want the FIFO head %q", got.KeyID, keys[3])
+	}
+}
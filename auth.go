@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth rejects requests that do not carry token, either as a bearer
+// token in Authorization or in the X-API-Key header. Safe methods are let
+// through unless protectReads is set. An empty token disables the check.
+func adminAuth(token string, protectReads bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.Next()
+			return
+		}
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if !protectReads {
+				c.Next()
+				return
+			}
+		}
+
+		if !validToken(requestToken(c), token) {
+			c.Header("WWW-Authenticate", "Bearer")
+			writeError(c, http.StatusUnauthorized, CodeUnauthorized, "missing or invalid credentials")
+			return
+		}
+		c.Next()
+	}
+}
+
+// requestToken extracts the credential presented by the client.
+func requestToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return c.GetHeader("X-API-Key")
+}
+
+func validToken(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
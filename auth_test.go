@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	const token = "s3cret"
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{AdminToken: token})
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong bearer token", "Authorization", "Bearer wrong", http.StatusUnauthorized},
+		{"token without scheme", "Authorization", token, http.StatusUnauthorized},
+		{"bearer token", "Authorization", "Bearer " + token, http.StatusCreated},
+		{"api key header", "X-API-Key", token, http.StatusCreated},
+	} {
+		req := newRequest(t, http.MethodPost, "/keys", nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		w := serveRequest(r, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized {
+			expectError(t, w, http.StatusUnauthorized, CodeUnauthorized)
+			if got := w.Header().Get("WWW-Authenticate"); got != "Bearer" {
+				t.Errorf("%s: WWW-Authenticate = %q", tc.name, got)
+			}
+		}
+	}
+	if got := km.Stats().Total; got != 2 {
+		t.Fatalf("%d keys created, want only the 2 authorized requests", got)
+	}
+
+	// Reads stay open unless ProtectReads is set.
+	w := doRequest(t, r, http.MethodGet, "/stats", nil)
+	expectStatus(t, w, http.StatusOK)
+	protected := newTestRouter(km, RouterConfig{AdminToken: token, ProtectReads: true})
+	w = doRequest(t, protected, http.MethodGet, "/stats", nil)
+	expectError(t, w, http.StatusUnauthorized, CodeUnauthorized)
+
+	// Reads that reveal every key id need the token regardless.
+	for _, target := range []string{"/export", "/keys/list", "/keys/ids"} {
+		w := doRequest(t, r, http.MethodGet, target, nil)
+		expectError(t, w, http.StatusUnauthorized, CodeUnauthorized)
+		req := newRequest(t, http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		expectStatus(t, serveRequest(r, req), http.StatusOK)
+	}
+
+	// So does the event stream. A request whose client is already gone
+	// returns as soon as the stream is set up.
+	w = doRequest(t, r, http.MethodGet, "/events", nil)
+	expectError(t, w, http.StatusUnauthorized, CodeUnauthorized)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := newRequest(t, http.MethodGet, "/events", nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	expectStatus(t, serveRequest(r, req), http.StatusOK)
+}
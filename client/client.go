@@ -0,0 +1,284 @@
+// Package client is a Go client for the keys-generator HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned for the server's error codes. They are wrapped in an
+// *Error, so test for them with errors.Is.
+var (
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrUnauthorized       = errors.New("missing or invalid credentials")
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrKeyExists          = errors.New("key already exists")
+	ErrKeyDeleted         = errors.New("key has been deleted")
+	ErrKeyNotBlocked      = errors.New("key is not blocked")
+	ErrNoKeysAvailable    = errors.New("no keys available")
+	ErrLeaseNotHeld       = errors.New("lease token does not match the current lease")
+	ErrPoolFull           = errors.New("key pool is full")
+	ErrTooManyLeases      = errors.New("too many keys are leased")
+	ErrRateLimited        = errors.New("rate limited")
+	ErrQuotaExceeded      = errors.New("client quota exceeded")
+	ErrVersionMismatch    = errors.New("key has been modified")
+	ErrVersionUnsupported = errors.New("server does not track key versions")
+	ErrRenewalLimit       = errors.New("lease renewal limit reached")
+	ErrStoreUnavailable   = errors.New("store unavailable")
+)
+
+var codeErrors = map[string]error{
+	"invalid_request":     ErrInvalidRequest,
+	"invalid_batch_size":  ErrInvalidRequest,
+	"invalid_state":       ErrInvalidRequest,
+	"unauthorized":        ErrUnauthorized,
+	"key_not_found":       ErrKeyNotFound,
+	"key_exists":          ErrKeyExists,
+	"key_deleted":         ErrKeyDeleted,
+	"key_not_blocked":     ErrKeyNotBlocked,
+	"no_keys_available":   ErrNoKeysAvailable,
+	"lease_not_held":      ErrLeaseNotHeld,
+	"pool_full":           ErrPoolFull,
+	"too_many_leases":     ErrTooManyLeases,
+	"rate_limited":        ErrRateLimited,
+	"quota_exceeded":      ErrQuotaExceeded,
+	"version_mismatch":    ErrVersionMismatch,
+	"version_unsupported": ErrVersionUnsupported,
+	"renewal_limit":       ErrRenewalLimit,
+	"store_unavailable":   ErrStoreUnavailable,
+}
+
+// Error is a non-2xx response from the server.
+type Error struct {
+	StatusCode int
+	// Code and Message are taken from the server's error body.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID identifies the request in the server's logs.
+	RequestID string `json:"requestId"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("keys-generator: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Unwrap returns the package error for e's code, if there is one.
+func (e *Error) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// Lease is a leased key and the token needed to release it early.
+type Lease struct {
+	KeyID      string `json:"keyId"`
+	LeaseToken string `json:"leaseToken"`
+}
+
+// KeyInfo is the metadata the server keeps for a key.
+type KeyInfo struct {
+	Key          string            `json:"key"`
+	CreationTime time.Time         `json:"createdAt"`
+	LastAccess   time.Time         `json:"lastAccess,omitzero"`
+	IsBlocked    bool              `json:"isBlocked"`
+	BlockedAt    time.Time         `json:"blockedAt,omitzero"`
+	Expiry       time.Time         `json:"expiresAt,omitzero"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Pool         string            `json:"pool,omitempty"`
+	Client       string            `json:"client,omitempty"`
+	Sliding      bool              `json:"sliding,omitempty"`
+	Renewals     int               `json:"renewals,omitempty"`
+	Version      uint64            `json:"version"`
+	DeletedAt    time.Time         `json:"deletedAt,omitzero"`
+	// ReservedUntil is when a reserved key joins the pool by itself.
+	ReservedUntil time.Time `json:"reservedUntil,omitzero"`
+	// ExpiresIn is the number of seconds left on the current lease.
+	ExpiresIn float64 `json:"expiresIn,omitempty"`
+}
+
+// LeaseOptions tune LeaseKey. Zero values use the server's defaults.
+type LeaseOptions struct {
+	// TTL is how long to hold the key.
+	TTL time.Duration
+	// Wait is how long the server may wait for a key when the pool is empty.
+	Wait time.Duration
+	// Pool is the pool to lease from.
+	Pool string
+	// Sliding makes every GetKeyInfo of the key renew the lease.
+	Sliding bool
+}
+
+// Client calls a keys-generator server.
+type Client struct {
+	// BaseURL is the server's address, such as "http://localhost:8080".
+	BaseURL string
+	// Token, when set, is sent as a bearer token on every request.
+	Token string
+	// ClientID, when set, is sent in X-Client-Id so leases count against
+	// this client's quota.
+	ClientID string
+	// HTTPClient sends the requests. Nil means http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// New returns a Client for the server at baseURL, authenticating with token
+// if it is not empty.
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+// GenerateKey creates a new available key labelled with tags and returns
+// its id.
+func (c *Client) GenerateKey(ctx context.Context, tags map[string]string) (string, error) {
+	var body struct {
+		Tags map[string]string `json:"tags,omitempty"`
+	}
+	body.Tags = tags
+
+	var resp struct {
+		KeyID string `json:"keyId"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/keys", nil, body, &resp); err != nil {
+		return "", err
+	}
+	return resp.KeyID, nil
+}
+
+// LeaseKey leases an available key.
+func (c *Client) LeaseKey(ctx context.Context, opts LeaseOptions) (Lease, error) {
+	query := url.Values{}
+	if opts.TTL > 0 {
+		query.Set("ttl", opts.TTL.String())
+	}
+	if opts.Wait > 0 {
+		query.Set("wait", opts.Wait.String())
+	}
+	if opts.Pool != "" {
+		query.Set("pool", opts.Pool)
+	}
+	if opts.Sliding {
+		query.Set("sliding", "true")
+	}
+
+	var lease Lease
+	err := c.do(ctx, http.MethodGet, "/keys", query, nil, &lease)
+	return lease, err
+}
+
+// LeaseKeys leases count keys at once. Either all of them are leased or,
+// with ErrNoKeysAvailable, none are. Wait and Sliding in opts are ignored.
+func (c *Client) LeaseKeys(ctx context.Context, count int, opts LeaseOptions) ([]Lease, error) {
+	query := url.Values{}
+	query.Set("count", strconv.Itoa(count))
+	if opts.TTL > 0 {
+		query.Set("ttl", opts.TTL.String())
+	}
+	if opts.Pool != "" {
+		query.Set("pool", opts.Pool)
+	}
+
+	var resp struct {
+		Leases []Lease `json:"leases"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/keys/batch", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Leases, nil
+}
+
+// GetKeyInfo returns the metadata of key.
+func (c *Client) GetKeyInfo(ctx context.Context, key string) (KeyInfo, error) {
+	var info KeyInfo
+	err := c.do(ctx, http.MethodGet, keyPath("/keys/", key), nil, nil, &info)
+	return info, err
+}
+
+// KeepAlive refreshes key's last access and renews its lease if it is leased.
+func (c *Client) KeepAlive(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodPut, keyPath("/keepalive/", key), nil, nil, nil)
+}
+
+// Unblock ends the lease on key, whoever holds it.
+func (c *Client) Unblock(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodPut, keyPath("/keys/", key), nil, nil, nil)
+}
+
+// Release gives a leased key back early. Unlike Unblock it only succeeds
+// for the holder of the lease.
+func (c *Client) Release(ctx context.Context, lease Lease) error {
+	body := struct {
+		LeaseToken string `json:"leaseToken"`
+	}{lease.LeaseToken}
+	return c.do(ctx, http.MethodPost, keyPath("/keys/", lease.KeyID)+"/release", nil, body, nil)
+}
+
+// Delete deletes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, keyPath("/keys/", key), nil, nil, nil)
+}
+
+func keyPath(prefix, key string) string {
+	return prefix + url.PathEscape(key)
+}
+
+// do sends a request with body, if not nil, encoded as JSON and decodes a
+// successful response into out, if not nil. Error responses are returned as
+// an *Error.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.ClientID != "" {
+		req.Header.Set("X-Client-Id", c.ClientID)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
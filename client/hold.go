@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeatInterval is how often Hold keeps a lease alive when no
+// interval is given. It is a quarter of the server's default lease.
+const DefaultHeartbeatInterval = 5 * time.Second
+
+// HeldLease is a lease kept alive in the background by Hold.
+type HeldLease struct {
+	Lease
+
+	client *Client
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Hold keeps lease alive by calling KeepAlive every interval until the
+// returned HeldLease is released or ctx is done. A zero interval uses
+// DefaultHeartbeatInterval. Heartbeats that fail are retried on the next
+// tick, except when the key has been deleted or the lease may not be renewed
+// again, which stops them.
+func (c *Client) Hold(ctx context.Context, lease Lease, interval time.Duration) *HeldLease {
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	h := &HeldLease{Lease: lease, client: c, cancel: cancel, done: make(chan struct{})}
+	go h.heartbeat(ctx, interval)
+	return h
+}
+
+func (h *HeldLease) heartbeat(ctx context.Context, interval time.Duration) {
+	defer close(h.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := h.client.KeepAlive(ctx, h.KeyID)
+		if ctx.Err() != nil {
+			return
+		}
+		h.mu.Lock()
+		h.err = err
+		h.mu.Unlock()
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyDeleted) || errors.Is(err, ErrRenewalLimit) {
+			return
+		}
+	}
+}
+
+// Err returns the error from the most recent heartbeat, or nil if it
+// succeeded.
+func (h *HeldLease) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Done is closed once heartbeats have stopped, whether because the lease
+// was released, its context ended or the key was lost.
+func (h *HeldLease) Done() <-chan struct{} {
+	return h.done
+}
+
+// Stop ends the heartbeats without releasing the key, which then stays
+// leased until its lease runs out.
+func (h *HeldLease) Stop() {
+	h.cancel()
+	<-h.done
+}
+
+// Release ends the heartbeats and gives the key back.
+func (h *HeldLease) Release(ctx context.Context) error {
+	h.Stop()
+	return h.client.Release(ctx, h.Lease)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"keys-generator/client"
+)
+
+// newTestClient serves NewRouter for km over HTTP and returns a client for
+// it that authenticates with token.
+func newTestClient(t *testing.T, km *KeyManager, cfg RouterConfig, token string) *client.Client {
+	t.Helper()
+	srv := httptest.NewServer(newTestRouter(km, cfg))
+	t.Cleanup(srv.Close)
+	return client.New(srv.URL, token)
+}
+
+func TestClientLifecycle(t *testing.T) {
+	km, _ := newTestManager(t, Config{BlockTTL: time.Minute})
+	c := newTestClient(t, km, RouterConfig{}, "")
+	ctx := context.Background()
+
+	key, err := c.GenerateKey(ctx, map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	lease, err := c.LeaseKey(ctx, client.LeaseOptions{TTL: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+	if lease.KeyID != key || lease.LeaseToken == "" {
+		t.Fatalf("LeaseKey = %+v, want %q with a token", lease, key)
+	}
+
+	info, err := c.GetKeyInfo(ctx, key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.IsBlocked || info.Tags["env"] != "prod" || info.ExpiresIn != 30 {
+		t.Fatalf("GetKeyInfo of leased key = %+v", info)
+	}
+	if err := c.KeepAlive(ctx, key); err != nil {
+		t.Fatalf("KeepAlive: %v", err)
+	}
+	if err := c.Release(ctx, lease); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	leases, err := c.LeaseKeys(ctx, 1, client.LeaseOptions{})
+	if err != nil {
+		t.Fatalf("LeaseKeys: %v", err)
+	}
+	if len(leases) != 1 || leases[0].KeyID != key {
+		t.Fatalf("LeaseKeys = %+v, want the released key", leases)
+	}
+	if err := c.Unblock(ctx, key); err != nil {
+		t.Fatalf("Unblock: %v", err)
+	}
+	if err := c.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got := km.Stats().Total; got != 0 {
+		t.Fatalf("Total = %d after Delete, want 0", got)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	const token = "s3cret"
+	km, _ := newTestManager(t, Config{MaxKeys: 1})
+	c := newTestClient(t, km, RouterConfig{AdminToken: token}, token)
+	ctx := context.Background()
+	key, err := c.GenerateKey(ctx, nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		call   func() error
+		status int
+		code   string
+		want   error
+	}{
+		{"unknown key", func() error {
+			_, err := c.GetKeyInfo(ctx, "unknown-key")
+			return err
+		}, http.StatusNotFound, CodeKeyNotFound, client.ErrKeyNotFound},
+		{"full pool", func() error {
+			_, err := c.GenerateKey(ctx, nil)
+			return err
+		}, http.StatusServiceUnavailable, CodePoolFull, client.ErrPoolFull},
+		{"unblock available key", func() error {
+			return c.Unblock(ctx, key)
+		}, http.StatusConflict, CodeKeyNotBlocked, client.ErrKeyNotBlocked},
+		{"wrong lease token", func() error {
+			if _, err := c.LeaseKey(ctx, client.LeaseOptions{}); err != nil {
+				return err
+			}
+			return c.Release(ctx, client.Lease{KeyID: key, LeaseToken: "wrong"})
+		}, http.StatusForbidden, CodeLeaseNotHeld, client.ErrLeaseNotHeld},
+		{"empty pool", func() error {
+			_, err := c.LeaseKey(ctx, client.LeaseOptions{})
+			return err
+		}, http.StatusNotFound, CodeNoKeysAvailable, client.ErrNoKeysAvailable},
+		{"invalid pool", func() error {
+			_, err := c.LeaseKey(ctx, client.LeaseOptions{Pool: "no spaces"})
+			return err
+		}, http.StatusBadRequest, CodeInvalidRequest, client.ErrInvalidRequest},
+		{"wrong token", func() error {
+			return client.New(c.BaseURL, "wrong").Delete(ctx, key)
+		}, http.StatusUnauthorized, CodeUnauthorized, client.ErrUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+			var apiErr *client.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("got %v, want a *client.Error", err)
+			}
+			if apiErr.StatusCode != tc.status || apiErr.Code != tc.code || apiErr.RequestID == "" {
+				t.Fatalf("got %+v, want status %d and code %q with a request id", apiErr, tc.status, tc.code)
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("errors.Is(%v, %v) = false", err, tc.want)
+			}
+		})
+	}
+
+	if err := (&client.Error{Code: CodeVersionUnsupported}); !errors.Is(err, client.ErrVersionUnsupported) {
+		t.Fatalf("errors.Is(%v, ErrVersionUnsupported) = false", err)
+	}
+	if err := (&client.Error{Code: "something_new"}).Unwrap(); err != nil {
+		t.Fatalf("Unwrap of an unknown code = %v, want nil", err)
+	}
+}
+
+func TestClientHold(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	c := newTestClient(t, km, RouterConfig{}, "")
+	ctx := context.Background()
+	key, err := c.GenerateKey(ctx, nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	lease, err := c.LeaseKey(ctx, client.LeaseOptions{})
+	if err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+
+	held := c.Hold(ctx, lease, time.Millisecond)
+	waitFor(t, "heartbeats to renew the lease", func() bool {
+		info, err := km.GetKeyInfo(key)
+		return err == nil && info.Renewals >= 3
+	})
+	if err := held.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	select {
+	case <-held.Done():
+	default:
+		t.Fatal("heartbeats still running after Release")
+	}
+	if info, err := km.GetKeyInfo(key); err != nil || info.IsBlocked {
+		t.Fatalf("after Release: blocked %v, err %v", info.IsBlocked, err)
+	}
+}
+
+func TestClientHoldStops(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		lose func(t *testing.T, km *KeyManager, key string)
+		want error
+	}{
+		{"key deleted", Config{}, func(t *testing.T, km *KeyManager, key string) {
+			if err := km.DeleteKey(key); err != nil {
+				t.Errorf("DeleteKey: %v", err)
+			}
+		}, client.ErrKeyNotFound},
+		{"key soft-deleted", Config{DeleteGracePeriod: time.Hour}, func(t *testing.T, km *KeyManager, key string) {
+			if err := km.DeleteKey(key); err != nil {
+				t.Errorf("DeleteKey: %v", err)
+			}
+		}, client.ErrKeyDeleted},
+		{"renewal limit", Config{MaxRenewals: 2}, func(*testing.T, *KeyManager, string) {}, client.ErrRenewalLimit},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			km, _ := newTestManager(t, tc.cfg)
+			c := newTestClient(t, km, RouterConfig{}, "")
+			ctx := context.Background()
+			key, err := c.GenerateKey(ctx, nil)
+			if err != nil {
+				t.Fatalf("GenerateKey: %v", err)
+			}
+			lease, err := c.LeaseKey(ctx, client.LeaseOptions{})
+			if err != nil {
+				t.Fatalf("LeaseKey: %v", err)
+			}
+
+			held := c.Hold(ctx, lease, time.Millisecond)
+			defer held.Stop()
+			tc.lose(t, km, key)
+			select {
+			case <-held.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("heartbeats did not stop")
+			}
+			if err := held.Err(); !errors.Is(err, tc.want) {
+				t.Fatalf("Err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientHoldStopsWithContext(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	c := newTestClient(t, km, RouterConfig{}, "")
+	if _, err := c.GenerateKey(context.Background(), nil); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	lease, err := c.LeaseKey(context.Background(), client.LeaseOptions{})
+	if err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	held := c.Hold(ctx, lease, time.Millisecond)
+	cancel()
+	select {
+	case <-held.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeats did not stop when the context ended")
+	}
+	// Stopping leaves the key leased.
+	if info, err := km.GetKeyInfo(lease.KeyID); err != nil || !info.IsBlocked {
+		t.Fatalf("after cancelling Hold: blocked %v, err %v, want the key still leased", info.IsBlocked, err)
+	}
+}
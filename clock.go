@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is KeyManager's source of time. Leases, idle deadlines and the sweep
+// are all measured against it, so tests can swap in a MockClock and move time
+// forward instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of *time.Timer that BackgroundTask uses.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// MockClock is a Clock that only moves when Advance or Set is called. Timers
+// created from it fire as soon as the clock passes their deadline.
+type MockClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*mockTimer
+}
+
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+func (c *MockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *MockClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &mockTimer{clock: c, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	t.arm(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers that fall due.
+func (c *MockClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to now, firing any timers that fall due.
+func (c *MockClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+	for _, t := range c.timers {
+		t.fireIfDue()
+	}
+}
+
+// mockTimer is a Timer driven by a MockClock. Its fields are guarded by the
+// clock's mu.
+type mockTimer struct {
+	clock  *MockClock
+	ch     chan time.Time
+	due    time.Time
+	active bool
+}
+
+func (t *mockTimer) C() <-chan time.Time { return t.ch }
+
+func (t *mockTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *mockTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasActive := t.active
+	t.arm(d)
+	return wasActive
+}
+
+// arm schedules the timer d after the clock's current time. The caller must
+// hold t.clock.mu.
+func (t *mockTimer) arm(d time.Duration) {
+	t.due = t.clock.now.Add(d)
+	t.active = true
+	t.fireIfDue()
+}
+
+// fireIfDue delivers the current time if the timer is due. Like time.Timer
+// the channel holds at most one value. The caller must hold t.clock.mu.
+func (t *mockTimer) fireIfDue() {
+	if !t.active || t.clock.now.Before(t.due) {
+		return
+	}
+	t.active = false
+	select {
+	case t.ch <- t.clock.now:
+	default:
+	}
+}
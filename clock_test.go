@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMockClockTimer(t *testing.T) {
+	clock := NewMockClock(testEpoch)
+	timer := clock.NewTimer(time.Minute)
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case got := <-timer.C():
+		if want := testEpoch.Add(time.Minute); !got.Equal(want) {
+			t.Fatalf("timer fired at %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("timer did not fire at its deadline")
+	}
+
+	if timer.Reset(time.Minute); !timer.Stop() {
+		t.Fatal("Stop of a reset timer reported it inactive")
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+}
+
+func TestMockClockDrivesBackgroundTask(t *testing.T) {
+	km, clock := newTestManager(t, Config{
+		BlockTTL: time.Minute,
+		IdleTTL:  5 * time.Minute,
+	})
+	leased := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	idle := mustGenerate(t, km)
+	runBackground(t, km)
+
+	clock.Advance(time.Minute + time.Second)
+	waitFor(t, "the lease to expire", func() bool {
+		info, err := km.GetKeyInfo(leased)
+		return err == nil && !info.IsBlocked
+	})
+
+	clock.Advance(4 * time.Minute)
+	waitFor(t, "the idle key to be deleted", func() bool {
+		_, err := km.GetKeyInfo(idle)
+		return errors.Is(err, ErrKeyNotFound)
+	})
+	if _, err := km.GetKeyInfo(leased); err != nil {
+		t.Fatalf("GetKeyInfo of formerly leased key: %v, want it kept", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig lets browser pages on other origins call the API. CORS is off
+// while AllowedOrigins is empty.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to call the API, such as
+	// "https://dashboard.example.com", or "*" for any origin.
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders are offered to preflight requests.
+	// Empty means defaultCORSMethods and defaultCORSHeaders.
+	AllowedMethods []string
+	AllowedHeaders []string
+}
+
+var (
+	defaultCORSMethods = []string{
+		http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+	}
+	defaultCORSHeaders = []string{
+		"Authorization", "Content-Type", "If-Match", "X-API-Key", ClientIDHeader, RequestIDHeader,
+	}
+	// corsExposedHeaders are the response headers scripts may read.
+	corsExposedHeaders = []string{"ETag", "Retry-After", RequestIDHeader}
+)
+
+// cors adds CORS headers to responses for allowed origins and answers their
+// preflight requests itself, ahead of authentication and routing. Requests
+// from other origins get no CORS headers, so browsers refuse them.
+func cors(cfg CORSConfig) gin.HandlerFunc {
+	methods := strings.Join(orDefault(cfg.AllowedMethods, defaultCORSMethods), ", ")
+	headers := strings.Join(orDefault(cfg.AllowedHeaders, defaultCORSHeaders), ", ")
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	anyOrigin := slices.Contains(cfg.AllowedOrigins, "*")
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Origin")
+		if !anyOrigin && !slices.Contains(cfg.AllowedOrigins, origin) {
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", methods)
+			c.Header("Access-Control-Allow-Headers", headers)
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Header("Access-Control-Expose-Headers", exposed)
+		c.Next()
+	}
+}
+
+// orDefault returns list, or def if list is empty.
+func orDefault(list, def []string) []string {
+	if len(list) == 0 {
+		return def
+	}
+	return list
+}
+
+// parseList splits a comma-separated list, dropping empty entries.
+func parseList(raw string) []string {
+	var list []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	const allowed = "https://dashboard.example.com"
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{
+		AdminToken: "s3cret",
+		CORS:       CORSConfig{AllowedOrigins: []string{allowed}},
+	})
+	request := func(method, origin string, preflight bool) *http.Response {
+		t.Helper()
+		req := newRequest(t, method, "/stats", nil)
+		req.Header.Set("Origin", origin)
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		return serveRequest(r, req).Result()
+	}
+
+	resp := request(http.MethodGet, allowed, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET from an allowed origin: status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != allowed {
+		t.Fatalf("Access-Control-Allow-Origin = %q, want %q", got, allowed)
+	}
+	if got := resp.Header.Get("Access-Control-Expose-Headers"); got != "ETag, Retry-After, X-Request-Id" {
+		t.Fatalf("Access-Control-Expose-Headers = %q", got)
+	}
+
+	// Preflights are answered ahead of authentication.
+	resp = request(http.MethodOptions, allowed, true)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("preflight from an allowed origin: status %d, want 204", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Methods"); got != "GET, POST, PUT, PATCH, DELETE" {
+		t.Fatalf("Access-Control-Allow-Methods = %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != allowed {
+		t.Fatalf("preflight Access-Control-Allow-Origin = %q, want %q", got, allowed)
+	}
+
+	for _, preflight := range []bool{false, true} {
+		method := http.MethodGet
+		if preflight {
+			method = http.MethodOptions
+		}
+		resp := request(method, "https://evil.example.com", preflight)
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Fatalf("%s from a disallowed origin: Access-Control-Allow-Origin = %q", method, got)
+		}
+		if got := resp.Header.Get("Vary"); got != "Origin" {
+			t.Fatalf("%s from a disallowed origin: Vary = %q, want Origin", method, got)
+		}
+		if preflight && resp.StatusCode == http.StatusNoContent {
+			t.Fatal("preflight from a disallowed origin was answered")
+		}
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{CORS: CORSConfig{AllowedOrigins: []string{"*"}}})
+	req := newRequest(t, http.MethodGet, "/keys/list", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	w := serveRequest(r, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://anywhere.example.com" {
+		t.Fatalf("Access-Control-Allow-Origin = %q, want the request's origin", got)
+	}
+
+	// Without CORS configured no headers are added.
+	r = newTestRouter(km, RouterConfig{})
+	w = serveRequest(r, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("Access-Control-Allow-Origin without CORS = %q", got)
+	}
+}
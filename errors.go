@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIError is the body of every error response.
+type APIError struct {
+	// Code is a stable, machine-readable identifier such as "key_not_found".
+	Code string `json:"code"`
+	// Message is a human-readable description of the problem.
+	Message string `json:"message"`
+	// Details carries extra context for some errors.
+	Details any `json:"details,omitempty"`
+	// RequestID is the id of the failed request, as in the X-Request-Id
+	// response header.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Error codes returned in APIError.Code.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeBodyTooLarge       = "body_too_large"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeInvalidBatchSize   = "invalid_batch_size"
+	CodeInvalidState       = "invalid_state"
+	CodeUnauthorized       = "unauthorized"
+	CodeKeyNotFound        = "key_not_found"
+	CodeKeyExists          = "key_exists"
+	CodeKeyNotBlocked      = "key_not_blocked"
+	CodeNoKeysAvailable    = "no_keys_available"
+	CodeRateLimited        = "rate_limited"
+	CodePoolFull           = "pool_full"
+	CodeNotReady           = "not_ready"
+	CodeStoreUnavailable   = "store_unavailable"
+	CodeLeaseNotHeld       = "lease_not_held"
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeTooManyLeases      = "too_many_leases"
+	CodeKeyDeleted         = "key_deleted"
+	CodeKeyNotDeleted      = "key_not_deleted"
+	CodeKeyNotReserved     = "key_not_reserved"
+	CodeRenewalLimit       = "renewal_limit"
+	CodeVersionMismatch    = "version_mismatch"
+	CodeVersionUnsupported = "version_unsupported"
+	CodeMissingIfMatch     = "precondition_required"
+	CodeTimeout            = "timeout"
+	CodeCanceled           = "canceled"
+	CodeInternal           = "internal_error"
+)
+
+// storeErrors maps the sentinel errors returned by a KeyStore to the status
+// and code the API reports for them.
+var storeErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrKeyNotFound, http.StatusNotFound, CodeKeyNotFound},
+	{ErrKeyNotBlocked, http.StatusConflict, CodeKeyNotBlocked},
+	{ErrKeyExists, http.StatusConflict, CodeKeyExists},
+	{ErrKeyDeleted, http.StatusGone, CodeKeyDeleted},
+	{ErrKeyNotDeleted, http.StatusConflict, CodeKeyNotDeleted},
+	{ErrKeyNotReserved, http.StatusConflict, CodeKeyNotReserved},
+	{ErrRenewalLimit, http.StatusConflict, CodeRenewalLimit},
+	{ErrVersionMismatch, http.StatusPreconditionFailed, CodeVersionMismatch},
+	{ErrVersionUnsupported, http.StatusNotImplemented, CodeVersionUnsupported},
+	{ErrNoKeysAvailable, http.StatusNotFound, CodeNoKeysAvailable},
+	{ErrPoolFull, http.StatusServiceUnavailable, CodePoolFull},
+	{ErrTooManyLeases, http.StatusServiceUnavailable, CodeTooManyLeases},
+	{ErrStoreUnavailable, http.StatusServiceUnavailable, CodeStoreUnavailable},
+	{ErrNotPersisted, http.StatusServiceUnavailable, CodeStoreUnavailable},
+	{ErrLeaseNotHeld, http.StatusForbidden, CodeLeaseNotHeld},
+	{ErrQuotaExceeded, http.StatusTooManyRequests, CodeQuotaExceeded},
+	{ErrInvalidBatchSize, http.StatusBadRequest, CodeInvalidBatchSize},
+	{ErrInvalidState, http.StatusBadRequest, CodeInvalidState},
+	{ErrInvalidImport, http.StatusBadRequest, CodeInvalidRequest},
+	{ErrInvalidKeyID, http.StatusBadRequest, CodeInvalidRequest},
+	{ErrInvalidPool, http.StatusBadRequest, CodeInvalidRequest},
+	{ErrPoolUnsupported, http.StatusBadRequest, CodeInvalidRequest},
+	{ErrSlidingUnsupported, http.StatusBadRequest, CodeInvalidRequest},
+	{ErrReservationUnsupported, http.StatusBadRequest, CodeInvalidRequest},
+	{ErrInvalidTTL, http.StatusBadRequest, CodeInvalidRequest},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, CodeTimeout},
+	{context.Canceled, StatusClientClosedRequest, CodeCanceled},
+}
+
+// StatusClientClosedRequest is reported when the client went away before the
+// store finished. Nobody is left to read it, but it keeps such requests out
+// of the 5xx counts in access logs.
+const StatusClientClosedRequest = 499
+
+// storeErrorStatus looks err up in storeErrors, reporting false for errors
+// the API does not know about.
+func storeErrorStatus(err error) (status int, code string, ok bool) {
+	for _, se := range storeErrors {
+		if errors.Is(err, se.err) {
+			return se.status, se.code, true
+		}
+	}
+	return 0, "", false
+}
+
+// writeError aborts the request with an APIError.
+func writeError(c *gin.Context, status int, code, message string) {
+	abortWithAPIError(c, status, APIError{Code: code, Message: message})
+}
+
+// abortWithAPIError aborts the request with apiErr, tagged with the request's
+// id.
+func abortWithAPIError(c *gin.Context, status int, apiErr APIError) {
+	apiErr.RequestID = requestIDFromContext(c.Request.Context())
+	c.AbortWithStatusJSON(status, apiErr)
+}
+
+// pressureReporter is implemented by stores that can explain why a lease
+// found the pool empty.
+type pressureReporter interface {
+	PoolPressure() PoolPressure
+}
+
+// writeNoKeysAvailable writes the 404 for an empty pool with the pool's counts
+// as details, plus a Retry-After header when a leased key will free up.
+func writeNoKeysAvailable(c *gin.Context, err error, pressure PoolPressure) {
+	if !pressure.NextFreeAt.IsZero() {
+		delay := max(time.Until(pressure.NextFreeAt), time.Second)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	}
+	abortWithAPIError(c, http.StatusNotFound, APIError{
+		Code:    CodeNoKeysAvailable,
+		Message: err.Error(),
+		Details: pressure,
+	})
+}
+
+// writeStoreError aborts the request with the APIError matching err. Errors
+// the API does not know about are logged and reported as a generic 500 so
+// backend details are not leaked to clients.
+func writeStoreError(c *gin.Context, err error) {
+	if status, code, ok := storeErrorStatus(err); ok {
+		writeError(c, status, code, err.Error())
+		return
+	}
+
+	slog.Error("handling request", "method", c.Request.Method, "path", c.FullPath(),
+		"requestId", requestIDFromContext(c.Request.Context()), "err", err)
+	writeError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storeErrorResponse records what writeStoreError answers for err.
+func storeErrorResponse(t *testing.T, err error) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	writeStoreError(c, err)
+	return w
+}
+
+func TestWriteStoreError(t *testing.T) {
+	for _, se := range storeErrors {
+		// Stores wrap the sentinels with detail, which must not matter.
+		err := fmt.Errorf("%w: detail", se.err)
+		w := storeErrorResponse(t, err)
+		expectError(t, w, se.status, se.code)
+		if got := decodeBody[APIError](t, w).Message; got != err.Error() {
+			t.Errorf("%v: message = %q", se.err, got)
+		}
+	}
+
+	w := storeErrorResponse(t, errors.New("disk on fire"))
+	expectError(t, w, http.StatusInternalServerError, CodeInternal)
+	if got := decodeBody[APIError](t, w).Message; got != "internal server error" {
+		t.Errorf("unknown error leaked as %q", got)
+	}
+}
+
+func TestStoreErrorsThroughRouter(t *testing.T) {
+	km, _ := newTestManager(t, Config{DeleteGracePeriod: time.Hour})
+	r := newTestRouter(km, RouterConfig{})
+	strict := newTestRouter(km, RouterConfig{RequireIfMatch: true})
+	leased := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	available := mustGenerate(t, km)
+	deleted := mustGenerate(t, km)
+	if err := km.DeleteKey(deleted); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+
+	for _, tc := range []struct {
+		h              http.Handler
+		method, target string
+		body           any
+		status         int
+		code           string
+	}{
+		{r, http.MethodGet, "/keys/missing", nil, http.StatusNotFound, CodeKeyNotFound},
+		{r, http.MethodPut, "/keys/" + available, nil, http.StatusConflict, CodeKeyNotBlocked},
+		{r, http.MethodPost, "/keys", generateRequest{KeyID: available}, http.StatusConflict, CodeKeyExists},
+		{r, http.MethodPost, "/keys/" + deleted + "/activate", nil, http.StatusGone, CodeKeyDeleted},
+		{r, http.MethodPost, "/keys/" + available + "/restore", nil, http.StatusConflict, CodeKeyNotDeleted},
+		{r, http.MethodPost, "/keys/" + available + "/activate", nil, http.StatusConflict, CodeKeyNotReserved},
+		{strict, http.MethodPut, "/keys/" + leased, nil, http.StatusPreconditionRequired, CodeMissingIfMatch},
+		{r, http.MethodPost, "/keys/" + leased + "/release", releaseRequest{LeaseToken: "wrong"}, http.StatusForbidden, CodeLeaseNotHeld},
+		{r, http.MethodPost, "/keys/batch", batchRequest{Count: DefaultMaxBatchSize + 1}, http.StatusBadRequest, CodeInvalidBatchSize},
+		{r, http.MethodGet, "/keys/list?state=odd", nil, http.StatusBadRequest, CodeInvalidState},
+	} {
+		w := doRequest(t, tc.h, tc.method, tc.target, tc.body)
+		expectError(t, w, tc.status, tc.code)
+	}
+
+	req := newRequest(t, http.MethodPut, "/keys/"+leased, nil)
+	req.Header.Set("If-Match", etag(0))
+	expectError(t, serveRequest(r, req), http.StatusPreconditionFailed, CodeVersionMismatch)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind by before
+// further events are dropped for it.
+const eventBufferSize = 64
+
+// eventBus fans key events out to subscribers. Publishing never blocks: a
+// subscriber whose buffer is full misses the event, which is counted so it
+// can be told how many it lost.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   map[*eventSub]struct{}
+	closed bool
+}
+
+// eventSub is one subscriber's view of an eventBus.
+type eventSub struct {
+	// C receives the events. It is closed when the bus is closed.
+	C chan KeyEvent
+	// dropped counts the events missed since it was last reset.
+	dropped atomic.Int64
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*eventSub]struct{})}
+}
+
+// subscribe registers a new subscriber. The returned function unsubscribes
+// it and must be called once the subscriber is done.
+func (b *eventBus) subscribe() (*eventSub, func()) {
+	sub := &eventSub{C: make(chan KeyEvent, eventBufferSize)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.C)
+		return sub, func() {}
+	}
+	b.subs[sub] = struct{}{}
+
+	return sub, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[sub]; ok {
+			delete(b.subs, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// publish hands ev to every subscriber with room for it.
+func (b *eventBus) publish(ev KeyEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub.C <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// subscribers returns the number of current subscribers.
+func (b *eventBus) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// close ends every subscription and refuses new ones.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.C)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readSSE reads the next server-sent event from r, returning its name and
+// data.
+func readSSE(t *testing.T, r *bufio.Reader) (name, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, data
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	srv := httptest.NewServer(newTestRouter(km, RouterConfig{}))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", got)
+	}
+	waitFor(t, "the stream to subscribe", func() bool { return km.events.subscribers() == 1 })
+
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	if err := km.UnblockKey(key); err != nil {
+		t.Fatalf("UnblockKey: %v", err)
+	}
+	if err := km.DeleteKey(key); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for _, want := range []string{EventGenerated, EventLeased, EventUnblocked, EventDeleted} {
+		name, data := readSSE(t, r)
+		var ev KeyEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("decoding %q event %q: %v", name, data, err)
+		}
+		if name != want || ev.Event != want || ev.Key != key || !ev.At.Equal(testEpoch) {
+			t.Fatalf("got %q event %+v, want %q for %q at %v", name, ev, want, key, testEpoch)
+		}
+	}
+}
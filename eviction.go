@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// EvictionPolicy decides what happens when a new key would take the pool
+// past MaxKeys.
+type EvictionPolicy string
+
+const (
+	// EvictReject refuses the new key with ErrPoolFull.
+	EvictReject EvictionPolicy = "reject"
+	// EvictLRU deletes the available key that has gone longest without
+	// being accessed to make room.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictOldest deletes the available key that was created first.
+	EvictOldest EvictionPolicy = "oldest"
+)
+
+var ErrInvalidEvictionPolicy = errors.New(`eviction policy must be one of "reject", "lru" or "oldest"`)
+
+// makeRoom ensures n more keys fit under MaxKeys, evicting available keys as
+// km.Eviction allows. Leased, cooling and soft-deleted keys are never
+// evicted. It returns ErrPoolFull, having evicted nothing, when room cannot
+// be made. The caller must hold km.mu.
+func (km *KeyManager) makeRoom(n int) error {
+	excess := len(km.keys) + n - km.MaxKeys
+	if km.MaxKeys <= 0 || excess <= 0 {
+		return nil
+	}
+	if km.Eviction != EvictLRU && km.Eviction != EvictOldest {
+		return ErrPoolFull
+	}
+
+	candidates := make([]KeyMetadata, 0, km.availableCount())
+	for _, keys := range km.available {
+		for _, key := range keys {
+			candidates = append(candidates, km.keys[key])
+		}
+	}
+	if len(candidates) < excess {
+		return ErrPoolFull
+	}
+
+	if km.Eviction == EvictLRU {
+		sort.Slice(candidates, func(i, j int) bool {
+			ai, aj := lastActivity(candidates[i]), lastActivity(candidates[j])
+			if !ai.Equal(aj) {
+				return ai.Before(aj)
+			}
+			return candidates[i].Key < candidates[j].Key
+		})
+	} else {
+		sortByCreation(candidates)
+	}
+
+	evicted := make(map[string]bool, excess)
+	for _, metadata := range candidates[:excess] {
+		evicted[metadata.Key] = true
+		km.forgetKey(metadata.Key)
+		km.metrics.evicted.Inc()
+	}
+	km.removeAvailableKeys(evicted)
+	km.logger.Debug("evicted keys to make room", "count", excess)
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy EvictionPolicy
+		// evicted is the index of the key that should make room, or -1 if
+		// the new key should be refused.
+		evicted int
+	}{
+		{EvictReject, -1},
+		{EvictLRU, 2},
+		{EvictOldest, 1},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			km, clock := newTestManager(t, Config{MaxKeys: 3, Eviction: tc.policy, Strategy: StrategyFIFO})
+			var keys []string
+			for range 3 {
+				keys = append(keys, mustGenerate(t, km))
+				clock.Advance(time.Second)
+			}
+			// The oldest key is leased, and the second has been used since
+			// the third was created.
+			mustLease(t, km, time.Hour)
+			if err := km.KeepAlive(keys[1]); err != nil {
+				t.Fatalf("KeepAlive: %v", err)
+			}
+
+			added, err := km.GenerateNewKey()
+			if tc.evicted < 0 {
+				if !errors.Is(err, ErrPoolFull) {
+					t.Fatalf("GenerateNewKey on a full pool: got %v, want ErrPoolFull", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GenerateNewKey on a full pool: %v", err)
+			}
+			for i, key := range keys {
+				_, err := km.GetKeyInfo(key)
+				if gone := errors.Is(err, ErrKeyNotFound); gone != (i == tc.evicted) {
+					t.Fatalf("key %d: GetKeyInfo = %v, want only key %d evicted", i, err, tc.evicted)
+				}
+			}
+
+			// With every remaining key leased there is nothing to evict.
+			for range 2 {
+				mustLease(t, km, time.Hour)
+			}
+			if _, err := km.GenerateNewKey(); !errors.Is(err, ErrPoolFull) {
+				t.Fatalf("GenerateNewKey with every key leased: got %v, want ErrPoolFull", err)
+			}
+			for _, key := range []string{keys[0], added} {
+				if info, err := km.GetKeyInfo(key); err != nil || !info.IsBlocked {
+					t.Fatalf("leased key %q: blocked %v, err %v, want it kept", key, info.IsBlocked, err)
+				}
+			}
+		})
+	}
+}
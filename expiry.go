@@ -0,0 +1,86 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryEntry records that key may fall due at due.
+type expiryEntry struct {
+	key string
+	due time.Time
+}
+
+// expiryHeap is a min-heap of expiryEntry ordered by due, implementing
+// heap.Interface.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryEntry)) }
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// The expiry heap lets the sweep look only at keys that are actually due
+// instead of scanning every map. It is an index, not a source of truth:
+// entries are never removed when a deadline moves, and the sweep re-checks
+// each popped entry against the maps with dueAt. The one invariant is that
+// every key has at least one entry no later than its real deadline, so
+// schedule must be called whenever a key is added or its deadline is brought
+// forward. Deadlines that move later, as with KeepAlive, need nothing.
+
+// schedule records that key falls due at due and wakes BackgroundTask in case
+// that is sooner than it planned. The caller must hold km.mu.
+func (km *KeyManager) schedule(key string, due time.Time) {
+	heap.Push(&km.expiries, expiryEntry{key: key, due: due})
+	km.nudge()
+
+	// Superseded entries only leave the heap once they come due, so rebuild
+	// it if they start to dominate.
+	if len(km.expiries) > 4*len(km.keys)+64 {
+		km.rebuildExpiries()
+	}
+}
+
+// rebuildExpiries replaces the heap with exactly one entry per key. The
+// caller must hold km.mu.
+func (km *KeyManager) rebuildExpiries() {
+	km.expiries = make(expiryHeap, 0, len(km.keys))
+	for key := range km.keys {
+		due, _ := km.dueAt(key)
+		km.expiries = append(km.expiries, expiryEntry{key: key, due: due})
+	}
+	heap.Init(&km.expiries)
+}
+
+// dueAt returns the earliest time the sweep has to act on key: the end of
+// its grace period if it is soft-deleted, otherwise the soonest of its lease
+// expiry, the end of its cooldown or reservation and its idle deadline, which
+// leased keys do not have under ExemptBlocked. It reports false if key does
+// not exist. The caller must hold km.mu.
+func (km *KeyManager) dueAt(key string) (time.Time, bool) {
+	metadata, exists := km.keys[key]
+	if !exists {
+		return time.Time{}, false
+	}
+	if deletedAt, deleted := km.deleted[key]; deleted {
+		return deletedAt.Add(km.DeleteGracePeriod), true
+	}
+	due := lastActivity(metadata).Add(km.IdleTTL)
+	if expiry, blocked := km.blocked[key]; blocked && (km.ExemptBlocked || expiry.Before(due)) {
+		due = expiry
+	}
+	if until, cooling := km.cooling[key]; cooling && until.Before(due) {
+		due = until
+	}
+	if until, reserved := km.reserved[key]; reserved && until.Before(due) {
+		due = until
+	}
+	return due, true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiriesFireInOrder(t *testing.T) {
+	km, clock := newTestManager(t, Config{MaxBlockTTL: time.Hour})
+	sub, unsubscribe := km.events.subscribe()
+	defer unsubscribe()
+
+	// Lease for 5, 1, 4, 2 and 3 seconds, in that order.
+	bySeconds := make(map[int]string)
+	for _, seconds := range []int{5, 1, 4, 2, 3} {
+		mustGenerate(t, km)
+		bySeconds[seconds] = mustLease(t, km, time.Duration(seconds)*time.Second).KeyID
+	}
+
+	var got []string
+	for step := 1; step <= 20; step++ {
+		clock.Advance(500 * time.Millisecond)
+		if step == 3 {
+			// At 1.5s, push the 2s lease out to 3.5s, leaving its old
+			// heap entry behind.
+			if err := km.KeepAlive(bySeconds[2]); err != nil {
+				t.Fatalf("KeepAlive: %v", err)
+			}
+		}
+		km.sweep(clock.Now())
+		for len(sub.C) > 0 {
+			if ev := <-sub.C; ev.Event == EventExpired {
+				got = append(got, ev.Key)
+			}
+		}
+	}
+
+	want := []string{bySeconds[1], bySeconds[3], bySeconds[2], bySeconds[4], bySeconds[5]}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expired in order %v, want %v", got, want)
+	}
+}
+
+func TestSweepOrderWithinOneSweep(t *testing.T) {
+	km, clock := newTestManager(t, Config{MaxBlockTTL: time.Hour})
+	sub, unsubscribe := km.events.subscribe()
+	defer unsubscribe()
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		mustGenerate(t, km)
+	}
+	for i := 5; i > 0; i-- {
+		lease := mustLease(t, km, time.Duration(i)*time.Second)
+		want = append([]string{lease.KeyID}, want...)
+	}
+
+	clock.Advance(time.Minute)
+	km.sweep(clock.Now())
+	var got []string
+	for len(sub.C) > 0 {
+		if ev := <-sub.C; ev.Event == EventExpired {
+			got = append(got, ev.Key)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("one sweep expired %v, want earliest first %v", got, want)
+	}
+}
+
+// BenchmarkSweepNothingDue measures a sweep that finds nothing to do. With
+// the expiry heap it only peeks at the earliest deadline, so its cost stays
+// flat as the pool grows where a scan of every key would grow with it.
+func BenchmarkSweepNothingDue(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			km, clock := newBenchManager(b, n)
+			now := clock.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				km.sweep(now)
+			}
+		})
+	}
+}
+
+// BenchmarkSweepOneDue measures a sweep that reclaims a single lease out of
+// a pool of n keys.
+func BenchmarkSweepOneDue(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			km, clock := newBenchManager(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				lease, err := km.LeaseKey(time.Second)
+				if err != nil {
+					b.Fatal(err)
+				}
+				clock.Advance(2 * time.Second)
+				b.StartTimer()
+				km.sweep(clock.Now())
+				b.StopTimer()
+				if info, _ := km.GetKeyInfo(lease.KeyID); info.IsBlocked {
+					b.Fatal("lease not reclaimed")
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// newBenchManager returns a manager on a MockClock holding n available keys
+// that will not go idle during the benchmark.
+func newBenchManager(b *testing.B, n int) (*KeyManager, *MockClock) {
+	b.Helper()
+	clock := NewMockClock(testEpoch)
+	km, err := NewKeyManagerWithConfig(Config{
+		Clock:        clock,
+		Logger:       discardLogger,
+		IdleTTL:      24 * 365 * time.Hour,
+		MaxBatchSize: n,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := km.GenerateKeys(n); err != nil {
+		b.Fatal(err)
+	}
+	return km, clock
+}
+
+func TestExemptBlockedKeyOutlivesIdleTTL(t *testing.T) {
+	km, clock := newTestManager(t, Config{
+		IdleTTL:       time.Minute,
+		MaxBlockTTL:   time.Hour,
+		ExemptBlocked: true,
+		Strategy:      StrategyFIFO,
+	})
+	leased := mustGenerate(t, km)
+	idle := mustGenerate(t, km)
+	mustLease(t, km, time.Hour)
+
+	clock.Advance(30 * time.Minute)
+	km.sweep(clock.Now())
+	info, err := km.GetKeyInfo(leased)
+	if err != nil {
+		t.Fatalf("GetKeyInfo of leased key past IdleTTL: %v, want it kept", err)
+	}
+	if !info.IsBlocked {
+		t.Fatal("leased key lost its lease past IdleTTL")
+	}
+	if _, err := km.GetKeyInfo(idle); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo of available key: got %v, want it deleted as idle", err)
+	}
+
+	// Once the lease ends the key is subject to IdleTTL again.
+	clock.Advance(30*time.Minute + time.Second)
+	km.sweep(clock.Now())
+	if info, err := km.GetKeyInfo(leased); err != nil || info.IsBlocked {
+		t.Fatalf("after the lease ran out: blocked %v, err %v, want the key available", info.IsBlocked, err)
+	}
+	clock.Advance(time.Minute + time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(leased); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo a minute after the lease: got %v, want ErrKeyNotFound", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportResult reports what Import did with each entry it was given.
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// Export returns every key's metadata ordered by creation time, in the form
+// Import accepts.
+func (km *KeyManager) Export() []KeyMetadata {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	keys := make([]KeyMetadata, 0, len(km.keys))
+	for _, metadata := range km.keys {
+		keys = append(keys, metadata)
+	}
+	sortByCreation(keys)
+	return keys
+}
+
+// Import merges keys, typically produced by Export on another instance, into
+// the pool. Keys that already exist are skipped unless overwrite is set. Each
+// imported key is placed in the deleted, blocked or available index according
+// to its DeletedAt and IsBlocked fields. Nothing is imported if an entry has
+// a key id or pool name RegisterKey would reject, or if the result would
+// exceed MaxKeys.
+func (km *KeyManager) Import(keys []KeyMetadata, overwrite bool) (_ ImportResult, err error) {
+	defer km.writeThrough(&err)
+
+	for i, metadata := range keys {
+		if err := checkKeyID(metadata.Key, km.KeyValidator); err != nil {
+			return ImportResult{}, fmt.Errorf("%w: entry %d: %v", ErrInvalidImport, i, err)
+		}
+		if err := checkPoolName(metadata.Pool); err != nil {
+			return ImportResult{}, fmt.Errorf("%w: entry %d: %v", ErrInvalidImport, i, err)
+		}
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := km.checkPending(); err != nil {
+		return ImportResult{}, err
+	}
+
+	added := make(map[string]bool)
+	for _, metadata := range keys {
+		if _, exists := km.keys[metadata.Key]; !exists {
+			added[metadata.Key] = true
+		}
+	}
+	if km.MaxKeys > 0 && len(km.keys)+len(added) > km.MaxKeys {
+		return ImportResult{}, ErrPoolFull
+	}
+
+	var result ImportResult
+	for _, metadata := range keys {
+		if _, exists := km.keys[metadata.Key]; exists {
+			if !overwrite && !added[metadata.Key] {
+				result.Skipped++
+				continue
+			}
+			if _, blocked := km.blocked[metadata.Key]; blocked {
+				km.trackLease(km.keys[metadata.Key].Client, -1)
+			}
+			delete(km.blocked, metadata.Key)
+			delete(km.deleted, metadata.Key)
+			if _, cooling := km.cooling[metadata.Key]; cooling {
+				delete(km.cooling, metadata.Key)
+			} else if _, reserved := km.reserved[metadata.Key]; reserved {
+				delete(km.reserved, metadata.Key)
+			} else {
+				km.removeAvailable(metadata.Key)
+			}
+		}
+
+		metadata.LeaseToken = ""
+		metadata.ExpiresIn = 0
+		if !metadata.DeletedAt.IsZero() {
+			metadata.IsBlocked = false
+			metadata.Client = ""
+			metadata.ReservedUntil = time.Time{}
+			km.putKey(metadata.Key, metadata)
+			km.deleted[metadata.Key] = metadata.DeletedAt
+		} else if metadata.IsBlocked {
+			metadata = km.restoreLease(metadata)
+			metadata.ReservedUntil = time.Time{}
+			km.putKey(metadata.Key, metadata)
+			km.blocked[metadata.Key] = metadata.Expiry
+			km.trackLease(metadata.Client, 1)
+		} else {
+			metadata.Client = ""
+			metadata.Expiry = time.Time{}
+			km.putKey(metadata.Key, metadata)
+			if metadata.ReservedUntil.IsZero() {
+				km.pushAvailable(metadata.Key)
+			} else {
+				km.reserved[metadata.Key] = metadata.ReservedUntil
+			}
+		}
+		due, _ := km.dueAt(metadata.Key)
+		km.schedule(metadata.Key, due)
+		result.Imported++
+	}
+
+	km.logger.Info("imported keys", "imported", result.Imported, "skipped", result.Skipped)
+	return result, nil
+}
+
+// removeAvailableKeys drops every key in removed from the available pools in
+// a single pass. The caller must hold km.mu.
+func (km *KeyManager) removeAvailableKeys(removed map[string]bool) {
+	if len(removed) == 0 {
+		return
+	}
+	for pool, keys := range km.available {
+		available := keys[:0]
+		for _, key := range keys {
+			if !removed[key] {
+				available = append(available, key)
+			}
+		}
+		km.available[pool] = available
+	}
+}
+
+// removeAvailable drops key from the available pool if it is there. The
+// caller must hold km.mu.
+func (km *KeyManager) removeAvailable(key string) {
+	pool := km.keys[key].Pool
+	available := km.available[pool]
+	for i, k := range available {
+		if k == key {
+			km.available[pool] = append(available[:i], available[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportJSON returns km.Export() as it looks after encoding and decoding
+// it, as GET /export and POST /import do.
+func exportJSON(t *testing.T, km *KeyManager) []KeyMetadata {
+	t.Helper()
+	raw, err := json.Marshal(km.Export())
+	if err != nil {
+		t.Fatalf("encoding export: %v", err)
+	}
+	var keys []KeyMetadata
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		t.Fatalf("decoding export: %v", err)
+	}
+	return keys
+}
+
+// withoutVersions returns keys with Version cleared, since Import bumps it
+// like any other change.
+func withoutVersions(keys []KeyMetadata) []KeyMetadata {
+	out := make([]KeyMetadata, len(keys))
+	for i, metadata := range keys {
+		metadata.Version = 0
+		out[i] = metadata
+	}
+	return out
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src, clock := newTestManager(t, Config{DeleteGracePeriod: time.Hour, Strategy: StrategyFIFO})
+	leased := mustGenerate(t, src)
+	mustLease(t, src, time.Minute)
+	clock.Advance(time.Second)
+	if _, err := src.GenerateNewKeyWithTags(map[string]string{"env": "prod"}); err != nil {
+		t.Fatalf("GenerateNewKeyWithTags: %v", err)
+	}
+	clock.Advance(time.Second)
+	deleted := mustGenerate(t, src)
+	if err := src.DeleteKey(deleted); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+	exported := exportJSON(t, src)
+
+	dst, _ := newTestManager(t, Config{DeleteGracePeriod: time.Hour})
+	dst.Clock.(*MockClock).Set(clock.Now())
+	result, err := dst.Import(exported, false)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if result.Imported != 3 || result.Skipped != 0 {
+		t.Fatalf("Import = %+v, want 3 imported", result)
+	}
+
+	if got, want := withoutVersions(exportJSON(t, dst)), withoutVersions(exported); !reflect.DeepEqual(got, want) {
+		t.Fatalf("re-export differs:\n got %+v\nwant %+v", got, want)
+	}
+	if got, want := dst.Stats(), src.Stats(); got != want {
+		t.Fatalf("Stats = %+v, want %+v", got, want)
+	}
+	if info, _ := dst.GetKeyInfo(leased); !info.IsBlocked {
+		t.Fatal("imported lease is not blocked")
+	}
+
+	// Importing again changes nothing unless asked to overwrite.
+	if result, err := dst.Import(exported, false); err != nil || result.Skipped != 3 {
+		t.Fatalf("second Import = %+v, %v, want 3 skipped", result, err)
+	}
+	if result, err := dst.Import(exported, true); err != nil || result.Imported != 3 {
+		t.Fatalf("overwriting Import = %+v, %v, want 3 imported", result, err)
+	}
+	if got, want := dst.Stats(), src.Stats(); got != want {
+		t.Fatalf("Stats after overwrite = %+v, want %+v", got, want)
+	}
+}
+
+func TestImportRejectsInvalidEntries(t *testing.T) {
+	validator, err := KeyIDPattern(`sk_[a-z]+`)
+	if err != nil {
+		t.Fatalf("KeyIDPattern: %v", err)
+	}
+	km, _ := newTestManager(t, Config{KeyValidator: validator})
+	valid := KeyMetadata{Key: "sk_valid"}
+
+	for _, bad := range []KeyMetadata{
+		{},
+		{Key: "sk_with/slash"},
+		{Key: "sk_" + strings.Repeat("a", MaxKeyIDLength)},
+		{Key: "pk_wrongshape"},
+		{Key: "sk_badpool", Pool: "a pool"},
+	} {
+		if _, err := km.Import([]KeyMetadata{valid, bad}, false); !errors.Is(err, ErrInvalidImport) {
+			t.Errorf("Import of %+v: got %v, want ErrInvalidImport", bad, err)
+		}
+	}
+	if got := km.Stats().Total; got != 0 {
+		t.Fatalf("%d keys imported from rejected batches, want 0", got)
+	}
+	if _, err := km.Import([]KeyMetadata{valid}, false); err != nil {
+		t.Fatalf("Import of a valid entry: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+// waiterKey identifies the callers of LeaseKeyWait waiting on one pool for
+// one client.
+type waiterKey struct {
+	pool, client string
+}
+
+// addWaiter records that a caller for client has started waiting for a key
+// in pool. The caller must hold km.mu.
+func (km *KeyManager) addWaiter(pool, client string) {
+	km.waiting[waiterKey{pool, client}]++
+}
+
+// removeWaiter undoes addWaiter. Under FairLeasing the waiters that were
+// queued behind this one are woken, since they may now be next in line. The
+// caller must hold km.mu.
+func (km *KeyManager) removeWaiter(pool, client string) {
+	wk := waiterKey{pool, client}
+	km.waiting[wk]--
+	if km.waiting[wk] <= 0 {
+		delete(km.waiting, wk)
+		km.forgetClient(client)
+	}
+	if km.FairLeasing && len(km.available[pool]) > 0 {
+		km.keyAvailable.Broadcast()
+	}
+}
+
+// noteLease records that client has just been granted a key, sending it to
+// the back of the line under FairLeasing. The caller must hold km.mu.
+func (km *KeyManager) noteLease(client string) {
+	if !km.FairLeasing {
+		return
+	}
+	km.leaseSeq++
+	km.lastLeased[client] = km.leaseSeq
+}
+
+// forgetClient drops client's place in line once it neither holds nor waits
+// for a key, so clients that come and go do not accumulate. The caller must
+// hold km.mu.
+func (km *KeyManager) forgetClient(client string) {
+	if _, ok := km.lastLeased[client]; !ok || km.leasedBy[client] > 0 {
+		return
+	}
+	for wk := range km.waiting {
+		if wk.client == client {
+			return
+		}
+	}
+	delete(km.lastLeased, client)
+}
+
+// claimable returns how many of pool's available keys client may lease right
+// now. That is all of them, unless FairLeasing is set, in which case one key
+// is held back for every waiter of a client that was granted a key less
+// recently than client, or never. The caller must hold km.mu.
+func (km *KeyManager) claimable(pool, client string) int {
+	n := len(km.available[pool])
+	if !km.FairLeasing || n == 0 {
+		return n
+	}
+	last := km.lastLeased[client]
+	for wk, count := range km.waiting {
+		if wk.pool == pool && wk.client != client && km.lastLeased[wk.client] < last {
+			n -= count
+		}
+	}
+	return max(n, 0)
+}
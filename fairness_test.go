@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFairLeasingAlternatesClients(t *testing.T) {
+	km, _ := newTestManager(t, Config{FairLeasing: true})
+	type grant struct {
+		client string
+		lease  Lease
+	}
+	grants := make(chan grant)
+	const perClient = 3
+	for _, client := range []string{"a", "b"} {
+		ctx := ContextWithClient(context.Background(), client)
+		for range perClient {
+			go func() {
+				lease, err := LeaseKeyWait(ctx, km, 0, 10*time.Second)
+				if err != nil {
+					t.Errorf("LeaseKeyWait for %s: %v", client, err)
+				}
+				grants <- grant{client, lease}
+			}()
+		}
+	}
+	waitFor(t, "every lease to wait", func() bool { return waiters(km) == 2*perClient })
+
+	var order []string
+	for range 2 * perClient {
+		key := mustGenerate(t, km)
+		select {
+		case g := <-grants:
+			if g.lease.KeyID != key {
+				t.Fatalf("%s leased %q, want the generated %q", g.client, g.lease.KeyID, key)
+			}
+			order = append(order, g.client)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no waiter was granted key %d; order so far %v", len(order)+1, order)
+		}
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] == order[i-1] {
+			t.Fatalf("grants went %v, want them to alternate between clients", order)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// KeyHistoryLength is how many events are kept per key for GET
+// /keys/{id}/events; older ones are discarded as new ones arrive.
+const KeyHistoryLength = 32
+
+// record appends event to key's history, discarding the oldest entry once
+// KeyHistoryLength are kept. The caller must hold km.mu.
+func (km *KeyManager) record(event, key string, now time.Time) {
+	h := km.history[key]
+	if len(h) == KeyHistoryLength {
+		// Shift in place rather than reslicing, so the backing array is
+		// reused instead of creeping forward and reallocating.
+		copy(h, h[1:])
+		h = h[:len(h)-1]
+	}
+	km.history[key] = append(h, KeyEvent{Event: event, Key: key, At: now})
+}
+
+// KeyHistory returns the most recent events for key, oldest first. A
+// soft-deleted key keeps its history until it is purged.
+func (km *KeyManager) KeyHistory(key string) ([]KeyEvent, error) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	if _, exists := km.keys[key]; !exists {
+		return nil, ErrKeyNotFound
+	}
+	return append([]KeyEvent{}, km.history[key]...), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeyHistory(t *testing.T) {
+	km, clock := newTestManager(t, Config{IdleTTL: time.Hour, DeleteGracePeriod: time.Minute})
+	r := newTestRouter(km, RouterConfig{})
+	step := func() time.Time {
+		clock.Advance(time.Second)
+		return clock.Now()
+	}
+
+	key := mustGenerate(t, km)
+	want := []KeyEvent{{EventGenerated, key, testEpoch}}
+	mustLease(t, km, time.Minute)
+	want = append(want, KeyEvent{EventLeased, key, testEpoch})
+	if err := km.KeepAlive(key); err != nil {
+		t.Fatalf("KeepAlive: %v", err)
+	}
+	want = append(want, KeyEvent{EventKeptAlive, key, testEpoch})
+	at := step()
+	if err := km.UnblockKey(key); err != nil {
+		t.Fatalf("UnblockKey: %v", err)
+	}
+	want = append(want, KeyEvent{EventUnblocked, key, at})
+	at = step()
+	mustLease(t, km, time.Minute)
+	want = append(want, KeyEvent{EventLeased, key, at})
+	clock.Advance(time.Minute + time.Second)
+	km.sweep(clock.Now())
+	want = append(want, KeyEvent{EventExpired, key, clock.Now()})
+	step()
+	if err := km.DeleteKey(key); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+
+	// A soft-deleted key keeps its history until it is purged.
+	w := doRequest(t, r, http.MethodGet, "/keys/"+key+"/events", nil)
+	expectStatus(t, w, http.StatusOK)
+	got := decodeBody[historyResponse](t, w).Events
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("history:\n got %v\nwant %v", got, want)
+	}
+
+	clock.Advance(2 * time.Minute)
+	km.sweep(clock.Now())
+	w = doRequest(t, r, http.MethodGet, "/keys/"+key+"/events", nil)
+	expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+}
+
+func TestKeyHistoryKeepsMostRecent(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	key := mustGenerate(t, km)
+	for range KeyHistoryLength + 8 {
+		clock.Advance(time.Second)
+		if err := km.KeepAlive(key); err != nil {
+			t.Fatalf("KeepAlive: %v", err)
+		}
+	}
+
+	history, err := km.KeyHistory(key)
+	if err != nil {
+		t.Fatalf("KeyHistory: %v", err)
+	}
+	if len(history) != KeyHistoryLength {
+		t.Fatalf("history holds %d events, want %d", len(history), KeyHistoryLength)
+	}
+	if first, last := history[0].At, history[len(history)-1].At; !first.Equal(testEpoch.Add(9*time.Second)) || !last.Equal(clock.Now()) {
+		t.Fatalf("history runs from %v to %v, want the latest %d events", first, last, KeyHistoryLength)
+	}
+}
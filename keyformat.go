@@ -0,0 +1,139 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var ErrInvalidKeyID = errors.New("invalid key id")
+
+// checkKeyID checks a caller-supplied key id, and then runs validator over it
+// if one is set.
+func checkKeyID(key string, validator func(string) error) error {
+	if key == "" || len(key) > MaxKeyIDLength {
+		return fmt.Errorf("%w: must be between 1 and %d characters", ErrInvalidKeyID, MaxKeyIDLength)
+	}
+	if err := checkNameChars(key); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKeyID, err)
+	}
+	if validator != nil {
+		if err := validator(key); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidKeyID, err)
+		}
+	}
+	return nil
+}
+
+// KeyIDPattern returns a key validator accepting only ids that match the
+// regular expression pattern in full.
+func KeyIDPattern(pattern string) (func(string) error, error) {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string) error {
+		if !re.MatchString(key) {
+			return fmt.Errorf("must match %s", pattern)
+		}
+		return nil
+	}, nil
+}
+
+// checkNameChars checks that s only uses characters that never need escaping
+// in a URL path, since key ids and pool names end up in them.
+func checkNameChars(s string) error {
+	for _, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '-', r == '_', r == '.', r == '~':
+		default:
+			return fmt.Errorf("%q is not allowed, use letters, digits, '-', '_', '.' or '~'", r)
+		}
+	}
+	return nil
+}
+
+// KeyFormat selects the shape of generated keys.
+type KeyFormat string
+
+const (
+	// FormatRandom generates URL-safe base64 keys from KeyLength random
+	// bytes.
+	FormatRandom KeyFormat = "random"
+	// FormatUUID generates hyphenated version 4 UUIDs. KeyLength is ignored.
+	FormatUUID KeyFormat = "uuid"
+	// FormatPrefixed generates FormatRandom keys behind a fixed prefix such
+	// as "sk_live_".
+	FormatPrefixed KeyFormat = "prefixed"
+)
+
+var ErrInvalidKeyFormat = errors.New(`key format must be "random", "uuid", or "prefixed" with a prefix`)
+
+// MinKeyLength is the fewest random bytes a generated key may have. Among n
+// keys of b random bytes the chance of any two colliding is about
+// n²/2^(8b+1), so 16 bytes keep it below one in 10^20 even for a billion
+// keys, while 4 bytes already collide more often than not by 80,000. Keys
+// short enough to collide are also short enough to guess.
+const MinKeyLength = 16
+
+var ErrKeyTooShort = fmt.Errorf("key length must be at least %d bytes", MinKeyLength)
+
+// validateKeyFormat checks that format is known and that a prefix is given
+// exactly when format needs one.
+func validateKeyFormat(format KeyFormat, prefix string) error {
+	switch format {
+	case "", FormatRandom, FormatUUID:
+		if prefix != "" {
+			return fmt.Errorf("%w: prefix %q requires the prefixed format", ErrInvalidKeyFormat, prefix)
+		}
+		return nil
+	case FormatPrefixed:
+		if prefix == "" {
+			return fmt.Errorf("%w: prefixed format requires a prefix", ErrInvalidKeyFormat)
+		}
+		return nil
+	}
+	return ErrInvalidKeyFormat
+}
+
+// validateKeyLength checks that keys of format would be generated from at
+// least MinKeyLength random bytes. Zero stands for DefaultKeyLength, and
+// FormatUUID, which ignores the length, is always accepted.
+func validateKeyLength(format KeyFormat, n int) error {
+	if n == 0 || format == FormatUUID || n >= MinKeyLength {
+		return nil
+	}
+	return ErrKeyTooShort
+}
+
+// GenerateFormattedKey returns a new key in format, built from n random bytes
+// where the format uses them. An empty format means FormatRandom.
+func GenerateFormattedKey(format KeyFormat, prefix string, n int) (string, error) {
+	switch format {
+	case "", FormatRandom:
+		return GenerateRandomKey(n)
+	case FormatPrefixed:
+		key, err := GenerateRandomKey(n)
+		if err != nil {
+			return "", err
+		}
+		return prefix + key, nil
+	case FormatUUID:
+		return generateUUID()
+	}
+	return "", ErrInvalidKeyFormat
+}
+
+// generateUUID returns a random version 4 UUID in its canonical hyphenated
+// form.
+func generateUUID() (string, error) {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
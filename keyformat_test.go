@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCheckKeyID(t *testing.T) {
+	for _, tc := range []struct {
+		id    string
+		valid bool
+	}{
+		{"", false},
+		{"k", true},
+		{strings.Repeat("k", MaxKeyIDLength), true},
+		{strings.Repeat("k", MaxKeyIDLength+1), false},
+		{"my-key_1.0~x", true},
+		{"my key", false},
+		{"a/b", false},
+	} {
+		err := checkKeyID(tc.id, nil)
+		if tc.valid && err != nil {
+			t.Errorf("checkKeyID(%.20q): %v", tc.id, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidKeyID) {
+			t.Errorf("checkKeyID(%.20q) = %v, want ErrInvalidKeyID", tc.id, err)
+		}
+	}
+}
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestGenerateFormattedKey(t *testing.T) {
+	for _, tc := range []struct {
+		format KeyFormat
+		prefix string
+		check  func(string) bool
+	}{
+		{FormatUUID, "", uuidV4.MatchString},
+		{FormatPrefixed, "sk_live_", func(key string) bool {
+			rest, ok := strings.CutPrefix(key, "sk_live_")
+			raw, err := base64.RawURLEncoding.DecodeString(rest)
+			return ok && err == nil && len(raw) == DefaultKeyLength
+		}},
+		{FormatRandom, "", func(key string) bool {
+			raw, err := base64.RawURLEncoding.DecodeString(key)
+			return err == nil && len(raw) == DefaultKeyLength
+		}},
+	} {
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			key, err := GenerateFormattedKey(tc.format, tc.prefix, DefaultKeyLength)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.format, err)
+			}
+			if !tc.check(key) {
+				t.Fatalf("%s: malformed key %q", tc.format, key)
+			}
+			if err := checkKeyID(key, nil); err != nil {
+				t.Fatalf("%s: generated key %q fails checkKeyID: %v", tc.format, key, err)
+			}
+			if seen[key] {
+				t.Fatalf("%s: key %q generated twice", tc.format, key)
+			}
+			seen[key] = true
+		}
+	}
+
+	if _, err := GenerateFormattedKey("hex", "", DefaultKeyLength); !errors.Is(err, ErrInvalidKeyFormat) {
+		t.Fatalf("unknown format: got %v, want ErrInvalidKeyFormat", err)
+	}
+}
+
+func TestManagerUsesKeyFormat(t *testing.T) {
+	km, _ := newTestManager(t, Config{KeyFormat: FormatPrefixed, KeyPrefix: "pk_"})
+	if key := mustGenerate(t, km); !strings.HasPrefix(key, "pk_") {
+		t.Fatalf("generated %q, want the pk_ prefix", key)
+	}
+
+	for _, tc := range []struct {
+		format KeyFormat
+		prefix string
+	}{
+		{FormatPrefixed, ""},
+		{FormatUUID, "pk_"},
+		{"hex", ""},
+	} {
+		if err := validateKeyFormat(tc.format, tc.prefix); !errors.Is(err, ErrInvalidKeyFormat) {
+			t.Errorf("validateKeyFormat(%q, %q) = %v, want ErrInvalidKeyFormat", tc.format, tc.prefix, err)
+		}
+	}
+}
+
+func TestValidateKeyLength(t *testing.T) {
+	tests := []struct {
+		format KeyFormat
+		n      int
+		want   error
+	}{
+		{FormatRandom, 0, nil},
+		{FormatRandom, MinKeyLength, nil},
+		{FormatRandom, MinKeyLength - 1, ErrKeyTooShort},
+		{FormatRandom, 4, ErrKeyTooShort},
+		{FormatPrefixed, MinKeyLength - 1, ErrKeyTooShort},
+		{FormatUUID, 4, nil},
+	}
+	for _, tc := range tests {
+		if err := validateKeyLength(tc.format, tc.n); !errors.Is(err, tc.want) {
+			t.Errorf("validateKeyLength(%q, %d) = %v, want %v", tc.format, tc.n, err, tc.want)
+		}
+	}
+
+	_, err := NewKeyManagerWithConfig(Config{KeyLength: MinKeyLength - 1, Logger: discardLogger})
+	if !errors.Is(err, ErrKeyTooShort) {
+		t.Fatalf("NewKeyManagerWithConfig below the floor: got %v, want ErrKeyTooShort", err)
+	}
+
+	// The length counts random bytes, not characters of the encoded key.
+	km, _ := newTestManager(t, Config{KeyLength: MinKeyLength})
+	key := mustGenerate(t, km)
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", key, err)
+	}
+	if len(raw) != MinKeyLength || len(key) == MinKeyLength {
+		t.Fatalf("key %q is %d characters from %d bytes, want %d bytes", key, len(key), len(raw), MinKeyLength)
+	}
+}
+
+func TestKeyIDPattern(t *testing.T) {
+	validate, err := KeyIDPattern(`sk_[a-z0-9]{8}|legacy-\d+`)
+	if err != nil {
+		t.Fatalf("KeyIDPattern: %v", err)
+	}
+	for _, tc := range []struct {
+		id    string
+		valid bool
+	}{
+		{"sk_abcd1234", true},
+		{"legacy-42", true},
+		{"sk_abcd12345", false},
+		{"xsk_abcd1234", false},
+		{"sk_ABCD1234", false},
+		{"legacy-42-extra", false},
+	} {
+		if err := validate(tc.id); (err == nil) != tc.valid {
+			t.Errorf("validator(%q) = %v, want valid %v", tc.id, err, tc.valid)
+		}
+	}
+	if _, err := KeyIDPattern("sk_("); err == nil {
+		t.Error("KeyIDPattern accepted an invalid regular expression")
+	}
+
+	km, _ := newTestManager(t, Config{KeyValidator: validate})
+	if err := km.RegisterKey("sk_abcd1234"); err != nil {
+		t.Fatalf("RegisterKey of a matching id: %v", err)
+	}
+	if err := km.RegisterKey("sk_nope"); !errors.Is(err, ErrInvalidKeyID) {
+		t.Fatalf("RegisterKey of a non-matching id: got %v, want ErrInvalidKeyID", err)
+	}
+
+	r := newTestRouter(km, RouterConfig{})
+	w := doRequest(t, r, http.MethodPost, "/keys", generateRequest{KeyID: "sk_nope"})
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+	if msg := decodeBody[APIError](t, w).Message; !strings.Contains(msg, "must match") {
+		t.Fatalf("error message %q does not name the pattern", msg)
+	}
+	// Generated keys are not held to the pattern.
+	mustGenerate(t, km)
+	if got := km.Stats().Total; got != 2 {
+		t.Fatalf("Total = %d, want 2", got)
+	}
+}
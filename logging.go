@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newLogger builds a JSON logger writing to w at the named level ("debug",
+// "info", "warn" or "error"). An empty level means info.
+func newLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl})), nil
+}
+
+// keyFingerprint identifies key in logs without revealing it: the first
+// eight bytes of its SHA-256, hex encoded.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// accessLog logs one line per request with its method, path, status and
+// latency. With redact set, the :id segment of the path is replaced by the
+// key's fingerprint, and requests that matched no route are logged without
+// their path, since it may still contain a key.
+func accessLog(logger *slog.Logger, redact bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		path := c.Request.URL.Path
+		if redact {
+			path = c.FullPath()
+			if id := c.Param("id"); id != "" {
+				path = strings.Replace(path, ":id", keyFingerprint(id), 1)
+			}
+		}
+		logger.Info("request",
+			"requestId", requestIDFromContext(c.Request.Context()),
+			"method", c.Request.Method,
+			"path", path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+		)
+	}
+}
+
+// recoverPanic turns a panicking handler into a 500 with the usual APIError
+// body, logging the panic and its stack. http.ErrAbortHandler is re-raised so
+// net/http still drops the connection, and nothing is written when the
+// handler had already started its response.
+func recoverPanic(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			logger.Error("handler panicked",
+				"requestId", requestIDFromContext(c.Request.Context()),
+				"method", c.Request.Method,
+				"path", c.FullPath(),
+				"panic", fmt.Sprint(rec),
+				"stack", string(debug.Stack()),
+			)
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			writeError(c, http.StatusInternalServerError, CodeInternal, "internal server error")
+		}()
+		c.Next()
+	}
+}
+
+// fatal logs err through the default logger and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLogsNeverContainKeys(t *testing.T) {
+	for _, level := range []string{"info", "debug"} {
+		var buf bytes.Buffer
+		logger, err := newLogger(&buf, level)
+		if err != nil {
+			t.Fatalf("newLogger: %v", err)
+		}
+		km, _ := newTestManager(t, Config{Logger: logger})
+		r := newTestRouter(km, RouterConfig{Logger: logger})
+
+		w := doRequest(t, r, http.MethodPost, "/keys", nil)
+		expectStatus(t, w, http.StatusCreated)
+		key := decodeBody[createdKeyResponse](t, w).KeyID
+		for _, req := range []struct{ method, target string }{
+			{http.MethodGet, "/keys"},
+			{http.MethodGet, "/keys/" + key},
+			{http.MethodPut, "/keepalive/" + key},
+			{http.MethodPut, "/keys/" + key},
+			{http.MethodDelete, "/keys/" + key},
+			{http.MethodGet, "/keys/" + key},
+		} {
+			doRequest(t, r, req.method, req.target, nil)
+		}
+
+		logs := buf.String()
+		if strings.Contains(logs, key) {
+			t.Errorf("%s logs contain the raw key:\n%s", level, logs)
+		}
+		if !strings.Contains(logs, keyFingerprint(key)) {
+			t.Errorf("%s logs do not identify the key by fingerprint:\n%s", level, logs)
+		}
+	}
+}
+
+func TestAccessLogRedactsPath(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		var buf bytes.Buffer
+		logger, err := newLogger(&buf, "info")
+		if err != nil {
+			t.Fatalf("newLogger: %v", err)
+		}
+		km, _ := newTestManager(t, Config{})
+		r := newTestRouter(km, RouterConfig{Logger: logger, LogRawPaths: raw})
+		key := mustGenerate(t, km)
+
+		doRequest(t, r, http.MethodPut, "/keepalive/"+key, nil)
+		doRequest(t, r, http.MethodGet, "/no-such-route/"+key, nil)
+
+		var paths []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry struct {
+				Msg  string `json:"msg"`
+				Path string `json:"path"`
+			}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("decoding log line %q: %v", line, err)
+			}
+			if entry.Msg == "request" {
+				paths = append(paths, entry.Path)
+			}
+		}
+
+		want := []string{"/keepalive/" + keyFingerprint(key), ""}
+		if raw {
+			want = []string{"/keepalive/" + key, "/no-such-route/" + key}
+		}
+		if fmt.Sprint(paths) != fmt.Sprint(want) {
+			t.Errorf("LogRawPaths %v: logged paths %q, want %q", raw, paths, want)
+		}
+	}
+}
+
+// panickingStore panics on every GetKeyInfoCtx.
+type panickingStore struct {
+	KeyStore
+}
+
+func (panickingStore) GetKeyInfoCtx(context.Context, string) (KeyMetadata, error) {
+	panic("boom")
+}
+
+func TestPanicBecomesJSON500(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(panickingStore{km}, RouterConfig{Logger: logger})
+
+	w := doRequest(t, r, http.MethodGet, "/keys/some-key", nil)
+	expectError(t, w, http.StatusInternalServerError, CodeInternal)
+	id := w.Header().Get(RequestIDHeader)
+	if got := decodeBody[APIError](t, w).RequestID; got == "" || got != id {
+		t.Fatalf("error body requestId = %q, want %q", got, id)
+	}
+
+	var logged bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"requestId"`
+			Panic     string `json:"panic"`
+			Stack     string `json:"stack"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decoding log line %q: %v", line, err)
+		}
+		if entry.Msg == "handler panicked" {
+			logged = entry.RequestID == id && entry.Panic == "boom" && entry.Stack != ""
+		}
+	}
+	if !logged {
+		t.Fatalf("panic was not logged with its request id and stack:\n%s", buf.String())
+	}
+
+	// The router keeps serving after a panic.
+	w = doRequest(t, r, http.MethodDelete, "/keys/some-key", nil)
+	expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+}
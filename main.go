@@ -1,222 +1,2382 @@
 package main
 
 import (
+	"container/heap"
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
-	"math/rand"
-	"net/http"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
 )
 
+// KeyMetadata is everything known about a key. Timestamps that have not been
+// set, such as BlockedAt for a key that was never leased, are left out of its
+// JSON.
 type KeyMetadata struct {
-	Key          string    `json:"key"`
-	CreationTime time.Time `json:"createdAt"`
-	LastAccess   time.Time `json:"lastAccess"`
-	IsBlocked    bool      `json:"isBlocked"`
-	BlockedAt    time.Time `json:"blockedAt"`
+	Key          string            `json:"key"`
+	CreationTime time.Time         `json:"createdAt"`
+	LastAccess   time.Time         `json:"lastAccess,omitzero"`
+	IsBlocked    bool              `json:"isBlocked"`
+	BlockedAt    time.Time         `json:"blockedAt,omitzero"`
+	Expiry       time.Time         `json:"expiresAt,omitzero"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	// Pool is the pool the key belongs to; leases only draw from one pool.
+	// It is empty for DefaultPool.
+	Pool string `json:"pool,omitempty"`
+	// Client is the client holding the current lease, if it identified
+	// itself.
+	Client string `json:"client,omitempty"`
+	// Sliding is set for a lease taken with ContextWithSlidingExpiry, which
+	// every read of the key renews.
+	Sliding bool `json:"sliding,omitempty"`
+	// Renewals counts how many times the current lease has been renewed by
+	// KeepAlive or a sliding read; see KeyManager.MaxRenewals.
+	Renewals int `json:"renewals,omitempty"`
+	// Version is incremented by every change to the key. It is served as
+	// the ETag of GET /keys/{id}.
+	Version uint64 `json:"version"`
+	// DeletedAt is set while the key is soft-deleted and waiting to be
+	// purged; see KeyManager.DeleteGracePeriod.
+	DeletedAt time.Time `json:"deletedAt,omitzero"`
+	// ReservedUntil is set while the key is reserved, and is when it joins
+	// the available pool unless activated sooner; see ContextWithReservation.
+	ReservedUntil time.Time `json:"reservedUntil,omitzero"`
+	// ExpiresIn is the number of seconds left on the current lease. It is
+	// computed when the key is read and omitted for keys that are not leased.
+	ExpiresIn float64 `json:"expiresIn,omitempty"`
+	// LeaseTTL is the duration the current lease was granted for; KeepAlive
+	// pushes Expiry out by this much.
+	LeaseTTL time.Duration `json:"-"`
+	// LeaseToken identifies the current lease holder. It is only ever handed
+	// to the caller that took the lease.
+	LeaseToken string `json:"-"`
 }
 
+// Lease is returned to the caller that leases a key. LeaseToken must be
+// presented to ReleaseKey to give the key back early.
+type Lease struct {
+	KeyID      string `json:"keyId"`
+	LeaseToken string `json:"leaseToken"`
+}
+
+// withExpiresIn returns metadata with ExpiresIn filled in relative to now.
+func withExpiresIn(metadata KeyMetadata, now time.Time) KeyMetadata {
+	metadata.ExpiresIn = 0
+	if metadata.IsBlocked && metadata.Expiry.After(now) {
+		metadata.ExpiresIn = metadata.Expiry.Sub(now).Seconds()
+	}
+	return metadata
+}
+
+const (
+	// DefaultKeyLength is the number of random bytes behind each generated key.
+	DefaultKeyLength = 16
+	// DefaultBlockTTL is how long a leased key stays blocked before it is
+	// returned to the available pool.
+	DefaultBlockTTL = 20 * time.Second
+	// DefaultMinBlockTTL and DefaultMaxBlockTTL bound the lease duration a
+	// caller may request.
+	DefaultMinBlockTTL = 1 * time.Second
+	DefaultMaxBlockTTL = 1 * time.Hour
+	// DefaultIdleTTL is how long a key may go without access before it is
+	// deleted.
+	DefaultIdleTTL = 1 * time.Minute
+	// DefaultTickInterval is the longest BackgroundTask sleeps between sweeps
+	// when nothing is due sooner.
+	DefaultTickInterval = 1 * time.Minute
+	// DefaultFlushInterval is how often PersistTask writes state to the Store.
+	DefaultFlushInterval = 10 * time.Second
+	// DefaultMaxPendingWrites is how many changed keys are held for the Store
+	// while it is unavailable.
+	DefaultMaxPendingWrites = 10000
+
+	// DefaultListLimit is the page size used by GET /keys/list when no limit
+	// is given, and MaxListLimit is the largest page it will return.
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+
+	// LeaseTokenLength is the number of random bytes in a lease token.
+	LeaseTokenLength = 16
+
+	// DefaultMaxBatchSize caps how many keys a single POST /keys/batch may
+	// create.
+	DefaultMaxBatchSize = 1000
+)
+
+var (
+	ErrNoKeysAvailable  = errors.New("no keys available")
+	ErrKeyNotFound      = errors.New("key does not exist")
+	ErrKeyExists        = errors.New("key already exists")
+	ErrStoreUnavailable = errors.New("key store is unavailable and too many changes are pending")
+	ErrNotPersisted     = errors.New("change was applied but could not be persisted")
+	ErrKeyNotBlocked    = errors.New("key is not blocked")
+	ErrInvalidBatchSize = errors.New("invalid batch size")
+	ErrPoolFull         = errors.New("key pool is full")
+	ErrTooManyLeases    = errors.New("too many keys are leased")
+	ErrLeaseNotHeld     = errors.New("lease token does not match")
+	ErrKeyDeleted       = errors.New("key has been deleted")
+	ErrKeyNotDeleted    = errors.New("key is not deleted")
+	ErrRenewalLimit     = errors.New("lease has been renewed the maximum number of times")
+)
+
+// KeyStore is the set of key lifecycle operations the HTTP API is built on.
+// KeyManager implements it in memory and RedisKeyStore implements it on top
+// of a shared Redis so several instances can serve the same pool.
+//
+// Every operation has a Ctx variant that gives up with ctx.Err() once ctx is
+// done; the plain forms run with context.Background().
+type KeyStore interface {
+	GenerateNewKey() (string, error)
+	GenerateNewKeyWithTags(tags map[string]string) (string, error)
+	GenerateNewKeyCtx(ctx context.Context, tags map[string]string) (string, error)
+	RegisterKey(key string) error
+	RegisterKeyCtx(ctx context.Context, key string, tags map[string]string) error
+	RetreiveAvailableKey() (string, error)
+	RetreiveAvailableKeyWithTTL(ttl time.Duration) (string, error)
+	RetreiveAvailableKeyCtx(ctx context.Context, ttl time.Duration) (string, error)
+	LeaseKey(ttl time.Duration) (Lease, error)
+	LeaseKeyCtx(ctx context.Context, ttl time.Duration) (Lease, error)
+	UnblockKey(key string) error
+	UnblockKeyCtx(ctx context.Context, key string) error
+	ReleaseKey(key, token string) error
+	ReleaseKeyCtx(ctx context.Context, key, token string) error
+	DeleteKey(key string) error
+	DeleteKeyCtx(ctx context.Context, key string) error
+	KeepAlive(key string) error
+	KeepAliveCtx(ctx context.Context, key string) error
+	GetKeyInfo(key string) (KeyMetadata, error)
+	GetKeyInfoCtx(ctx context.Context, key string) (KeyMetadata, error)
+	// Ready reports whether the store can serve requests, returning the
+	// reason when it cannot.
+	Ready(ctx context.Context) error
+}
+
+// Config holds the tunables for a KeyManager. Zero values fall back to the
+// package defaults.
+type Config struct {
+	KeyLength         int
+	KeyFormat         KeyFormat
+	KeyPrefix         string
+	KeyValidator      func(string) error
+	BlockTTL          time.Duration
+	MinBlockTTL       time.Duration
+	MaxBlockTTL       time.Duration
+	IdleTTL           time.Duration
+	ExemptBlocked     bool
+	TickInterval      time.Duration
+	MaxBatchSize      int
+	MaxKeys           int
+	WebhookURL        string
+	Logger            *slog.Logger
+	Store             Store
+	FlushInterval     time.Duration
+	WriteThrough      bool
+	MaxPendingWrites  int
+	ReclaimCooldown   time.Duration
+	ReservationTTL    time.Duration
+	Clock             Clock
+	Strategy          RetrievalStrategy
+	DeleteGracePeriod time.Duration
+	ClientQuota       int
+	ClientQuotas      map[string]int
+	AutoGenerate      bool
+	FairLeasing       bool
+	AffinityWindow    time.Duration
+	MaxBlocked        int
+	MaxRenewals       int
+	Eviction          EvictionPolicy
+	// PrewarmCount is how many available keys NewKeyManagerWithConfig makes
+	// sure the default pool starts with.
+	PrewarmCount int
+}
+
+// RetrievalStrategy selects which available key a lease hands out.
+type RetrievalStrategy string
+
+const (
+	// StrategyRandom leases a uniformly random available key.
+	StrategyRandom RetrievalStrategy = "random"
+	// StrategyFIFO leases the key that has been available the longest, which
+	// spreads use evenly across the pool.
+	StrategyFIFO RetrievalStrategy = "fifo"
+	// StrategyLIFO leases the key that most recently became available.
+	StrategyLIFO RetrievalStrategy = "lifo"
+)
+
+var ErrInvalidStrategy = errors.New(`strategy must be one of "random", "fifo" or "lifo"`)
+
 type KeyManager struct {
-	keys      map[string]KeyMetadata
-	available []string
-	blocked   map[string]time.Time
-	mu        sync.Mutex
-	blockMu   sync.Mutex
+	// KeyLength is the number of random bytes used for each generated key,
+	// at least MinKeyLength.
+	KeyLength int
+	// KeyFormat is the shape of generated keys. KeyPrefix is the prefix
+	// used by FormatPrefixed.
+	KeyFormat KeyFormat
+	KeyPrefix string
+	// KeyValidator, when set, vets the ids passed to RegisterKey on top of
+	// the built-in length and character checks; its error is reported as
+	// ErrInvalidKeyID. Generated keys are not passed to it. Nil accepts
+	// any id.
+	KeyValidator func(string) error
+	// BlockTTL is how long a leased key stays blocked when the lease does not
+	// ask for a specific duration.
+	BlockTTL time.Duration
+	// MinBlockTTL and MaxBlockTTL bound the duration a lease may request.
+	MinBlockTTL time.Duration
+	MaxBlockTTL time.Duration
+	// IdleTTL is how long a key may go without access before it is deleted.
+	// Idle time is measured from the key's last access or, for a key that
+	// has never been accessed, from its creation. The end of a lease counts
+	// as an access.
+	IdleTTL time.Duration
+	// ExemptBlocked spares leased keys from idle deletion, however long ago
+	// they were last accessed: only their lease expiry applies to them.
+	ExemptBlocked bool
+	// TickInterval caps how long BackgroundTask sleeps between sweeps. It
+	// normally wakes exactly when the next lease, idle or grace period runs
+	// out.
+	TickInterval time.Duration
+	// MaxBatchSize caps how many keys GenerateKeys creates at once.
+	MaxBatchSize int
+	// MaxKeys caps the total number of managed keys. Zero means unlimited.
+	MaxKeys int
+	// Eviction decides whether creating a key when MaxKeys is reached fails
+	// or evicts an available key to make room.
+	Eviction EvictionPolicy
+	// MaxBlocked caps how many keys may be leased at once, however many
+	// are available, to protect whatever the keys grant access to. Zero
+	// means unlimited.
+	MaxBlocked int
+	// MaxRenewals caps how many times a single lease may be renewed, so no
+	// client can hold a key forever by heartbeating. Past the cap KeepAlive
+	// fails with ErrRenewalLimit, sliding reads stop renewing, and the key
+	// is reclaimed when its lease runs out. Zero means unlimited.
+	MaxRenewals int
+	// Store, when set, is where key state is persisted.
+	Store Store
+	// FlushInterval is how often PersistTask writes state to Store.
+	FlushInterval time.Duration
+	// WriteThrough flushes to Store after every change, before the call
+	// that made it returns, trading throughput for durability. A failed
+	// flush is reported to that caller as ErrNotPersisted, though the
+	// change itself stays in effect and is retried by later flushes like
+	// any other. Failures of PersistTask's periodic flushes are only
+	// logged.
+	WriteThrough bool
+	// MaxPendingWrites bounds how many changed keys are kept for replay while
+	// Store is failing. Once that many are pending, further changes are
+	// refused with ErrStoreUnavailable until a flush succeeds.
+	MaxPendingWrites int
+	// ReclaimCooldown, when positive, holds a key whose lease ran out or was
+	// force-expired out of the pool for this long before it can be leased
+	// again, so the previous holder's last requests cannot collide with a new
+	// holder.
+	ReclaimCooldown time.Duration
+	// ReservationTTL is how long a key created under ContextWithReservation
+	// is held out of the available pool waiting for ActivateKey before it
+	// joins by itself.
+	ReservationTTL time.Duration
+	// Clock is the source of time for leases, idle deadlines and the sweep.
+	Clock Clock
+	// Strategy decides which available key each lease hands out.
+	Strategy RetrievalStrategy
+	// DeleteGracePeriod, when positive, turns DeleteKey into a soft delete:
+	// the key stays readable, and can be restored with RestoreKey, for this
+	// long before BackgroundTask purges it. Zero deletes keys immediately.
+	DeleteGracePeriod time.Duration
+	// ClientQuota caps how many keys a single identified client may hold
+	// at once, unless ClientQuotas has an entry for it. Zero means no limit.
+	// Leases are attributed to a client with ContextWithClient.
+	ClientQuota  int
+	ClientQuotas map[string]int
+	// FairLeasing shares keys out between clients, as identified by
+	// ContextWithClient, when there are not enough to go round: a key that
+	// frees up goes to the waiting client that was granted one least
+	// recently, rather than to whoever asked first, and leases that do not
+	// wait cannot take keys those clients are owed.
+	FairLeasing bool
+	// AffinityWindow, when positive, lets a client that leases again within
+	// this long of giving a key back, or of losing it to expiry, have that
+	// same key if it is still available, whatever Strategy would pick.
+	// Clients are identified with ContextWithClient.
+	AffinityWindow time.Duration
+	// AutoGenerate makes a lease from an empty pool generate a fresh key
+	// instead of failing with ErrNoKeysAvailable, as long as MaxKeys allows.
+	AutoGenerate bool
+
+	keys map[string]KeyMetadata
+	// available lists the keys that can be leased, per pool.
+	available map[string][]string
+	// blocked maps each leased key to the time its lease expires.
+	blocked map[string]time.Time
+	// deleted maps each soft-deleted key to the time it was deleted.
+	deleted map[string]time.Time
+	// cooling maps each key in its ReclaimCooldown to the time it rejoins
+	// available.
+	cooling map[string]time.Time
+	// reserved maps each reserved key to the time its reservation ends.
+	reserved map[string]time.Time
+	// expiries orders keys by when the sweep next has to look at them.
+	expiries expiryHeap
+	// leasedBy counts the leases currently held by each identified client.
+	leasedBy map[string]int
+	// waiting counts the LeaseKeyWait callers by pool and client, and
+	// lastLeased orders clients by when they were last granted a key, as a
+	// sequence number from leaseSeq. Both serve FairLeasing.
+	waiting    map[waiterKey]int
+	lastLeased map[string]uint64
+	leaseSeq   uint64
+	// lastHeld maps each client to the key it held last, for
+	// AffinityWindow.
+	lastHeld map[string]heldKey
+	// history holds each key's recent events, for KeyHistory.
+	history map[string][]KeyEvent
+	// lastSweep is the time of the previous sweep, for checkClock.
+	lastSweep time.Time
+	// pending holds the keys changed since the last successful flush, and
+	// storeErr the error from the last flush, if it failed.
+	pending  map[string]struct{}
+	storeErr error
+	// mu guards keys, available, blocked, deleted, cooling, reserved, expiries,
+	// leasedBy, waiting, lastLeased, leaseSeq, lastHeld, history, lastSweep,
+	// pending and storeErr. Methods that only read them
+	// take the read lock, so lookups do not queue behind one another.
+	mu sync.RWMutex
+	// flushMu keeps flushes in order, so an older snapshot never overwrites
+	// a newer one.
+	flushMu sync.Mutex
+	// keyAvailable is broadcast, with mu held, whenever a key is added to
+	// available.
+	keyAvailable *sync.Cond
+	// rng picks keys for StrategyRandom. It is guarded by mu, so leases do
+	// not contend on the global source's lock.
+	rng *rand.Rand
+
+	logger  *slog.Logger
+	metrics *keyMetrics
+	// webhook, when set, is told about keys reclaimed by the sweep.
+	webhook *webhookNotifier
+	// events streams every key state change to GET /events.
+	events *eventBus
+	// reaping is set while BackgroundTask is running.
+	reaping atomic.Bool
+	// wake tells BackgroundTask that a deadline earlier than the one it is
+	// sleeping towards may have been scheduled.
+	wake chan struct{}
+}
+
+func NewKeyManager() *KeyManager {
+	return newKeyManager(Config{})
+}
+
+// NewKeyManagerWithConfig builds a KeyManager from cfg. When cfg.Store is set
+// the manager is rehydrated from it before being returned.
+func NewKeyManagerWithConfig(cfg Config) (*KeyManager, error) {
+	switch cfg.Strategy {
+	case "", StrategyRandom, StrategyFIFO, StrategyLIFO:
+	default:
+		return nil, ErrInvalidStrategy
+	}
+	switch cfg.Eviction {
+	case "", EvictReject, EvictLRU, EvictOldest:
+	default:
+		return nil, ErrInvalidEvictionPolicy
+	}
+	if err := validateKeyFormat(cfg.KeyFormat, cfg.KeyPrefix); err != nil {
+		return nil, err
+	}
+	if err := validateKeyLength(cfg.KeyFormat, cfg.KeyLength); err != nil {
+		return nil, err
+	}
+
+	km := newKeyManager(cfg)
+	if km.Store != nil {
+		if err := km.load(); err != nil {
+			return nil, err
+		}
+	}
+	if err := km.prewarm(cfg.PrewarmCount); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+// prewarm generates keys until the default pool holds n available ones, so
+// the first leases after startup need not wait for keys to be created. Keys
+// loaded from Store count towards n, and no more are made than MaxKeys
+// allows. Like any other key, prewarmed keys are deleted once idle for
+// IdleTTL.
+func (km *KeyManager) prewarm(n int) error {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	n -= len(km.available[DefaultPool])
+	if km.MaxKeys > 0 {
+		n = min(n, km.MaxKeys-len(km.keys))
+	}
+	for i := 0; i < n; i++ {
+		key, err := km.uniqueKey()
+		if err != nil {
+			return err
+		}
+		km.addKey(key, DefaultPool, nil)
+		km.pushAvailable(key)
+	}
+	if n > 0 {
+		km.logger.Info("prewarmed key pool", "generated", n)
+	}
+	return nil
+}
+
+func newKeyManager(cfg Config) *KeyManager {
+	if cfg.KeyLength <= 0 {
+		cfg.KeyLength = DefaultKeyLength
+	}
+	if cfg.BlockTTL <= 0 {
+		cfg.BlockTTL = DefaultBlockTTL
+	}
+	if cfg.MinBlockTTL <= 0 {
+		cfg.MinBlockTTL = DefaultMinBlockTTL
+	}
+	if cfg.MaxBlockTTL <= 0 {
+		cfg.MaxBlockTTL = DefaultMaxBlockTTL
+	}
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = DefaultIdleTTL
+	}
+	if cfg.TickInterval <= 0 {
+		cfg.TickInterval = DefaultTickInterval
+	}
+	if cfg.MaxBatchSize <= 0 {
+		cfg.MaxBatchSize = DefaultMaxBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.MaxPendingWrites <= 0 {
+		cfg.MaxPendingWrites = DefaultMaxPendingWrites
+	}
+	if cfg.ReservationTTL <= 0 {
+		cfg.ReservationTTL = DefaultReservationTTL
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = realClock{}
+	}
+	if cfg.Strategy == "" {
+		cfg.Strategy = StrategyRandom
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	var webhook *webhookNotifier
+	if cfg.WebhookURL != "" {
+		webhook = newWebhookNotifier(cfg.WebhookURL, cfg.Logger)
+	}
+
+	km := &KeyManager{
+		KeyLength:         cfg.KeyLength,
+		KeyFormat:         cfg.KeyFormat,
+		KeyPrefix:         cfg.KeyPrefix,
+		KeyValidator:      cfg.KeyValidator,
+		BlockTTL:          cfg.BlockTTL,
+		MinBlockTTL:       cfg.MinBlockTTL,
+		MaxBlockTTL:       cfg.MaxBlockTTL,
+		IdleTTL:           cfg.IdleTTL,
+		ExemptBlocked:     cfg.ExemptBlocked,
+		TickInterval:      cfg.TickInterval,
+		MaxBatchSize:      cfg.MaxBatchSize,
+		MaxKeys:           cfg.MaxKeys,
+		MaxBlocked:        cfg.MaxBlocked,
+		MaxRenewals:       cfg.MaxRenewals,
+		Eviction:          cfg.Eviction,
+		Store:             cfg.Store,
+		FlushInterval:     cfg.FlushInterval,
+		WriteThrough:      cfg.WriteThrough,
+		MaxPendingWrites:  cfg.MaxPendingWrites,
+		ReclaimCooldown:   cfg.ReclaimCooldown,
+		ReservationTTL:    cfg.ReservationTTL,
+		Clock:             cfg.Clock,
+		Strategy:          cfg.Strategy,
+		DeleteGracePeriod: cfg.DeleteGracePeriod,
+		ClientQuota:       cfg.ClientQuota,
+		ClientQuotas:      cfg.ClientQuotas,
+		AutoGenerate:      cfg.AutoGenerate,
+		FairLeasing:       cfg.FairLeasing,
+		AffinityWindow:    cfg.AffinityWindow,
+		keys:              make(map[string]KeyMetadata),
+		blocked:           make(map[string]time.Time),
+		available:         make(map[string][]string),
+		deleted:           make(map[string]time.Time),
+		cooling:           make(map[string]time.Time),
+		reserved:          make(map[string]time.Time),
+		leasedBy:          make(map[string]int),
+		waiting:           make(map[waiterKey]int),
+		lastLeased:        make(map[string]uint64),
+		lastHeld:          make(map[string]heldKey),
+		history:           make(map[string][]KeyEvent),
+		pending:           make(map[string]struct{}),
+		logger:            cfg.Logger,
+		metrics:           newKeyMetrics(),
+		webhook:           webhook,
+		events:            newEventBus(),
+	}
+	km.keyAvailable = sync.NewCond(&km.mu)
+	km.wake = make(chan struct{}, 1)
+	km.rng = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	return km
 }
 
-func NewKeyManager() *KeyManager {
-	return &KeyManager{
-		keys:    make(map[string]KeyMetadata),
-		blocked: make(map[string]time.Time),
+// load replaces the in-memory state with the contents of km.Store, rebuilding
+// the available and blocked indexes from each key's IsBlocked flag.
+func (km *KeyManager) load() error {
+	keys, err := km.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	km.keys = make(map[string]KeyMetadata, len(keys))
+	km.blocked = make(map[string]time.Time)
+	km.deleted = make(map[string]time.Time)
+	km.cooling = make(map[string]time.Time)
+	km.reserved = make(map[string]time.Time)
+	km.leasedBy = make(map[string]int)
+	km.history = make(map[string][]KeyEvent)
+	var available []KeyMetadata
+	for key, metadata := range keys {
+		metadata.Key = key
+		km.keys[key] = metadata
+		if !metadata.DeletedAt.IsZero() {
+			km.deleted[key] = metadata.DeletedAt
+		} else if metadata.IsBlocked {
+			metadata = km.restoreLease(metadata)
+			km.keys[key] = metadata
+			km.blocked[key] = metadata.Expiry
+			km.trackLease(metadata.Client, 1)
+		} else if !metadata.ReservedUntil.IsZero() {
+			km.reserved[key] = metadata.ReservedUntil
+		} else {
+			available = append(available, metadata)
+		}
+	}
+
+	sortByCreation(available)
+	km.available = make(map[string][]string)
+	for _, metadata := range available {
+		km.available[metadata.Pool] = append(km.available[metadata.Pool], metadata.Key)
+	}
+	km.rebuildExpiries()
+	return nil
+}
+
+// restoreLease fills in the lease fields that are not serialised for a
+// blocked key read back from a snapshot. Keys saved without an expiry are
+// given BlockTTL from the time they were blocked.
+func (km *KeyManager) restoreLease(metadata KeyMetadata) KeyMetadata {
+	if metadata.Expiry.IsZero() {
+		metadata.Expiry = metadata.BlockedAt.Add(km.BlockTTL)
+	}
+	metadata.LeaseTTL = metadata.Expiry.Sub(metadata.BlockedAt)
+	return metadata
+}
+
+// Flush writes a snapshot of every key to km.Store. It is a no-op when no
+// store is configured.
+//
+// A failed flush loses nothing: the keys stay in memory and keep being
+// served, and the changes made meanwhile are written by the first flush that
+// succeeds. Until then Ready reports the error.
+func (km *KeyManager) Flush() error {
+	if km.Store == nil {
+		return nil
+	}
+
+	km.flushMu.Lock()
+	defer km.flushMu.Unlock()
+
+	km.mu.Lock()
+	snapshot := make(map[string]KeyMetadata, len(km.keys))
+	for key, metadata := range km.keys {
+		snapshot[key] = metadata
+	}
+	pending := km.pending
+	km.pending = make(map[string]struct{})
+	km.mu.Unlock()
+
+	err := km.Store.Save(snapshot)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err != nil {
+		for key := range pending {
+			km.pending[key] = struct{}{}
+		}
+		km.storeErr = err
+		return err
+	}
+	if km.storeErr != nil {
+		km.logger.Info("key store recovered", "replayed", len(pending))
+		km.storeErr = nil
+	}
+	return nil
+}
+
+// writeThrough flushes to Store under WriteThrough once a mutation has
+// succeeded, replacing a nil *err with ErrNotPersisted if the flush fails.
+// Callers defer it ahead of taking km.mu, so it runs after the lock is
+// released.
+func (km *KeyManager) writeThrough(err *error) {
+	if *err != nil || !km.WriteThrough || km.Store == nil {
+		return
+	}
+	if flushErr := km.Flush(); flushErr != nil {
+		*err = fmt.Errorf("%w: %v", ErrNotPersisted, flushErr)
+	}
+}
+
+// writeThroughLogged is writeThrough for changes made where no error can be
+// returned, such as by the sweep, which only log a failed flush.
+func (km *KeyManager) writeThroughLogged() {
+	var err error
+	if km.writeThrough(&err); err != nil {
+		km.logger.Error("flushing key store", "err", err)
+	}
+}
+
+// putKey stores metadata for key, bumping its version, and marks it for the
+// next flush. The caller must hold km.mu.
+func (km *KeyManager) putKey(key string, metadata KeyMetadata) {
+	metadata.Version++
+	km.keys[key] = metadata
+	km.markPending(key)
+}
+
+// dropKey forgets key and marks it for the next flush. The caller must hold
+// km.mu.
+func (km *KeyManager) dropKey(key string) {
+	delete(km.keys, key)
+	delete(km.history, key)
+	km.markPending(key)
+}
+
+// markPending records that key has changed since the last flush. The caller
+// must hold km.mu.
+func (km *KeyManager) markPending(key string) {
+	if km.Store != nil {
+		km.pending[key] = struct{}{}
+	}
+}
+
+// checkPending returns ErrStoreUnavailable when the last flush failed and
+// MaxPendingWrites changes are already waiting for the store, so no more can
+// be accepted without risking their loss. The caller must hold km.mu.
+func (km *KeyManager) checkPending() error {
+	if km.storeErr != nil && len(km.pending) >= km.MaxPendingWrites {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, km.storeErr)
+	}
+	return nil
+}
+
+// PersistTask flushes state to km.Store every FlushInterval until ctx is
+// cancelled.
+func (km *KeyManager) PersistTask(ctx context.Context) {
+	ticker := time.NewTicker(km.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := km.Flush(); err != nil {
+				km.logger.Error("flushing key store", "err", err)
+			}
+		}
+	}
+}
+
+// GenerateRandomKey returns a URL-safe base64 token built from n bytes read
+// from crypto/rand.
+func GenerateRandomKey(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (km *KeyManager) GenerateNewKey() (string, error) {
+	return km.GenerateNewKeyWithTags(nil)
+}
+
+// GenerateNewKeyWithTags creates a new available key labelled with tags.
+func (km *KeyManager) GenerateNewKeyWithTags(tags map[string]string) (string, error) {
+	return km.GenerateNewKeyCtx(context.Background(), tags)
+}
+
+// GenerateNewKeyCtx is GenerateNewKeyWithTags honouring ctx.
+func (km *KeyManager) GenerateNewKeyCtx(ctx context.Context, tags map[string]string) (_ string, err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := km.checkPending(); err != nil {
+		return "", err
+	}
+
+	newKey, err := km.createKey(poolFromContext(ctx), tags)
+	if err != nil {
+		return "", err
+	}
+	km.offerKey(newKey, reservationFromContext(ctx))
+	km.logger.Debug("generated key", "key", keyFingerprint(newKey))
+
+	return newKey, nil
+}
+
+// RegisterKey adds key, chosen by the caller rather than generated, to the
+// available pool. It returns ErrKeyExists if key is already managed, which
+// makes provisioning a known id idempotent.
+func (km *KeyManager) RegisterKey(key string) error {
+	return km.RegisterKeyCtx(context.Background(), key, nil)
+}
+
+// RegisterKeyCtx is RegisterKey for a key labelled with tags, honouring ctx.
+func (km *KeyManager) RegisterKeyCtx(ctx context.Context, key string, tags map[string]string) (err error) {
+	defer km.writeThrough(&err)
+
+	if err := checkKeyID(key, km.KeyValidator); err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := km.checkPending(); err != nil {
+		return err
+	}
+	if _, exists := km.keys[key]; exists {
+		return ErrKeyExists
+	}
+	if err := km.makeRoom(1); err != nil {
+		return err
+	}
+
+	km.addKey(key, poolFromContext(ctx), tags)
+	km.offerKey(key, reservationFromContext(ctx))
+	km.logger.Debug("registered key", "key", keyFingerprint(key))
+
+	return nil
+}
+
+// GenerateKeys creates n keys in a single critical section.
+func (km *KeyManager) GenerateKeys(n int) (_ []string, err error) {
+	defer km.writeThrough(&err)
+
+	if n <= 0 || n > km.MaxBatchSize {
+		return nil, fmt.Errorf("%w: count must be between 1 and %d", ErrInvalidBatchSize, km.MaxBatchSize)
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := km.checkPending(); err != nil {
+		return nil, err
+	}
+
+	if err := km.makeRoom(n); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key, err := km.generateKey(DefaultPool, nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// generateKey creates a new available key in pool. The caller must hold
+// km.mu.
+func (km *KeyManager) generateKey(pool string, tags map[string]string) (string, error) {
+	newKey, err := km.createKey(pool, tags)
+	if err != nil {
+		return "", err
+	}
+	km.pushAvailable(newKey)
+
+	return newKey, nil
+}
+
+// createKey records a new key belonging to pool without making it available.
+// The caller must hold km.mu.
+func (km *KeyManager) createKey(pool string, tags map[string]string) (string, error) {
+	if err := km.makeRoom(1); err != nil {
+		return "", err
+	}
+
+	newKey, err := km.uniqueKey()
+	if err != nil {
+		return "", err
+	}
+	km.addKey(newKey, pool, tags)
+
+	return newKey, nil
+}
+
+// addKey records key, which must not already be managed, as belonging to
+// pool without making it available. The caller must hold km.mu.
+func (km *KeyManager) addKey(key, pool string, tags map[string]string) {
+	now := km.Clock.Now()
+	km.putKey(key, KeyMetadata{
+		Key:          key,
+		CreationTime: now,
+		Tags:         copyTags(tags),
+		Pool:         pool,
+	})
+	km.schedule(key, now.Add(km.IdleTTL))
+	km.metrics.generated.Inc()
+	km.publish(EventGenerated, key, now)
+}
+
+// GenerateLeasedKey creates a new key and leases it for ttl in one step, so
+// the caller is guaranteed to get the key it created. The key never passes
+// through the available pool.
+func (km *KeyManager) GenerateLeasedKey(ttl time.Duration) (KeyMetadata, error) {
+	return km.GenerateLeasedKeyCtx(context.Background(), ttl)
+}
+
+// GenerateLeasedKeyCtx is GenerateLeasedKey honouring ctx, creating the key in
+// its pool and counting the lease against its client's quota.
+func (km *KeyManager) GenerateLeasedKeyCtx(ctx context.Context, ttl time.Duration) (_ KeyMetadata, err error) {
+	defer km.writeThrough(&err)
+
+	token, err := GenerateRandomKey(LeaseTokenLength)
+	if err != nil {
+		return KeyMetadata{}, err
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	ttl = clampBlockTTL(ttl, km.BlockTTL, km.MinBlockTTL, km.MaxBlockTTL)
+	if err := ctx.Err(); err != nil {
+		return KeyMetadata{}, err
+	}
+	if err := km.checkPending(); err != nil {
+		return KeyMetadata{}, err
+	}
+	client := clientFromContext(ctx)
+	if err := km.checkQuota(client, 1); err != nil {
+		return KeyMetadata{}, err
+	}
+	if err := km.checkMaxBlocked(1); err != nil {
+		return KeyMetadata{}, err
+	}
+
+	key, err := km.createKey(poolFromContext(ctx), nil)
+	if err != nil {
+		return KeyMetadata{}, err
+	}
+	now := km.Clock.Now()
+	km.leaseKey(key, ttl, token, client, false, now)
+
+	return withExpiresIn(km.keys[key], now), nil
+}
+
+// copyTags returns a copy of tags so callers cannot mutate stored metadata,
+// or nil when there are none.
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		out[k] = v
+	}
+	return out
+}
+
+// clampBlockTTL resolves a requested lease duration, falling back to def when
+// ttl is zero and clamping the result to [min, max].
+func clampBlockTTL(ttl, def, min, max time.Duration) time.Duration {
+	if ttl == 0 {
+		ttl = def
+	}
+	if ttl < min {
+		ttl = min
+	}
+	if ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// uniqueKey generates random keys until it finds one that is not already
+// managed. The caller must hold km.mu.
+func (km *KeyManager) uniqueKey() (string, error) {
+	for {
+		key, err := GenerateFormattedKey(km.KeyFormat, km.KeyPrefix, km.KeyLength)
+		if err != nil {
+			return "", err
+		}
+		if _, exists := km.keys[key]; !exists {
+			return key, nil
+		}
+	}
+}
+
+func (km *KeyManager) RetreiveAvailableKey() (string, error) {
+	return km.RetreiveAvailableKeyWithTTL(0)
+}
+
+// RetreiveAvailableKeyWithTTL leases a key for ttl, clamped to
+// [MinBlockTTL, MaxBlockTTL]. A zero ttl uses BlockTTL.
+func (km *KeyManager) RetreiveAvailableKeyWithTTL(ttl time.Duration) (string, error) {
+	return km.RetreiveAvailableKeyCtx(context.Background(), ttl)
+}
+
+// RetreiveAvailableKeyCtx is RetreiveAvailableKeyWithTTL honouring ctx.
+func (km *KeyManager) RetreiveAvailableKeyCtx(ctx context.Context, ttl time.Duration) (string, error) {
+	lease, err := km.LeaseKeyCtx(ctx, ttl)
+	return lease.KeyID, err
+}
+
+// LeaseKey leases a key like RetreiveAvailableKeyWithTTL and also returns the
+// token that ReleaseKey requires.
+func (km *KeyManager) LeaseKey(ttl time.Duration) (Lease, error) {
+	return km.LeaseKeyCtx(context.Background(), ttl)
+}
+
+// LeaseKeyCtx is LeaseKey honouring ctx.
+func (km *KeyManager) LeaseKeyCtx(ctx context.Context, ttl time.Duration) (_ Lease, err error) {
+	defer km.writeThrough(&err)
+
+	token, err := GenerateRandomKey(LeaseTokenLength)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	ttl = clampBlockTTL(ttl, km.BlockTTL, km.MinBlockTTL, km.MaxBlockTTL)
+	if err := ctx.Err(); err != nil {
+		return Lease{}, err
+	}
+	if err := km.checkPending(); err != nil {
+		return Lease{}, err
+	}
+
+	client := clientFromContext(ctx)
+	if err := km.checkQuota(client, 1); err != nil {
+		return Lease{}, err
+	}
+	if err := km.checkMaxBlocked(1); err != nil {
+		return Lease{}, err
+	}
+	pool := poolFromContext(ctx)
+	sliding := slidingFromContext(ctx)
+	if km.claimable(pool, client) == 0 {
+		return km.leaseGenerated(pool, ttl, token, client, sliding)
+	}
+	return km.leaseNext(pool, ttl, token, client, sliding), nil
+}
+
+// LeaseKeys leases n available keys at once, or none at all: when fewer than
+// n are available it returns ErrNoKeysAvailable and leaves the pool as it
+// was.
+func (km *KeyManager) LeaseKeys(n int) ([]string, error) {
+	leases, err := km.LeaseKeysCtx(context.Background(), 0, n)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(leases))
+	for i, lease := range leases {
+		keys[i] = lease.KeyID
+	}
+	return keys, nil
+}
+
+// LeaseKeysCtx is LeaseKeys for leases of ttl, honouring ctx, that returns
+// the lease tokens as well.
+func (km *KeyManager) LeaseKeysCtx(ctx context.Context, ttl time.Duration, n int) (_ []Lease, err error) {
+	defer km.writeThrough(&err)
+
+	if n <= 0 || n > km.MaxBatchSize {
+		return nil, fmt.Errorf("%w: count must be between 1 and %d", ErrInvalidBatchSize, km.MaxBatchSize)
+	}
+	tokens := make([]string, n)
+	for i := range tokens {
+		token, err := GenerateRandomKey(LeaseTokenLength)
+		if err != nil {
+			return nil, err
+		}
+		tokens[i] = token
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	ttl = clampBlockTTL(ttl, km.BlockTTL, km.MinBlockTTL, km.MaxBlockTTL)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := km.checkPending(); err != nil {
+		return nil, err
+	}
+
+	client := clientFromContext(ctx)
+	if err := km.checkQuota(client, n); err != nil {
+		return nil, err
+	}
+	if err := km.checkMaxBlocked(n); err != nil {
+		return nil, err
+	}
+	pool := poolFromContext(ctx)
+	if km.claimable(pool, client) < n {
+		return nil, ErrNoKeysAvailable
+	}
+
+	sliding := slidingFromContext(ctx)
+	leases := make([]Lease, n)
+	for i, token := range tokens {
+		leases[i] = km.leaseNext(pool, ttl, token, client, sliding)
+	}
+	return leases, nil
+}
+
+// leaseGenerated leases a freshly generated key from pool to client when
+// AutoGenerate is set. It returns ErrNoKeysAvailable when it is not, or when
+// MaxKeys leaves no room for another key. The caller must hold km.mu.
+func (km *KeyManager) leaseGenerated(pool string, ttl time.Duration, token, client string, sliding bool) (Lease, error) {
+	if !km.AutoGenerate {
+		return Lease{}, ErrNoKeysAvailable
+	}
+	key, err := km.createKey(pool, nil)
+	if errors.Is(err, ErrPoolFull) {
+		return Lease{}, ErrNoKeysAvailable
+	}
+	if err != nil {
+		return Lease{}, err
+	}
+	km.logger.Debug("generated key on demand", "key", keyFingerprint(key))
+
+	km.leaseKey(key, ttl, token, client, sliding, km.Clock.Now())
+	return Lease{KeyID: key, LeaseToken: token}, nil
+}
+
+// leaseNext takes the next key from pool, which must have one available, and
+// leases it to client. The key client held last comes first while its
+// AffinityWindow is open. The caller must hold km.mu.
+func (km *KeyManager) leaseNext(pool string, ttl time.Duration, token, client string, sliding bool) Lease {
+	now := km.Clock.Now()
+	available := km.available[pool]
+	index, ok := km.affinityIndex(client, available, now)
+	if !ok {
+		index = km.nextAvailable(len(available))
+	}
+	key := available[index]
+	km.available[pool] = append(available[:index], available[index+1:]...)
+
+	km.leaseKey(key, ttl, token, client, sliding, now)
+	return Lease{KeyID: key, LeaseToken: token}
+}
+
+// nextAvailable returns the index, among n available keys of a pool, of the
+// key the next lease should hand out according to km.Strategy. n must not be
+// zero. The caller must hold km.mu.
+func (km *KeyManager) nextAvailable(n int) int {
+	switch km.Strategy {
+	case StrategyFIFO:
+		return 0
+	case StrategyLIFO:
+		return n - 1
+	default:
+		return km.rng.IntN(n)
+	}
+}
+
+// checkMaxBlocked returns ErrTooManyLeases if n more leases would take the
+// number of leased keys past MaxBlocked. The caller must hold km.mu.
+func (km *KeyManager) checkMaxBlocked(n int) error {
+	if km.MaxBlocked > 0 && len(km.blocked)+n > km.MaxBlocked {
+		return ErrTooManyLeases
+	}
+	return nil
+}
+
+// leaseKey marks key as blocked for ttl starting at now and records token and
+// client as the lease holder. With sliding set, reads of the key renew the
+// lease. The key must already have been removed from the available pool. The
+// caller must hold km.mu.
+func (km *KeyManager) leaseKey(key string, ttl time.Duration, token, client string, sliding bool, now time.Time) {
+	metadata := km.keys[key]
+	metadata.LastAccess = now
+	metadata.IsBlocked = true
+	metadata.BlockedAt = now
+	metadata.Expiry = now.Add(ttl)
+	metadata.LeaseTTL = ttl
+	metadata.LeaseToken = token
+	metadata.Client = client
+	metadata.Sliding = sliding
+	metadata.Renewals = 0
+	km.putKey(key, metadata)
+
+	km.blocked[key] = metadata.Expiry
+	km.trackLease(client, 1)
+	km.noteLease(client)
+	km.schedule(key, metadata.Expiry)
+	km.metrics.leased.Inc()
+	km.publish(EventLeased, key, now)
+}
+
+func (km *KeyManager) UnblockKey(key string) error {
+	return km.UnblockKeyCtx(context.Background(), key)
+}
+
+// UnblockKeyCtx is UnblockKey honouring ctx.
+func (km *KeyManager) UnblockKeyCtx(ctx context.Context, key string) (err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := km.checkPending(); err != nil {
+		return err
+	}
+
+	if _, err := km.liveKey(key); err != nil {
+		return err
+	}
+	if err := km.checkVersion(ctx, key); err != nil {
+		return err
+	}
+	return km.unblock(key, km.Clock.Now())
+}
+
+// UnblockMany is UnblockKey for several keys under a single hold of the
+// lock. The result maps every key to the error UnblockKey would have
+// returned for it, nil on success. It fails as a whole with
+// ErrInvalidBatchSize when keys is empty or longer than MaxBatchSize.
+func (km *KeyManager) UnblockMany(keys []string) (_ map[string]error, err error) {
+	defer km.writeThrough(&err)
+
+	if len(keys) == 0 || len(keys) > km.MaxBatchSize {
+		return nil, fmt.Errorf("%w: between 1 and %d keys are required", ErrInvalidBatchSize, km.MaxBatchSize)
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := km.checkPending(); err != nil {
+		return nil, err
+	}
+
+	now := km.Clock.Now()
+	results := make(map[string]error, len(keys))
+	for _, key := range keys {
+		results[key] = km.unblock(key, now)
+	}
+	return results, nil
+}
+
+// unblock ends the lease on key at now and returns it to the available pool,
+// or returns ErrKeyNotBlocked if it is not leased. The caller must hold
+// km.mu.
+func (km *KeyManager) unblock(key string, now time.Time) error {
+	if _, err := km.liveKey(key); err != nil {
+		return err
+	}
+	if _, exists := km.blocked[key]; !exists {
+		return ErrKeyNotBlocked
+	}
+	km.releaseKey(key, now)
+	km.metrics.unblocked.Inc()
+	km.publish(EventUnblocked, key, now)
+	return nil
+}
+
+// ForceExpire ends the lease on key now, exactly as if it had run out: the
+// key returns to the pool, counts as expired and is reported to the webhook.
+// It returns ErrKeyNotBlocked if key is not leased.
+func (km *KeyManager) ForceExpire(key string) (err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+
+	if err := km.checkPending(); err != nil {
+		km.mu.Unlock()
+		return err
+	}
+	if _, err := km.liveKey(key); err != nil {
+		km.mu.Unlock()
+		return err
+	}
+	if _, blocked := km.blocked[key]; !blocked {
+		km.mu.Unlock()
+		return ErrKeyNotBlocked
+	}
+
+	now := km.Clock.Now()
+	km.reclaimKey(key, now)
+	km.metrics.expired.Inc()
+	km.publish(EventExpired, key, now)
+	km.mu.Unlock()
+
+	km.logger.Info("force-expired key", "key", keyFingerprint(key))
+	if km.webhook != nil {
+		km.webhook.Notify(KeyEvent{Event: EventExpired, Key: key, At: now})
+	}
+	return nil
+}
+
+// ReleaseKey ends the lease on key early, but only for the caller holding the
+// lease: token must match the one issued by LeaseKey, otherwise
+// ErrLeaseNotHeld is returned.
+func (km *KeyManager) ReleaseKey(key, token string) error {
+	return km.ReleaseKeyCtx(context.Background(), key, token)
+}
+
+// ReleaseKeyCtx is ReleaseKey honouring ctx.
+func (km *KeyManager) ReleaseKeyCtx(ctx context.Context, key, token string) (err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := km.checkPending(); err != nil {
+		return err
+	}
+
+	metadata, err := km.liveKey(key)
+	if err != nil {
+		return err
+	}
+	if _, exists := km.blocked[key]; !exists {
+		return ErrKeyNotBlocked
+	}
+	if subtle.ConstantTimeCompare([]byte(metadata.LeaseToken), []byte(token)) != 1 {
+		return ErrLeaseNotHeld
+	}
+
+	now := km.Clock.Now()
+	km.releaseKey(key, now)
+	km.metrics.unblocked.Inc()
+	km.publish(EventUnblocked, key, now)
+	return nil
+}
+
+// DeleteKey removes key, returning ErrKeyNotFound if it does not exist.
+func (km *KeyManager) DeleteKey(key string) error {
+	return km.DeleteKeyCtx(context.Background(), key)
+}
+
+// DeleteKeyCtx is DeleteKey honouring ctx.
+func (km *KeyManager) DeleteKeyCtx(ctx context.Context, key string) (err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := km.checkPending(); err != nil {
+		return err
+	}
+
+	if _, err := km.liveKey(key); err != nil {
+		return err
+	}
+	if km.DeleteGracePeriod > 0 {
+		km.softDeleteKey(key, km.Clock.Now())
+		return nil
+	}
+	km.deleteKey(key)
+
+	return nil
+}
+
+// DeleteWhere deletes every key for which match returns true, under a single
+// lock, and returns how many were deleted. As with DeleteKey, keys are only
+// soft-deleted while DeleteGracePeriod is set, and keys that already are
+// soft-deleted are left alone.
+func (km *KeyManager) DeleteWhere(match func(KeyMetadata) bool) (_ int, err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := km.checkPending(); err != nil {
+		return 0, err
+	}
+
+	// Collect the keys first so that km.keys is not changed while it is
+	// being ranged over.
+	keys := km.matching(match)
+	now := km.Clock.Now()
+	unavailable := make(map[string]bool)
+	for _, key := range keys {
+		if km.DeleteGracePeriod > 0 {
+			km.softDeleteKey(key, now)
+			continue
+		}
+		if km.isAvailable(key) {
+			unavailable[key] = true
+		}
+		km.forgetKey(key)
+	}
+	km.removeAvailableKeys(unavailable)
+
+	return len(keys), nil
+}
+
+// FindWhere returns the sorted ids of the keys DeleteWhere(match) would
+// delete, without deleting them.
+func (km *KeyManager) FindWhere(match func(KeyMetadata) bool) []string {
+	km.mu.RLock()
+	ids := km.matching(match)
+	km.mu.RUnlock()
+
+	sort.Strings(ids)
+	return ids
+}
+
+// matching returns the ids of the keys that are not soft-deleted and for
+// which match returns true. The caller must hold km.mu.
+func (km *KeyManager) matching(match func(KeyMetadata) bool) []string {
+	ids := make([]string, 0)
+	for key, metadata := range km.keys {
+		if _, deleted := km.deleted[key]; !deleted && match(metadata) {
+			ids = append(ids, key)
+		}
+	}
+	return ids
+}
+
+// RestoreKey brings a soft-deleted key back into the available pool. It
+// returns ErrKeyNotDeleted for a key that is not soft-deleted.
+func (km *KeyManager) RestoreKey(key string) (err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := km.checkPending(); err != nil {
+		return err
+	}
+
+	metadata, exists := km.keys[key]
+	if !exists {
+		return ErrKeyNotFound
+	}
+	if _, deleted := km.deleted[key]; !deleted {
+		return ErrKeyNotDeleted
+	}
+
+	metadata.DeletedAt = time.Time{}
+	metadata.LastAccess = km.Clock.Now()
+	km.putKey(key, metadata)
+	delete(km.deleted, key)
+	km.pushAvailable(key)
+
+	km.logger.Info("restored key", "key", keyFingerprint(key))
+	return nil
+}
+
+// liveKey returns key's metadata, or ErrKeyNotFound if it does not exist and
+// ErrKeyDeleted if it is soft-deleted. The caller must hold km.mu.
+func (km *KeyManager) liveKey(key string) (KeyMetadata, error) {
+	metadata, exists := km.keys[key]
+	if !exists {
+		return KeyMetadata{}, ErrKeyNotFound
+	}
+	if _, deleted := km.deleted[key]; deleted {
+		return KeyMetadata{}, ErrKeyDeleted
+	}
+	return metadata, nil
+}
+
+// softDeleteKey ends any lease on key, takes it out of the available pool
+// and marks it deleted as of now, leaving it for the sweep to purge once
+// DeleteGracePeriod has passed. The caller must hold km.mu.
+func (km *KeyManager) softDeleteKey(key string, now time.Time) {
+	metadata := km.keys[key]
+	if _, blocked := km.blocked[key]; blocked {
+		km.trackLease(metadata.Client, -1)
+	}
+	metadata.Client = ""
+	metadata.Sliding = false
+	metadata.Renewals = 0
+	metadata.IsBlocked = false
+	metadata.Expiry = time.Time{}
+	metadata.LeaseTTL = 0
+	metadata.LeaseToken = ""
+	metadata.ReservedUntil = time.Time{}
+	metadata.DeletedAt = now
+	km.putKey(key, metadata)
+
+	delete(km.blocked, key)
+	if _, cooling := km.cooling[key]; cooling {
+		delete(km.cooling, key)
+	} else if _, reserved := km.reserved[key]; reserved {
+		delete(km.reserved, key)
+	} else {
+		km.removeAvailable(key)
 	}
+	km.deleted[key] = now
+	km.schedule(key, now.Add(km.DeleteGracePeriod))
 }
 
-func GenerateRandomKey() string {
-	return "key" + strconv.Itoa(rand.Int())
-}
+// RotateKey replaces key with a freshly generated id and returns it. The
+// creation time, tags and lease state, including the lease token, carry over,
+// so an available key stays in its place in the pool and a leased key stays
+// leased to the same holder.
+func (km *KeyManager) RotateKey(key string) (_ string, err error) {
+	defer km.writeThrough(&err)
 
-func (km *KeyManager) GenerateNewKey() string {
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
-	newKey := GenerateRandomKey()
+	if err := km.checkPending(); err != nil {
+		return "", err
+	}
+
+	metadata, err := km.liveKey(key)
+	if err != nil {
+		return "", err
+	}
+	newKey, err := km.uniqueKey()
+	if err != nil {
+		return "", err
+	}
+
+	metadata.Key = newKey
+	km.putKey(newKey, metadata)
+	km.dropKey(key)
 
-	km.keys[newKey] = KeyMetadata{
-		Key:          newKey,
-		CreationTime: time.Now(),
+	if expiry, blocked := km.blocked[key]; blocked {
+		km.blocked[newKey] = expiry
+		delete(km.blocked, key)
+	} else if until, cooling := km.cooling[key]; cooling {
+		km.cooling[newKey] = until
+		delete(km.cooling, key)
+	} else if until, reserved := km.reserved[key]; reserved {
+		km.reserved[newKey] = until
+		delete(km.reserved, key)
+	} else {
+		available := km.available[metadata.Pool]
+		for i, k := range available {
+			if k == key {
+				available[i] = newKey
+				break
+			}
+		}
 	}
-	fmt.Println(km.keys[newKey])
-	km.available = append(km.available, newKey)
+	due, _ := km.dueAt(newKey)
+	km.schedule(newKey, due)
 
-	return newKey
+	km.logger.Info("rotated key", "key", keyFingerprint(key), "newKey", keyFingerprint(newKey))
+	return newKey, nil
 }
 
-func (km *KeyManager) RetreiveAvailableKey() (string, error) {
+// Clear removes every key, leased or not, and returns how many were removed.
+func (km *KeyManager) Clear() int {
+	defer km.writeThroughLogged()
+
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
-	if len(km.available) == 0 {
-		return "", errors.New("no keys available")
+	removed := len(km.keys)
+	for key := range km.keys {
+		km.markPending(key)
 	}
+	km.keys = make(map[string]KeyMetadata)
+	km.available = make(map[string][]string)
+	km.blocked = make(map[string]time.Time)
+	km.deleted = make(map[string]time.Time)
+	km.cooling = make(map[string]time.Time)
+	km.reserved = make(map[string]time.Time)
+	km.expiries = nil
+	km.leasedBy = make(map[string]int)
+	km.lastHeld = make(map[string]heldKey)
+	km.history = make(map[string][]KeyEvent)
+	km.metrics.deleted.Add(float64(removed))
+
+	km.logger.Info("cleared key pool", "removed", removed)
+	return removed
+}
 
-	index := rand.Intn(len(km.available))
-	key := km.available[index]
-	km.available = append(km.available[:index], km.available[index+1:]...)
+// publish records that event happened to key at now in the key's history and
+// tells GET /events subscribers about it. The caller must hold km.mu.
+func (km *KeyManager) publish(event, key string, now time.Time) {
+	km.record(event, key, now)
+	km.events.publish(KeyEvent{Event: event, Key: key, At: now})
+}
+
+// releaseKey ends the lease on key at now and returns it to the available
+// pool. The caller must hold km.mu.
+func (km *KeyManager) releaseKey(key string, now time.Time) {
+	km.endLease(key, now)
+	km.pushAvailable(key)
+}
 
-	km.keys[key] = KeyMetadata{
-		Key:        key,
-		LastAccess: time.Now(),
-		IsBlocked:  true,
-		BlockedAt:  time.Now(),
+// reclaimKey ends the lease on key at now because it ran out or was forced
+// to. The key returns to the available pool once ReclaimCooldown has passed.
+// The caller must hold km.mu.
+func (km *KeyManager) reclaimKey(key string, now time.Time) {
+	km.endLease(key, now)
+	if km.ReclaimCooldown <= 0 {
+		km.pushAvailable(key)
+		return
 	}
+	km.cooling[key] = now.Add(km.ReclaimCooldown)
+	km.schedule(key, km.cooling[key])
+}
 
-	km.blocked[key] = time.Now()
-	return key, nil
+// endLease resets the lease fields of key and unblocks it, leaving it in no
+// pool. LastAccess is set to now, so a key that was leased for longer than
+// IdleTTL is not reaped the moment it is given back. Creation time, tags and
+// every other attribute are carried over untouched. The caller must hold
+// km.mu.
+func (km *KeyManager) endLease(key string, now time.Time) {
+	metadata := km.keys[key]
+	km.metrics.leaseDuration.Observe(elapsed(metadata.BlockedAt, now).Seconds())
+	km.trackLease(metadata.Client, -1)
+	km.rememberHeld(metadata.Client, key, now)
+
+	metadata.Client = ""
+	metadata.Sliding = false
+	metadata.Renewals = 0
+	metadata.IsBlocked = false
+	metadata.Expiry = time.Time{}
+	metadata.LeaseTTL = 0
+	metadata.LeaseToken = ""
+	metadata.LastAccess = now
+	km.putKey(key, metadata)
+
+	delete(km.blocked, key)
 }
 
-func (km *KeyManager) UnblockKey(key string) error {
-	km.mu.Lock()
-	defer km.mu.Unlock()
+// deleteKey removes key from keys and from whichever of available, blocked
+// and deleted holds it, so that no index is left naming a key that no longer
+// exists. The caller must hold km.mu.
+func (km *KeyManager) deleteKey(key string) {
+	if km.isAvailable(key) {
+		km.removeAvailable(key)
+	}
+	km.forgetKey(key)
+}
 
-	if _, exists := km.blocked[key]; exists {
-		metadata := km.keys[key]
-		metadata.IsBlocked = false
-		delete(km.blocked, key)
-		km.available = append(km.available, key)
-		km.keys[key] = metadata
-		return nil
+// isAvailable reports whether key is managed and neither leased, cooling
+// down, reserved nor soft-deleted, which is exactly when it is in available.
+// The caller must hold km.mu.
+func (km *KeyManager) isAvailable(key string) bool {
+	_, exists := km.keys[key]
+	_, blocked := km.blocked[key]
+	_, deleted := km.deleted[key]
+	_, cooling := km.cooling[key]
+	_, reserved := km.reserved[key]
+	return exists && !blocked && !deleted && !cooling && !reserved
+}
+
+// forgetKey is deleteKey without the scan of available, for callers deleting
+// many keys that then drop them from available in one pass with
+// removeAvailableKeys. The caller must hold km.mu.
+func (km *KeyManager) forgetKey(key string) {
+	if _, exists := km.keys[key]; exists {
+		km.metrics.deleted.Inc()
+		km.publish(EventDeleted, key, km.Clock.Now())
 	}
+	if _, blocked := km.blocked[key]; blocked {
+		km.trackLease(km.keys[key].Client, -1)
+	}
+	km.dropKey(key)
+	delete(km.blocked, key)
+	delete(km.deleted, key)
+	delete(km.cooling, key)
+	delete(km.reserved, key)
+}
 
-	return errors.New("key not blocked or not exist")
+// KeepAlive marks key as recently used so the idle sweep leaves it alone. If
+// key is leased, its lease is also renewed for another LeaseTTL from now, so a
+// holder that keeps heartbeating is never reclaimed. Keys that are not leased
+// only have LastAccess refreshed.
+func (km *KeyManager) KeepAlive(key string) error {
+	return km.KeepAliveCtx(context.Background(), key)
 }
 
-func (km *KeyManager) DeleteKey(key string) error {
+// KeepAliveCtx is KeepAlive honouring ctx.
+func (km *KeyManager) KeepAliveCtx(ctx context.Context, key string) (err error) {
+	defer km.writeThrough(&err)
+
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
-	delete(km.keys, key)
-	delete(km.blocked, key)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := km.checkPending(); err != nil {
+		return err
+	}
+	if err := km.checkVersion(ctx, key); err != nil {
+		return err
+	}
 
-	return nil
+	return km.keepAlive(key, km.Clock.Now())
 }
 
-func (km *KeyManager) KeepAlive(key string) error {
+// KeepAliveMany is KeepAlive for several keys under a single hold of the
+// lock. The result maps every key to the error KeepAlive would have returned
+// for it, nil on success. It fails as a whole with ErrInvalidBatchSize when
+// keys is empty or longer than MaxBatchSize.
+func (km *KeyManager) KeepAliveMany(keys []string) (_ map[string]error, err error) {
+	defer km.writeThrough(&err)
+
+	if len(keys) == 0 || len(keys) > km.MaxBatchSize {
+		return nil, fmt.Errorf("%w: between 1 and %d keys are required", ErrInvalidBatchSize, km.MaxBatchSize)
+	}
+
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
-	if _, exists := km.keys[key]; exists {
-		metadata := km.keys[key]
-		metadata.LastAccess = time.Now()
-		km.keys[key] = metadata
-		return nil
+	if err := km.checkPending(); err != nil {
+		return nil, err
+	}
+
+	now := km.Clock.Now()
+	results := make(map[string]error, len(keys))
+	for _, key := range keys {
+		results[key] = km.keepAlive(key, now)
+	}
+	return results, nil
+}
+
+// KeyStatus is the state of one key as reported by StatusMany. ExpiresIn is
+// set only while the key is leased.
+type KeyStatus struct {
+	Exists    bool    `json:"exists"`
+	Blocked   bool    `json:"blocked"`
+	ExpiresIn float64 `json:"expiresIn,omitempty"`
+}
+
+// StatusMany reports the state of every key under a single lock, so callers
+// holding many leases need not look each one up. Unknown and soft-deleted
+// keys are reported with Exists false.
+func (km *KeyManager) StatusMany(keys []string) (map[string]KeyStatus, error) {
+	if len(keys) == 0 || len(keys) > km.MaxBatchSize {
+		return nil, fmt.Errorf("%w: between 1 and %d keys are required", ErrInvalidBatchSize, km.MaxBatchSize)
+	}
+
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	now := km.Clock.Now()
+	statuses := make(map[string]KeyStatus, len(keys))
+	for _, key := range keys {
+		metadata, err := km.liveKey(key)
+		if err != nil {
+			statuses[key] = KeyStatus{}
+			continue
+		}
+		metadata = withExpiresIn(metadata, now)
+		statuses[key] = KeyStatus{Exists: true, Blocked: metadata.IsBlocked, ExpiresIn: metadata.ExpiresIn}
+	}
+	return statuses, nil
+}
+
+// keepAlive refreshes key's LastAccess and renews its lease if it is blocked.
+// A lease already renewed MaxRenewals times is left alone and
+// ErrRenewalLimit returned. The caller must hold km.mu.
+func (km *KeyManager) keepAlive(key string, now time.Time) error {
+	metadata, err := km.liveKey(key)
+	if err != nil {
+		return err
 	}
-	return errors.New("key does not exist")
+
+	_, blocked := km.blocked[key]
+	if blocked && !km.renewable(metadata) {
+		return ErrRenewalLimit
+	}
+	metadata.LastAccess = now
+	if blocked {
+		metadata.Expiry = now.Add(metadata.LeaseTTL)
+		metadata.Renewals++
+		km.blocked[key] = metadata.Expiry
+	}
+	km.putKey(key, metadata)
+	km.record(EventKeptAlive, key, now)
+	return nil
+}
+
+// renewable reports whether the lease described by metadata may be renewed
+// again under MaxRenewals.
+func (km *KeyManager) renewable(metadata KeyMetadata) bool {
+	return km.MaxRenewals <= 0 || metadata.Renewals < km.MaxRenewals
 }
 
 func (km *KeyManager) GetKeyInfo(key string) (KeyMetadata, error) {
+	return km.GetKeyInfoCtx(context.Background(), key)
+}
+
+// GetKeyInfoCtx is GetKeyInfo honouring ctx.
+func (km *KeyManager) GetKeyInfoCtx(ctx context.Context, key string) (KeyMetadata, error) {
+	km.mu.RLock()
+	if err := ctx.Err(); err != nil {
+		km.mu.RUnlock()
+		return KeyMetadata{}, err
+	}
+	metadata, exists := km.keys[key]
+	now := km.Clock.Now()
+	km.mu.RUnlock()
+
+	if !exists {
+		return KeyMetadata{}, ErrKeyNotFound
+	}
+	if metadata.Sliding && metadata.IsBlocked {
+		// Reading a sliding lease renews it, which needs the write lock.
+		return km.slideKeyInfo(key)
+	}
+	return withExpiresIn(metadata, now), nil
+}
+
+// slideKeyInfo is GetKeyInfoCtx for a key that was on a sliding lease when
+// it was looked up under the read lock. The key is looked up again, as it
+// may have changed in between.
+func (km *KeyManager) slideKeyInfo(key string) (_ KeyMetadata, err error) {
+	defer km.writeThrough(&err)
+
 	km.mu.Lock()
 	defer km.mu.Unlock()
 
-	fmt.Println(km.keys[key])
-	if metadata, exists := km.keys[key]; exists {
-		return metadata, nil
+	metadata, exists := km.keys[key]
+	if !exists {
+		return KeyMetadata{}, ErrKeyNotFound
 	}
-	return KeyMetadata{}, errors.New("key does not exist")
+	now := km.Clock.Now()
+	return withExpiresIn(km.slide(key, metadata, now), now), nil
 }
 
-func (km *KeyManager) BackgroundTask() {
-	for {
-		time.Sleep(1 * time.Second)
-		now := time.Now()
-
-		km.blockMu.Lock()
-
-		for key, blockedTime := range km.blocked {
-			if now.Sub(blockedTime) > 20*time.Second {
-				metadata := km.keys[key]
-				metadata.IsBlocked = false
-				delete(km.blocked, key)
-				km.keys[key] = metadata
-				km.available = append(km.available, key)
-			}
+// Key states accepted by ListKeysByState.
+const (
+	StateAll       = "all"
+	StateBlocked   = "blocked"
+	StateAvailable = "available"
+	StateDeleted   = "deleted"
+)
+
+var ErrInvalidState = errors.New(`state must be one of "all", "blocked", "available" or "deleted"`)
+
+// ListKeys returns up to limit keys starting at offset, ordered by creation
+// time, along with the total number of managed keys.
+func (km *KeyManager) ListKeys(offset, limit int) ([]KeyMetadata, int, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, errors.New("offset and limit must not be negative")
+	}
+
+	all, err := km.ListKeysByState(StateAll)
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := paginate(all, offset, limit)
+	return page, total, nil
+}
+
+// ListKeysByState returns every key in the given state, ordered by creation
+// time. A key counts as blocked only while it is both flagged and tracked in
+// the blocked index.
+func (km *KeyManager) ListKeysByState(state string) ([]KeyMetadata, error) {
+	switch state {
+	case StateAll, StateBlocked, StateAvailable, StateDeleted:
+	default:
+		return nil, ErrInvalidState
+	}
+
+	km.mu.RLock()
+	keys := make([]KeyMetadata, 0, len(km.keys))
+	for key, metadata := range km.keys {
+		_, tracked := km.blocked[key]
+		_, deleted := km.deleted[key]
+		current := StateAvailable
+		switch {
+		case deleted:
+			current = StateDeleted
+		case metadata.IsBlocked && tracked:
+			current = StateBlocked
+		}
+		if state == StateAll || state == current {
+			keys = append(keys, metadata)
 		}
-		km.blockMu.Unlock()
+	}
+	km.mu.RUnlock()
 
-		km.mu.Lock()
+	sortByCreation(keys)
+	return keys, nil
+}
 
-		for key, metadata := range km.keys {
-			if now.Sub(metadata.LastAccess) > 1*time.Minute {
-				km.DeleteKey(key)
-			}
+// GetAllKeyIDs returns the ids of every key that is not soft-deleted, sorted.
+// The slice is freshly allocated, so callers may modify it freely.
+func (km *KeyManager) GetAllKeyIDs() []string {
+	km.mu.RLock()
+	ids := make([]string, 0, len(km.keys)-len(km.deleted))
+	for key := range km.keys {
+		if _, deleted := km.deleted[key]; !deleted {
+			ids = append(ids, key)
 		}
-		km.mu.Unlock()
 	}
+	km.mu.RUnlock()
+
+	sort.Strings(ids)
+	return ids
 }
 
-func main() {
-	km := NewKeyManager()
-	go km.BackgroundTask()
+// FindByTag returns the ids of every key tagged k=v, ordered by creation time.
+func (km *KeyManager) FindByTag(k, v string) []string {
+	all, _ := km.ListKeysByState(StateAll)
+
+	var ids []string
+	for _, metadata := range filterByTag(all, k, v) {
+		ids = append(ids, metadata.Key)
+	}
+	return ids
+}
+
+// filterByTag returns the keys tagged k=v, preserving their order.
+func filterByTag(keys []KeyMetadata, k, v string) []KeyMetadata {
+	var matched []KeyMetadata
+	for _, metadata := range keys {
+		if tag, ok := metadata.Tags[k]; ok && tag == v {
+			matched = append(matched, metadata)
+		}
+	}
+	return matched
+}
 
-	r := gin.Default()
+// Stats summarises the pool.
+type Stats struct {
+	Total     int `json:"total"`
+	Available int `json:"available"`
+	Blocked   int `json:"blocked"`
+	Deleted   int `json:"deleted"`
+	// CoolingDown counts keys waiting out ReclaimCooldown.
+	CoolingDown int `json:"coolingDown"`
+	// Reserved counts keys waiting for ActivateKey.
+	Reserved  int       `json:"reserved"`
+	OldestKey time.Time `json:"oldestKeyCreatedAt"`
+}
 
-	r.POST("/keys", func(c *gin.Context) {
-		key := km.GenerateNewKey()
-		c.JSON(http.StatusCreated, gin.H{"keyId": key})
-	})
+// Stats returns counts for the pool read under a single lock, so Available,
+// Blocked, Deleted, CoolingDown and Reserved always add up to Total.
+func (km *KeyManager) Stats() Stats {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
 
-	r.GET("/keys", func(c *gin.Context) {
-		key, err := km.RetreiveAvailableKey()
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	stats := Stats{Total: len(km.keys)}
+	for key, metadata := range km.keys {
+		if _, deleted := km.deleted[key]; deleted {
+			stats.Deleted++
+		} else if _, blocked := km.blocked[key]; blocked {
+			stats.Blocked++
+		} else if _, cooling := km.cooling[key]; cooling {
+			stats.CoolingDown++
+		} else if _, reserved := km.reserved[key]; reserved {
+			stats.Reserved++
 		} else {
-			c.JSON(http.StatusOK, gin.H{"keyId": key})
+			stats.Available++
 		}
-	})
+		if stats.OldestKey.IsZero() || metadata.CreationTime.Before(stats.OldestKey) {
+			stats.OldestKey = metadata.CreationTime
+		}
+	}
+	return stats
+}
 
-	r.GET("/keys/:id", func(c *gin.Context) {
-		key := c.Param("id")
-		metadata, err := km.GetKeyInfo(key)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-		} else {
-			c.JSON(http.StatusOK, metadata)
+// PoolPressure describes an exhausted pool to a client whose lease failed, so
+// it can decide whether waiting is worthwhile.
+type PoolPressure struct {
+	Total   int `json:"total"`
+	Blocked int `json:"blocked"`
+	// NextFreeAt is the soonest a blocked key's lease runs out, or zero when
+	// nothing is leased and waiting would not help.
+	NextFreeAt time.Time `json:"nextFreeAt,omitzero"`
+}
+
+// PoolPressure reports how many keys exist, how many are leased and when the
+// first of those leases expires.
+func (km *KeyManager) PoolPressure() PoolPressure {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	pressure := PoolPressure{Total: len(km.keys), Blocked: len(km.blocked)}
+	for _, expiry := range km.blocked {
+		if pressure.NextFreeAt.IsZero() || expiry.Before(pressure.NextFreeAt) {
+			pressure.NextFreeAt = expiry
+		}
+	}
+	// A key coming out of its cooldown or reservation frees up just as
+	// surely.
+	for _, pending := range []map[string]time.Time{km.cooling, km.reserved} {
+		for _, until := range pending {
+			if pressure.NextFreeAt.IsZero() || until.Before(pressure.NextFreeAt) {
+				pressure.NextFreeAt = until
+			}
+		}
+	}
+	return pressure
+}
+
+// NextAvailable reports the soonest a lease from pool can succeed: now if a
+// key is available, otherwise when the first of the pool's leases, cooldowns
+// or reservations ends. It reports false when the pool has none of these, so
+// no key will free up by itself.
+func (km *KeyManager) NextAvailable(pool string) (time.Time, bool) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	now := km.Clock.Now()
+	if len(km.available[pool]) > 0 {
+		return now, true
+	}
+	var next time.Time
+	for _, pending := range []map[string]time.Time{km.blocked, km.cooling, km.reserved} {
+		for key, at := range pending {
+			if km.keys[key].Pool == pool && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
 		}
+	}
+	return next, !next.IsZero()
+}
+
+// paginate returns the window of keys starting at offset together with the
+// total length.
+func paginate(keys []KeyMetadata, offset, limit int) ([]KeyMetadata, int) {
+	total := len(keys)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return keys[offset:end], total
+}
 
+// sortByCreation orders keys oldest first, breaking ties by key so the order
+// is stable across calls.
+func sortByCreation(keys []KeyMetadata) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreationTime.Equal(keys[j].CreationTime) {
+			return keys[i].CreationTime.Before(keys[j].CreationTime)
+		}
+		return keys[i].Key < keys[j].Key
 	})
+}
+
+// Ready reports an error until BackgroundTask is running, while the last
+// flush to Store has failed, or when Store implements Pinger and cannot be
+// reached.
+func (km *KeyManager) Ready(ctx context.Context) error {
+	if !km.reaping.Load() {
+		return errors.New("background reaper is not running")
+	}
+	km.mu.RLock()
+	storeErr, pending := km.storeErr, len(km.pending)
+	km.mu.RUnlock()
+	if storeErr != nil {
+		return fmt.Errorf("flushing store: %w (%d changes pending)", storeErr, pending)
+	}
+	if p, ok := km.Store.(Pinger); ok {
+		if err := p.Ping(ctx); err != nil {
+			return fmt.Errorf("pinging store: %w", err)
+		}
+	}
+	return nil
+}
+
+// BackgroundTask sweeps for expired keys until ctx is cancelled. Rather than
+// polling, it sleeps until the earliest lease expiry, idle deadline or end of
+// a grace period, and at most TickInterval.
+func (km *KeyManager) BackgroundTask(ctx context.Context) {
+	timer := km.Clock.NewTimer(km.nextSweep(km.Clock.Now()))
+	defer timer.Stop()
+
+	km.reaping.Store(true)
+	defer km.reaping.Store(false)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-km.wake:
+		case now := <-timer.C():
+			km.sweep(now)
+		}
+		timer.Reset(km.nextSweep(km.Clock.Now()))
+	}
+}
+
+// nudge wakes BackgroundTask so it recomputes when to sweep next. It never
+// blocks. The caller must hold km.mu.
+func (km *KeyManager) nudge() {
+	select {
+	case km.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextSweep returns how long after now the next key falls due, capped at
+// TickInterval.
+func (km *KeyManager) nextSweep(now time.Time) time.Duration {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	next := now.Add(km.TickInterval)
+	if len(km.expiries) > 0 && km.expiries[0].due.Before(next) {
+		next = km.expiries[0].due
+	}
+
+	// Sweeps only act on deadlines strictly in the past, so aim just beyond.
+	return max(next.Sub(now)+time.Millisecond, 0)
+}
+
+// lastActivity is the time idle expiry is measured from: LastAccess, or
+// CreationTime for a key that has never been accessed.
+func lastActivity(metadata KeyMetadata) time.Time {
+	if metadata.LastAccess.After(metadata.CreationTime) {
+		return metadata.LastAccess
+	}
+	return metadata.CreationTime
+}
+
+// sweep unblocks keys whose lease has expired and deletes keys that have been
+// idle for longer than IdleTTL, as well as soft-deleted keys whose
+// DeleteGracePeriod has run out. Only keys at the head of the expiry heap are
+// examined. The sweep runs under a single hold of km.mu so the reaper never
+// races with request handlers; webhook notifications are sent after the lock
+// is released.
+func (km *KeyManager) sweep(now time.Time) {
+	km.mu.Lock()
+	km.checkClock(now)
+
+	var events []KeyEvent
+	unavailable := make(map[string]bool)
+	for len(km.expiries) > 0 && km.expiries[0].due.Before(now) {
+		key := heap.Pop(&km.expiries).(expiryEntry).key
+		due, exists := km.dueAt(key)
+		if !exists {
+			continue
+		}
+		if !due.Before(now) {
+			heap.Push(&km.expiries, expiryEntry{key: key, due: due})
+			continue
+		}
+
+		if expiry, blocked := km.blocked[key]; blocked && now.After(expiry) {
+			km.reclaimKey(key, now)
+			km.metrics.expired.Inc()
+			km.publish(EventExpired, key, now)
+			events = append(events, KeyEvent{Event: EventExpired, Key: key, At: now})
+		}
+		if until, cooling := km.cooling[key]; cooling && !now.Before(until) {
+			delete(km.cooling, key)
+			km.pushAvailable(key)
+		}
+		if until, reserved := km.reserved[key]; reserved && !now.Before(until) {
+			km.activate(key, now)
+		}
+		if due, _ = km.dueAt(key); !due.Before(now) {
+			heap.Push(&km.expiries, expiryEntry{key: key, due: due})
+			continue
+		}
+		if km.isAvailable(key) {
+			unavailable[key] = true
+		}
+		km.forgetKey(key)
+		events = append(events, KeyEvent{Event: EventDeleted, Key: key, At: now})
+	}
+	km.removeAvailableKeys(unavailable)
+	km.pruneAffinity(now)
+	changed := len(km.pending) > 0
 
-	r.DELETE("/keys/:id", func(c *gin.Context) {
-		key := c.Param("id")
-		err := km.DeleteKey(key)
+	km.mu.Unlock()
+	if changed {
+		km.writeThroughLogged()
+	}
+
+	if km.webhook != nil {
+		for _, ev := range events {
+			km.webhook.Notify(ev)
+		}
+	}
+}
+
+//go:generate swag init --parseFuncBody -g main.go
+
+// @title                      Keys Generator API
+// @version                    1.0
+// @description                Generates, leases and expires API keys.
+// @BasePath                   /
+// @securityDefinitions.apikey BearerAuth
+// @in                         header
+// @name                       Authorization
+func main() {
+	defaultAddr := DefaultListenAddr
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		defaultAddr = addr
+	}
+	listenAddr := flag.String("addr", defaultAddr, "address to listen on (overrides LISTEN_ADDR)")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger, err := newLogger(os.Stderr, os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fatal("configuring logger", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg := Config{
+		WebhookURL: os.Getenv("WEBHOOK_URL"),
+		Logger:     logger,
+	}
+	if raw := os.Getenv("MAX_KEYS"); raw != "" {
+		n, err := strconv.Atoi(raw)
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"message": "Key is deleted"})
+			fatal("parsing MAX_KEYS", err)
 		}
-	})
+		cfg.MaxKeys = n
+	}
+	if raw := os.Getenv("MAX_BLOCKED"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			fatal("parsing MAX_BLOCKED", err)
+		}
+		cfg.MaxBlocked = n
+	}
+	cfg.Strategy = RetrievalStrategy(os.Getenv("LEASE_STRATEGY"))
+	cfg.Eviction = EvictionPolicy(os.Getenv("EVICTION_POLICY"))
+	cfg.KeyFormat = KeyFormat(os.Getenv("KEY_FORMAT"))
+	if raw := os.Getenv("KEY_LENGTH"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			fatal("parsing KEY_LENGTH", err)
+		}
+		cfg.KeyLength = n
+	}
+	cfg.KeyPrefix = os.Getenv("KEY_PREFIX")
+	if pattern := os.Getenv("KEY_ID_PATTERN"); pattern != "" {
+		validator, err := KeyIDPattern(pattern)
+		if err != nil {
+			fatal("parsing KEY_ID_PATTERN", err)
+		}
+		cfg.KeyValidator = validator
+	}
+	if raw := os.Getenv("DELETE_GRACE_PERIOD"); raw != "" {
+		grace, err := time.ParseDuration(raw)
+		if err != nil {
+			fatal("parsing DELETE_GRACE_PERIOD", err)
+		}
+		cfg.DeleteGracePeriod = grace
+	}
+	if raw := os.Getenv("CLIENT_QUOTA"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			fatal("parsing CLIENT_QUOTA", err)
+		}
+		cfg.ClientQuota = n
+	}
+	if raw := os.Getenv("CLIENT_QUOTAS"); raw != "" {
+		quotas, err := parseClientQuotas(raw)
+		if err != nil {
+			fatal("parsing CLIENT_QUOTAS", err)
+		}
+		cfg.ClientQuotas = quotas
+	}
+	cfg.AutoGenerate = os.Getenv("AUTO_GENERATE") == "true"
+	cfg.FairLeasing = os.Getenv("FAIR_LEASING") == "true"
+	if raw := os.Getenv("AFFINITY_WINDOW"); raw != "" {
+		window, err := time.ParseDuration(raw)
+		if err != nil {
+			fatal("parsing AFFINITY_WINDOW", err)
+		}
+		cfg.AffinityWindow = window
+	}
+	if raw := os.Getenv("PREWARM_COUNT"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			fatal("parsing PREWARM_COUNT", err)
+		}
+		cfg.PrewarmCount = n
+	}
+	cfg.ExemptBlocked = os.Getenv("EXEMPT_BLOCKED") == "true"
+	if raw := os.Getenv("MAX_RENEWALS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			fatal("parsing MAX_RENEWALS", err)
+		}
+		cfg.MaxRenewals = n
+	}
+	if raw := os.Getenv("RESERVATION_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil {
+			fatal("parsing RESERVATION_TTL", err)
+		}
+		cfg.ReservationTTL = ttl
+	}
+	if raw := os.Getenv("RECLAIM_COOLDOWN"); raw != "" {
+		cooldown, err := time.ParseDuration(raw)
+		if err != nil {
+			fatal("parsing RECLAIM_COOLDOWN", err)
+		}
+		cfg.ReclaimCooldown = cooldown
+	}
+	if raw := os.Getenv("MAX_PENDING_WRITES"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			fatal("parsing MAX_PENDING_WRITES", err)
+		}
+		cfg.MaxPendingWrites = n
+	}
+	if path := os.Getenv("STORE_FILE"); path != "" {
+		cfg.Store = NewFileStore(path)
+	}
+	if raw := os.Getenv("FLUSH_INTERVAL"); raw != "" {
+		interval, err := time.ParseDuration(raw)
+		if err != nil {
+			fatal("parsing FLUSH_INTERVAL", err)
+		}
+		cfg.FlushInterval = interval
+	}
+	cfg.WriteThrough = os.Getenv("WRITE_THROUGH") == "true"
 
-	r.PUT("/keys/:id", func(c *gin.Context) {
-		key := c.Param("id")
-		err := km.UnblockKey(key)
+	routerCfg := RouterConfig{
+		AdminToken:     os.Getenv("ADMIN_TOKEN"),
+		ProtectReads:   os.Getenv("PROTECT_READS") == "true",
+		Logger:         logger,
+		LogRawPaths:    os.Getenv("LOG_RAW_PATHS") == "true",
+		RequireIfMatch: os.Getenv("REQUIRE_IF_MATCH") == "true",
+		UnblockCreates: os.Getenv("UNBLOCK_CREATES") == "true",
+		EnablePprof:    os.Getenv("ENABLE_PPROF") == "true",
+		CORS: CORSConfig{
+			AllowedOrigins: parseList(os.Getenv("CORS_ORIGINS")),
+			AllowedMethods: parseList(os.Getenv("CORS_METHODS")),
+			AllowedHeaders: parseList(os.Getenv("CORS_HEADERS")),
+		},
+	}
+	if raw := os.Getenv("MAX_BODY_BYTES"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"message": "Key is unblocked again"})
+			fatal("parsing MAX_BODY_BYTES", err)
 		}
-	})
+		routerCfg.MaxBodyBytes = n
+	}
+	if raw := os.Getenv("LEASE_RATE"); raw != "" {
+		rps, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			fatal("parsing LEASE_RATE", err)
+		}
+		routerCfg.LeaseRate = rps
+		routerCfg.LeaseBurst, _ = strconv.Atoi(os.Getenv("LEASE_BURST"))
+		routerCfg.LeaseRatePerIP = os.Getenv("LEASE_RATE_PER_IP") == "true"
+	}
 
-	r.PUT("/keepalive/:id", func(c *gin.Context) {
-		key := c.Param("id")
-		err := km.KeepAlive(key)
+	tlsCfg := TLSConfig{
+		CertFile: os.Getenv("TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("TLS_KEY_FILE"),
+	}
+	tlsCfg.MinVersion, err = parseTLSVersion(os.Getenv("TLS_MIN_VERSION"))
+	if err != nil {
+		fatal("parsing TLS_MIN_VERSION", err)
+	}
+
+	var store KeyStore
+	var km *KeyManager
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		if err := validateKeyFormat(cfg.KeyFormat, cfg.KeyPrefix); err != nil {
+			fatal("configuring redis store", err)
+		}
+		if err := validateKeyLength(cfg.KeyFormat, cfg.KeyLength); err != nil {
+			fatal("configuring redis store", err)
+		}
+		// The Redis store has no cap on the number of keys, so refuse
+		// to start rather than silently ignore one.
+		if cfg.MaxKeys > 0 {
+			fatal("configuring redis store", errors.New("MAX_KEYS is not supported with REDIS_ADDR"))
+		}
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		store = NewRedisKeyStore(client, cfg)
+	} else {
+		km, err = NewKeyManagerWithConfig(cfg)
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"message": "Key is alive again"})
+			fatal("loading keys", err)
 		}
-	})
+		go km.BackgroundTask(ctx)
+		// End event streams on shutdown, or they would hold it up until
+		// shutdownTimeout.
+		context.AfterFunc(ctx, km.events.close)
+		if km.Store != nil {
+			go km.PersistTask(ctx)
+		}
+		store = km
+	}
+
+	ln, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		fatal("listening", err)
+	}
+	logger.Info("listening", "addr", ln.Addr().String(), "tls", tlsCfg.Enabled())
 
-	r.Run(":8000")
+	handler := NewRouter(store, routerCfg)
+	if tlsCfg.Enabled() {
+		err = RunTLS(ctx, ln, handler, tlsCfg)
+	} else {
+		err = Run(ctx, ln, handler)
+	}
+	if err != nil {
+		slog.Error("serving", "err", err)
+	}
+	if km != nil {
+		if err := km.Flush(); err != nil {
+			slog.Error("flushing key store", "err", err)
+		}
+	}
 }
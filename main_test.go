@@ -0,0 +1,1135 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(discardLogger)
+	os.Exit(m.Run())
+}
+
+// discardLogger keeps test output free of the manager's and router's logs.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testEpoch is where every MockClock used by the tests starts.
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestManager builds a KeyManager from cfg that runs on a MockClock,
+// which it also returns.
+func newTestManager(t *testing.T, cfg Config) (*KeyManager, *MockClock) {
+	t.Helper()
+	clock := NewMockClock(testEpoch)
+	cfg.Clock = clock
+	if cfg.Logger == nil {
+		cfg.Logger = discardLogger
+	}
+	km, err := NewKeyManagerWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewKeyManagerWithConfig: %v", err)
+	}
+	return km, clock
+}
+
+// mustGenerate generates a key or fails the test.
+func mustGenerate(t *testing.T, km *KeyManager) string {
+	t.Helper()
+	key, err := km.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+	return key
+}
+
+// mustLease leases a key for ttl or fails the test.
+func mustLease(t *testing.T, km *KeyManager, ttl time.Duration) Lease {
+	t.Helper()
+	lease, err := km.LeaseKey(ttl)
+	if err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+	return lease
+}
+
+// waitFor polls cond until it holds, failing the test if it does not within
+// a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// runBackground runs km.BackgroundTask until the test ends, returning once
+// it has started.
+func runBackground(t *testing.T, km *KeyManager) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		km.BackgroundTask(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitFor(t, "the reaper to start", km.reaping.Load)
+}
+
+func TestSweepDeletesIdleKey(t *testing.T) {
+	km, clock := newTestManager(t, Config{IdleTTL: time.Minute})
+	if err := km.RegisterKey("idle-key"); err != nil {
+		t.Fatalf("RegisterKey: %v", err)
+	}
+
+	clock.Advance(time.Minute + time.Second)
+	km.sweep(clock.Now())
+
+	if _, err := km.GetKeyInfo("idle-key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo after idle sweep: got %v, want ErrKeyNotFound", err)
+	}
+	// The sweep must have released km.mu, or this would deadlock.
+	if _, err := km.GenerateNewKey(); err != nil {
+		t.Fatalf("GenerateNewKey after sweep: %v", err)
+	}
+}
+
+func TestSweepKeepsRecentlyUsedKey(t *testing.T) {
+	km, clock := newTestManager(t, Config{IdleTTL: time.Minute})
+	key := mustGenerate(t, km)
+
+	clock.Advance(45 * time.Second)
+	if err := km.KeepAlive(key); err != nil {
+		t.Fatalf("KeepAlive: %v", err)
+	}
+	clock.Advance(45 * time.Second)
+	km.sweep(clock.Now())
+
+	if _, err := km.GetKeyInfo(key); err != nil {
+		t.Fatalf("GetKeyInfo: %v, want the key kept", err)
+	}
+}
+
+func TestGenerateRandomKeyLengthAndCharset(t *testing.T) {
+	for _, n := range []int{16, 24, 32} {
+		key, err := GenerateRandomKey(n)
+		if err != nil {
+			t.Fatalf("GenerateRandomKey(%d): %v", n, err)
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(key)
+		if err != nil {
+			t.Fatalf("key %q is not unpadded URL-safe base64: %v", key, err)
+		}
+		if len(raw) != n {
+			t.Errorf("GenerateRandomKey(%d) decodes to %d bytes", n, len(raw))
+		}
+		if err := checkNameChars(key); err != nil {
+			t.Errorf("key %q is not safe in a URL path: %v", key, err)
+		}
+	}
+}
+
+func TestGenerateRandomKeyUnique(t *testing.T) {
+	const n = 10000
+	seen := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		key, err := GenerateRandomKey(DefaultKeyLength)
+		if err != nil {
+			t.Fatalf("GenerateRandomKey: %v", err)
+		}
+		if seen[key] {
+			t.Fatalf("key %q generated twice", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestGeneratedKeysAreManagedOnce(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	keys, err := km.GenerateKeys(1000)
+	if err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	if got := len(km.GetAllKeyIDs()); got != len(keys) {
+		t.Fatalf("manager holds %d keys, want %d", got, len(keys))
+	}
+}
+
+func TestShortTTLs(t *testing.T) {
+	km, clock := newTestManager(t, Config{
+		BlockTTL:    2 * time.Second,
+		MinBlockTTL: time.Second,
+		IdleTTL:     5 * time.Second,
+	})
+	leased := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	idle := mustGenerate(t, km)
+
+	clock.Advance(3 * time.Second)
+	km.sweep(clock.Now())
+	info, err := km.GetKeyInfo(leased)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if info.IsBlocked {
+		t.Fatal("key still blocked after BlockTTL")
+	}
+
+	clock.Advance(3 * time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(idle); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo of idle key: got %v, want ErrKeyNotFound", err)
+	}
+	// The leased key's idle time restarted when its lease ended.
+	if _, err := km.GetKeyInfo(leased); err != nil {
+		t.Fatalf("GetKeyInfo of formerly leased key: %v", err)
+	}
+}
+
+func TestConcurrentGenerateLeaseUnblock(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger})
+
+	const workers, rounds = 16, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if _, err := km.GenerateNewKey(); err != nil {
+					t.Errorf("GenerateNewKey: %v", err)
+					return
+				}
+				lease, err := km.LeaseKey(0)
+				if err != nil {
+					t.Errorf("LeaseKey: %v", err)
+					return
+				}
+				if i%2 == 0 {
+					if err := km.UnblockKey(lease.KeyID); err != nil {
+						t.Errorf("UnblockKey: %v", err)
+						return
+					}
+				}
+				km.sweep(time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := km.Stats()
+	if stats.Total != workers*rounds {
+		t.Fatalf("Total = %d, want %d", stats.Total, workers*rounds)
+	}
+	if stats.Blocked != workers*rounds/2 || stats.Available != workers*rounds/2 {
+		t.Fatalf("Blocked = %d, Available = %d, want %d each", stats.Blocked, stats.Available, workers*rounds/2)
+	}
+	if n := km.availableCount(); n != stats.Available {
+		t.Fatalf("available index holds %d keys, Stats counts %d", n, stats.Available)
+	}
+}
+
+func TestLeaseKeepsCreationTime(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	key := mustGenerate(t, km)
+	created := clock.Now()
+
+	clock.Advance(10 * time.Second)
+	got, err := km.RetreiveAvailableKey()
+	if err != nil {
+		t.Fatalf("RetreiveAvailableKey: %v", err)
+	}
+	if got != key {
+		t.Fatalf("leased %q, want %q", got, key)
+	}
+
+	info, err := km.GetKeyInfo(key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.CreationTime.Equal(created) {
+		t.Fatalf("CreationTime = %v, want %v", info.CreationTime, created)
+	}
+	if !info.BlockedAt.Equal(clock.Now()) {
+		t.Fatalf("BlockedAt = %v, want %v", info.BlockedAt, clock.Now())
+	}
+}
+
+func TestBackgroundTaskStopsOnCancel(t *testing.T) {
+	km, _ := newTestManager(t, Config{TickInterval: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		km.BackgroundTask(ctx)
+		close(done)
+	}()
+	waitFor(t, "the reaper to start", func() bool { return km.Ready(context.Background()) == nil })
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("BackgroundTask still running a second after cancel")
+	}
+	if err := km.Ready(context.Background()); err == nil {
+		t.Fatal("Ready succeeds after BackgroundTask returned")
+	}
+}
+
+func TestClampBlockTTL(t *testing.T) {
+	const def, lo, hi = 20 * time.Second, time.Second, time.Hour
+	for _, tc := range []struct {
+		ttl, want time.Duration
+	}{
+		{0, def},
+		{time.Millisecond, lo},
+		{lo, lo},
+		{time.Minute, time.Minute},
+		{hi, hi},
+		{2 * hi, hi},
+	} {
+		if got := clampBlockTTL(tc.ttl, def, lo, hi); got != tc.want {
+			t.Errorf("clampBlockTTL(%v) = %v, want %v", tc.ttl, got, tc.want)
+		}
+	}
+}
+
+func TestLeaseTTLIsClamped(t *testing.T) {
+	km, clock := newTestManager(t, Config{MinBlockTTL: time.Second, MaxBlockTTL: time.Minute})
+	short := mustGenerate(t, km)
+	mustLease(t, km, time.Millisecond)
+	long := mustGenerate(t, km)
+	mustLease(t, km, time.Hour)
+
+	for key, want := range map[string]time.Duration{short: time.Second, long: time.Minute} {
+		info, err := km.GetKeyInfo(key)
+		if err != nil {
+			t.Fatalf("GetKeyInfo: %v", err)
+		}
+		if got := info.Expiry.Sub(clock.Now()); got != want {
+			t.Errorf("lease runs for %v, want %v", got, want)
+		}
+	}
+}
+
+func TestKeepAliveHoldsLease(t *testing.T) {
+	km, clock := newTestManager(t, Config{BlockTTL: 10 * time.Second})
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(8 * time.Second)
+		if err := km.KeepAlive(key); err != nil {
+			t.Fatalf("KeepAlive: %v", err)
+		}
+		km.sweep(clock.Now())
+	}
+	info, err := km.GetKeyInfo(key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.IsBlocked {
+		t.Fatal("key reclaimed while heartbeats kept coming")
+	}
+
+	clock.Advance(11 * time.Second)
+	km.sweep(clock.Now())
+	if info, _ := km.GetKeyInfo(key); info.IsBlocked {
+		t.Fatal("key still blocked after heartbeats stopped")
+	}
+	if lease := mustLease(t, km, 0); lease.KeyID != key {
+		t.Fatalf("leased %q, want the reclaimed %q", lease.KeyID, key)
+	}
+}
+
+func TestUnblockKeepsMetadata(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	key, err := km.GenerateNewKeyWithTags(map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatalf("GenerateNewKeyWithTags: %v", err)
+	}
+
+	for round := 0; round < 2; round++ {
+		clock.Advance(time.Minute)
+		leasedAt := clock.Now()
+		mustLease(t, km, 0)
+		clock.Advance(time.Second)
+		if err := km.UnblockKey(key); err != nil {
+			t.Fatalf("UnblockKey: %v", err)
+		}
+
+		info, err := km.GetKeyInfo(key)
+		if err != nil {
+			t.Fatalf("GetKeyInfo: %v", err)
+		}
+		if info.IsBlocked || !info.Expiry.IsZero() || info.ExpiresIn != 0 {
+			t.Fatalf("round %d: lease not cleared: %+v", round, info)
+		}
+		if !info.CreationTime.Equal(testEpoch) {
+			t.Errorf("round %d: CreationTime = %v, want %v", round, info.CreationTime, testEpoch)
+		}
+		if !info.BlockedAt.Equal(leasedAt) {
+			t.Errorf("round %d: BlockedAt = %v, want %v", round, info.BlockedAt, leasedAt)
+		}
+		if !info.LastAccess.Equal(clock.Now()) {
+			t.Errorf("round %d: LastAccess = %v, want %v", round, info.LastAccess, clock.Now())
+		}
+		if info.Tags["env"] != "prod" {
+			t.Errorf("round %d: tags = %v", round, info.Tags)
+		}
+	}
+}
+
+func TestLeaseStrategy(t *testing.T) {
+	for _, tc := range []struct {
+		strategy RetrievalStrategy
+		order    []int
+	}{
+		{StrategyFIFO, []int{0, 1, 2}},
+		{StrategyLIFO, []int{2, 1, 0}},
+	} {
+		km, clock := newTestManager(t, Config{Strategy: tc.strategy})
+		var keys []string
+		for i := 0; i < 3; i++ {
+			keys = append(keys, mustGenerate(t, km))
+			clock.Advance(time.Second)
+		}
+		for _, i := range tc.order {
+			if got := mustLease(t, km, 0).KeyID; got != keys[i] {
+				t.Fatalf("%s: leased %q, want key %d %q", tc.strategy, got, i, keys[i])
+			}
+		}
+	}
+
+	// An unblocked key goes to the back of a FIFO pool.
+	km, _ := newTestManager(t, Config{Strategy: StrategyFIFO})
+	first, second := mustGenerate(t, km), mustGenerate(t, km)
+	mustLease(t, km, 0)
+	if err := km.UnblockKey(first); err != nil {
+		t.Fatalf("UnblockKey: %v", err)
+	}
+	if got := mustLease(t, km, 0).KeyID; got != second {
+		t.Fatalf("leased %q, want %q ahead of the returned key", got, second)
+	}
+}
+
+func TestRandomStrategyLeasesEveryKey(t *testing.T) {
+	km, _ := newTestManager(t, Config{Strategy: StrategyRandom})
+	keys, err := km.GenerateKeys(50)
+	if err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	leased := make(map[string]bool)
+	for range keys {
+		leased[mustLease(t, km, 0).KeyID] = true
+	}
+	if len(leased) != len(keys) {
+		t.Fatalf("leased %d distinct keys, want %d", len(leased), len(keys))
+	}
+}
+
+func TestCtxMethodsHonourCancellation(t *testing.T) {
+	km, _ := newTestManager(t, Config{Strategy: StrategyFIFO})
+	leased := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	key := mustGenerate(t, km)
+	before := km.Stats()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, stop := context.WithDeadline(context.Background(), testEpoch)
+	defer stop()
+
+	for name, op := range map[string]func(context.Context) error{
+		"GenerateNewKeyCtx": func(ctx context.Context) error {
+			_, err := km.GenerateNewKeyCtx(ctx, nil)
+			return err
+		},
+		"RegisterKeyCtx": func(ctx context.Context) error {
+			return km.RegisterKeyCtx(ctx, "new-key", nil)
+		},
+		"RetreiveAvailableKeyCtx": func(ctx context.Context) error {
+			_, err := km.RetreiveAvailableKeyCtx(ctx, 0)
+			return err
+		},
+		"LeaseKeyCtx": func(ctx context.Context) error {
+			_, err := km.LeaseKeyCtx(ctx, 0)
+			return err
+		},
+		"UnblockKeyCtx": func(ctx context.Context) error { return km.UnblockKeyCtx(ctx, leased) },
+		"ReleaseKeyCtx": func(ctx context.Context) error { return km.ReleaseKeyCtx(ctx, leased, "token") },
+		"DeleteKeyCtx":  func(ctx context.Context) error { return km.DeleteKeyCtx(ctx, key) },
+		"KeepAliveCtx":  func(ctx context.Context) error { return km.KeepAliveCtx(ctx, key) },
+		"GetKeyInfoCtx": func(ctx context.Context) error {
+			_, err := km.GetKeyInfoCtx(ctx, key)
+			return err
+		},
+	} {
+		if err := op(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s with a cancelled context: got %v, want context.Canceled", name, err)
+		}
+		if err := op(expired); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s past its deadline: got %v, want context.DeadlineExceeded", name, err)
+		}
+	}
+	if after := km.Stats(); after != before {
+		t.Fatalf("cancelled calls changed the pool: %+v, was %+v", after, before)
+	}
+}
+
+func TestClear(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "keys.json"))
+	km, _ := newTestManager(t, Config{Store: fs, DeleteGracePeriod: time.Hour, ReclaimCooldown: time.Hour})
+	mustGenerate(t, km)
+	mustGenerate(t, km)
+	mustLease(t, km, 0)
+	deleted := mustGenerate(t, km)
+	if err := km.DeleteKey(deleted); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+	if _, err := km.GenerateNewKeyCtx(ContextWithReservation(context.Background()), nil); err != nil {
+		t.Fatalf("GenerateNewKeyCtx: %v", err)
+	}
+
+	if removed := km.Clear(); removed != 4 {
+		t.Fatalf("Clear removed %d keys, want 4", removed)
+	}
+	if stats := km.Stats(); stats != (Stats{}) {
+		t.Fatalf("Stats after Clear = %+v", stats)
+	}
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey after Clear: got %v, want ErrNoKeysAvailable", err)
+	}
+	if err := km.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if keys, err := fs.Load(); err != nil || len(keys) != 0 {
+		t.Fatalf("store holds %d keys after Clear (%v)", len(keys), err)
+	}
+
+	// The pool is still usable.
+	mustGenerate(t, km)
+	mustLease(t, km, 0)
+}
+
+func TestManagersLeaseInDifferentOrders(t *testing.T) {
+	leaseOrder := func() []string {
+		km, _ := newTestManager(t, Config{Strategy: StrategyRandom})
+		for i := 0; i < 20; i++ {
+			if err := km.RegisterKey(fmt.Sprintf("key-%02d", i)); err != nil {
+				t.Fatalf("RegisterKey: %v", err)
+			}
+		}
+		var order []string
+		for i := 0; i < 20; i++ {
+			order = append(order, mustLease(t, km, 0).KeyID)
+		}
+		return order
+	}
+
+	// Identical pools, so only the managers' random sources can tell the
+	// sequences apart; 20! orders make a collision all but impossible.
+	if a, b := leaseOrder(), leaseOrder(); fmt.Sprint(a) == fmt.Sprint(b) {
+		t.Fatalf("two managers leased in the same order %v", a)
+	}
+}
+
+func TestIdleExpiryOfNeverAccessedKey(t *testing.T) {
+	km, clock := newTestManager(t, Config{IdleTTL: time.Minute})
+	key := mustGenerate(t, km)
+
+	// Idle time counts from creation, so a fresh key is not reaped at once.
+	clock.Advance(59 * time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(key); err != nil {
+		t.Fatalf("key reaped before IdleTTL from its creation: %v", err)
+	}
+
+	clock.Advance(2 * time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestIdleExpiryOfLeasedKey(t *testing.T) {
+	// Without ExemptBlocked a lease longer than IdleTTL does not protect the
+	// key from idle deletion.
+	km, clock := newTestManager(t, Config{IdleTTL: time.Minute, MaxBlockTTL: time.Hour})
+	key := mustGenerate(t, km)
+	mustLease(t, km, time.Hour)
+
+	clock.Advance(2 * time.Minute)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo: got %v, want the idle leased key deleted", err)
+	}
+	if stats := km.Stats(); stats.Blocked != 0 {
+		t.Fatalf("Blocked = %d after the leased key was deleted", stats.Blocked)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	km, clock := newTestManager(t, Config{DeleteGracePeriod: time.Hour})
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	if err := km.DeleteKey(key); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+	// Still readable, marked deleted, and out of reach of leases.
+	info, err := km.GetKeyInfo(key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo of soft-deleted key: %v", err)
+	}
+	if !info.DeletedAt.Equal(clock.Now()) || info.IsBlocked {
+		t.Fatalf("soft-deleted key: %+v", info)
+	}
+	if deleted, _ := km.ListKeysByState(StateDeleted); len(deleted) != 1 || deleted[0].Key != key {
+		t.Fatalf("ListKeysByState(deleted) = %v", deleted)
+	}
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey: got %v, want ErrNoKeysAvailable", err)
+	}
+	if err := km.KeepAlive(key); !errors.Is(err, ErrKeyDeleted) {
+		t.Fatalf("KeepAlive: got %v, want ErrKeyDeleted", err)
+	}
+	if err := km.DeleteKey(key); !errors.Is(err, ErrKeyDeleted) {
+		t.Fatalf("second DeleteKey: got %v, want ErrKeyDeleted", err)
+	}
+
+	clock.Advance(30 * time.Minute)
+	km.sweep(clock.Now())
+	if err := km.RestoreKey(key); err != nil {
+		t.Fatalf("RestoreKey within the grace period: %v", err)
+	}
+	if err := km.RestoreKey(key); !errors.Is(err, ErrKeyNotDeleted) {
+		t.Fatalf("RestoreKey of a live key: got %v, want ErrKeyNotDeleted", err)
+	}
+	if got := mustLease(t, km, 0).KeyID; got != key {
+		t.Fatalf("leased %q, want the restored %q", got, key)
+	}
+
+	if err := km.DeleteKey(key); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+	clock.Advance(time.Hour + time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo after the grace period: got %v, want ErrKeyNotFound", err)
+	}
+	if err := km.RestoreKey(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("RestoreKey after purge: got %v, want ErrKeyNotFound", err)
+	}
+	if stats := km.Stats(); stats.Total != 0 || stats.Deleted != 0 {
+		t.Fatalf("Stats after purge = %+v", stats)
+	}
+}
+
+func TestShortLeaseReclaimedOnTime(t *testing.T) {
+	// TickInterval is far longer than the lease, so only the reaper waking
+	// for the lease's own expiry can reclaim it in time.
+	km := newKeyManager(Config{
+		Logger:       discardLogger,
+		MinBlockTTL:  time.Millisecond,
+		TickInterval: time.Minute,
+	})
+	runBackground(t, km)
+	key := mustGenerate(t, km)
+	start := time.Now()
+	mustLease(t, km, 200*time.Millisecond)
+
+	waitFor(t, "the lease to be reclaimed", func() bool {
+		info, err := km.GetKeyInfo(key)
+		return err == nil && !info.IsBlocked
+	})
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Fatalf("200ms lease reclaimed after %v", elapsed)
+	}
+}
+
+func TestGetAllKeyIDsReturnsCopy(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	if _, err := km.GenerateKeys(3); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	ids := km.GetAllKeyIDs()
+	want := append([]string(nil), ids...)
+
+	ids[0] = "scribbled"
+	slices.Reverse(ids)
+	if got := km.GetAllKeyIDs(); !slices.Equal(got, want) {
+		t.Fatalf("GetAllKeyIDs after modifying an earlier result = %v, want %v", got, want)
+	}
+	for _, key := range want {
+		if _, err := km.GetKeyInfo(key); err != nil {
+			t.Fatalf("GetKeyInfo(%q): %v", key, err)
+		}
+	}
+}
+
+func TestDeletedBlockedKeyIsNeverLeased(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	deleted := make(map[string]bool)
+
+	const rounds = 200
+	for i := 0; i < rounds; i++ {
+		mustGenerate(t, km)
+		key := mustLease(t, km, 0).KeyID
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			// Losing the race to DeleteKey is fine.
+			km.UnblockKey(key)
+		}()
+		go func() {
+			defer wg.Done()
+			if err := km.DeleteKey(key); err != nil {
+				t.Errorf("DeleteKey: %v", err)
+			}
+		}()
+		wg.Wait()
+		deleted[key] = true
+	}
+
+	if stats := km.Stats(); stats.Total != 0 || stats.Available != 0 || stats.Blocked != 0 {
+		t.Fatalf("after deleting every key: %+v", stats)
+	}
+	if n := km.availableCount(); n != 0 {
+		t.Fatalf("available index still holds %d deleted keys", n)
+	}
+	fresh := mustGenerate(t, km)
+	if lease := mustLease(t, km, 0); deleted[lease.KeyID] || lease.KeyID != fresh {
+		t.Fatalf("leased %q, want the fresh key %q", lease.KeyID, fresh)
+	}
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey on a pool of deleted keys: got %v, want ErrNoKeysAvailable", err)
+	}
+}
+
+func TestReclaimCooldown(t *testing.T) {
+	km, clock := newTestManager(t, Config{BlockTTL: time.Minute, ReclaimCooldown: 30 * time.Second})
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	clock.Advance(time.Minute + time.Second)
+	km.sweep(clock.Now())
+	if stats := km.Stats(); stats.CoolingDown != 1 || stats.Available != 0 || stats.Blocked != 0 {
+		t.Fatalf("after the lease ran out: %+v, want the key cooling down", stats)
+	}
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey during the cooldown: got %v, want ErrNoKeysAvailable", err)
+	}
+
+	clock.Advance(29 * time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey just before the cooldown ends: got %v, want ErrNoKeysAvailable", err)
+	}
+
+	clock.Advance(2 * time.Second)
+	km.sweep(clock.Now())
+	lease := mustLease(t, km, 0)
+	if lease.KeyID != key {
+		t.Fatalf("leased %q after the cooldown, want %q", lease.KeyID, key)
+	}
+
+	// Giving a key back early skips the cooldown.
+	if err := km.ReleaseKey(key, lease.LeaseToken); err != nil {
+		t.Fatalf("ReleaseKey: %v", err)
+	}
+	mustLease(t, km, 0)
+}
+
+func TestAutoGenerate(t *testing.T) {
+	km, _ := newTestManager(t, Config{AutoGenerate: true, MaxKeys: 2})
+	existing := mustGenerate(t, km)
+	if lease := mustLease(t, km, 0); lease.KeyID != existing {
+		t.Fatalf("leased %q, want the existing key %q first", lease.KeyID, existing)
+	}
+
+	generated := mustLease(t, km, 0)
+	if generated.KeyID == existing {
+		t.Fatal("auto-generated lease returned the key that is already leased")
+	}
+	info, err := km.GetKeyInfo(generated.KeyID)
+	if err != nil {
+		t.Fatalf("GetKeyInfo of generated key: %v", err)
+	}
+	if !info.IsBlocked {
+		t.Fatal("auto-generated key is not leased")
+	}
+
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey at MaxKeys: got %v, want ErrNoKeysAvailable", err)
+	}
+	if stats := km.Stats(); stats.Total != 2 || stats.Blocked != 2 {
+		t.Fatalf("after filling the pool: %+v", stats)
+	}
+}
+
+func TestNoAutoGenerateByDefault(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey from an empty pool: got %v, want ErrNoKeysAvailable", err)
+	}
+	if got := km.Stats().Total; got != 0 {
+		t.Fatalf("Total = %d, want no key generated", got)
+	}
+}
+
+func TestMaxBlocked(t *testing.T) {
+	km, _ := newTestManager(t, Config{MaxBlocked: 2})
+	if _, err := km.GenerateKeys(4); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	first := mustLease(t, km, 0)
+	mustLease(t, km, 0)
+
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrTooManyLeases) {
+		t.Fatalf("LeaseKey at MaxBlocked: got %v, want ErrTooManyLeases", err)
+	}
+	if _, err := km.LeaseKeys(1); !errors.Is(err, ErrTooManyLeases) {
+		t.Fatalf("LeaseKeys at MaxBlocked: got %v, want ErrTooManyLeases", err)
+	}
+	if stats := km.Stats(); stats.Blocked != 2 || stats.Available != 2 {
+		t.Fatalf("after rejected leases: %+v", stats)
+	}
+
+	if err := km.ReleaseKey(first.KeyID, first.LeaseToken); err != nil {
+		t.Fatalf("ReleaseKey: %v", err)
+	}
+	mustLease(t, km, 0)
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrTooManyLeases) {
+		t.Fatalf("LeaseKey back at MaxBlocked: got %v, want ErrTooManyLeases", err)
+	}
+}
+
+func TestSweepDeletesManyStaleKeysAtOnce(t *testing.T) {
+	km, clock := newTestManager(t, Config{IdleTTL: time.Minute})
+	const stale = 500
+	if _, err := km.GenerateKeys(stale); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	clock.Advance(30 * time.Second)
+	fresh := mustGenerate(t, km)
+
+	clock.Advance(31 * time.Second)
+	km.sweep(clock.Now())
+
+	if ids := km.GetAllKeyIDs(); len(ids) != 1 || ids[0] != fresh {
+		t.Fatalf("after one sweep %d keys remain, want only the fresh one", len(ids))
+	}
+	if stats := km.Stats(); stats.Total != 1 || stats.Available != 1 {
+		t.Fatalf("after one sweep: %+v", stats)
+	}
+	if n := km.availableCount(); n != 1 {
+		t.Fatalf("available index holds %d keys, want 1", n)
+	}
+}
+
+func TestMaxRenewals(t *testing.T) {
+	km, clock := newTestManager(t, Config{BlockTTL: 10 * time.Second, MaxRenewals: 2})
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	for i := range 2 {
+		clock.Advance(5 * time.Second)
+		if err := km.KeepAlive(key); err != nil {
+			t.Fatalf("renewal %d: %v", i+1, err)
+		}
+	}
+	clock.Advance(5 * time.Second)
+	if err := km.KeepAlive(key); !errors.Is(err, ErrRenewalLimit) {
+		t.Fatalf("renewal past the limit: got %v, want ErrRenewalLimit", err)
+	}
+	info, err := km.GetKeyInfo(key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if info.Renewals != 2 || !info.Expiry.Equal(clock.Now().Add(5*time.Second)) {
+		t.Fatalf("after a rejected renewal: renewals %d, expiry %v, want 2 and the last renewal's expiry",
+			info.Renewals, info.Expiry)
+	}
+
+	// The capped lease runs out and the key comes back with a fresh count.
+	clock.Advance(6 * time.Second)
+	km.sweep(clock.Now())
+	if stats := km.Stats(); stats.Available != 1 || stats.Blocked != 0 {
+		t.Fatalf("after the capped lease ran out: %+v, want the key available", stats)
+	}
+	mustLease(t, km, 0)
+	if err := km.KeepAlive(key); err != nil {
+		t.Fatalf("renewing a new lease: %v", err)
+	}
+}
+
+func TestLeaseKeys(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	generated, err := km.GenerateKeys(5)
+	if err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+
+	leased, err := km.LeaseKeys(2)
+	if err != nil {
+		t.Fatalf("LeaseKeys(2): %v", err)
+	}
+	if len(leased) != 2 || leased[0] == leased[1] {
+		t.Fatalf("LeaseKeys(2) = %v, want two distinct keys", leased)
+	}
+
+	if _, err := km.LeaseKeys(4); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKeys(4) with 3 available: got %v, want ErrNoKeysAvailable", err)
+	}
+	if stats := km.Stats(); stats.Blocked != 2 || stats.Available != 3 {
+		t.Fatalf("after a failed LeaseKeys: %+v, want the pool untouched", stats)
+	}
+	for _, n := range []int{0, -1} {
+		if _, err := km.LeaseKeys(n); !errors.Is(err, ErrInvalidBatchSize) {
+			t.Fatalf("LeaseKeys(%d): got %v, want ErrInvalidBatchSize", n, err)
+		}
+	}
+
+	rest, err := km.LeaseKeys(3)
+	if err != nil {
+		t.Fatalf("LeaseKeys(3) with 3 available: %v", err)
+	}
+	all := append(leased, rest...)
+	slices.Sort(all)
+	slices.Sort(generated)
+	if !slices.Equal(all, generated) {
+		t.Fatalf("leased %v, want every generated key once: %v", all, generated)
+	}
+	if stats := km.Stats(); stats.Blocked != 5 || stats.Available != 0 {
+		t.Fatalf("after leasing every key: %+v", stats)
+	}
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger})
+	keys, err := km.GenerateKeys(50)
+	if err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				lease, err := km.LeaseKey(0)
+				if errors.Is(err, ErrNoKeysAvailable) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("LeaseKey: %v", err)
+					return
+				}
+				if err := km.ReleaseKey(lease.KeyID, lease.LeaseToken); err != nil {
+					t.Errorf("ReleaseKey: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < 500; i++ {
+				key := keys[i%len(keys)]
+				info, err := km.GetKeyInfo(key)
+				if err != nil || info.Key != key {
+					t.Errorf("GetKeyInfo(%q) = %q, %v", key, info.Key, err)
+					return
+				}
+				if info.IsBlocked != !info.Expiry.IsZero() {
+					t.Errorf("torn read of %q: blocked %v, expiry %v", key, info.IsBlocked, info.Expiry)
+					return
+				}
+				if stats := km.Stats(); stats.Available+stats.Blocked != stats.Total {
+					t.Errorf("inconsistent stats: %+v", stats)
+					return
+				}
+				if page, total, err := km.ListKeys(0, 10); err != nil || len(page) != 10 || total != len(keys) {
+					t.Errorf("ListKeys = %d keys of %d, %v", len(page), total, err)
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(stop)
+	wg.Wait()
+
+	if stats := km.Stats(); stats.Total != len(keys) || stats.Blocked != 0 {
+		t.Fatalf("after every lease was released: %+v", stats)
+	}
+}
+
+// BenchmarkGetKeyInfoParallel measures GetKeyInfo from many goroutines at
+// once, which share the read lock, on its own and alongside a goroutine that
+// keeps leasing and releasing keys.
+func BenchmarkGetKeyInfoParallel(b *testing.B) {
+	for _, writing := range []bool{false, true} {
+		b.Run(fmt.Sprintf("writer=%v", writing), func(b *testing.B) {
+			km, _ := newBenchManager(b, 1000)
+			keys := km.GetAllKeyIDs()
+			if writing {
+				stop := make(chan struct{})
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						if lease, err := km.LeaseKey(0); err == nil {
+							km.ReleaseKey(lease.KeyID, lease.LeaseToken)
+						}
+					}
+				}()
+				b.Cleanup(func() {
+					close(stop)
+					<-done
+				})
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := km.GetKeyInfo(keys[i%len(keys)]); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	km, _ := newTestManager(t, Config{PrewarmCount: 10})
+	if stats := km.Stats(); stats.Total != 10 || stats.Available != 10 || stats.Blocked != 0 {
+		t.Fatalf("PrewarmCount=10: %+v, want 10 available and 0 blocked", stats)
+	}
+
+	capped, _ := newTestManager(t, Config{PrewarmCount: 10, MaxKeys: 6})
+	if stats := capped.Stats(); stats.Available != 6 {
+		t.Fatalf("PrewarmCount=10 with MaxKeys=6: %+v, want 6 available", stats)
+	}
+
+	// Keys reloaded from the store count towards the target, leased ones do
+	// not.
+	fs := NewFileStore(filepath.Join(t.TempDir(), "keys.json"))
+	saved, _ := newTestManager(t, Config{Store: fs, PrewarmCount: 4})
+	mustLease(t, saved, time.Hour)
+	if err := saved.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	reloaded, _ := newTestManager(t, Config{Store: fs, PrewarmCount: 10})
+	if stats := reloaded.Stats(); stats.Total != 11 || stats.Available != 10 || stats.Blocked != 1 {
+		t.Fatalf("PrewarmCount=10 over a stored pool: %+v, want 10 available and 1 blocked", stats)
+	}
+}
+
+func TestReturnedKeyIsNotReapedAtOnce(t *testing.T) {
+	km, clock := newTestManager(t, Config{IdleTTL: time.Minute, BlockTTL: 50 * time.Second})
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	clock.Advance(51 * time.Second)
+	km.sweep(clock.Now())
+	if info, err := km.GetKeyInfo(key); err != nil || info.IsBlocked {
+		t.Fatalf("after the lease ran out: blocked %v, err %v", info.IsBlocked, err)
+	}
+
+	// The key has now existed for longer than IdleTTL, but the end of its
+	// lease counted as an access.
+	clock.Advance(30 * time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(key); err != nil {
+		t.Fatalf("key reaped within IdleTTL of its lease ending: %v", err)
+	}
+
+	clock.Advance(31 * time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.GetKeyInfo(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo IdleTTL after the lease ended: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestNextAvailable(t *testing.T) {
+	km, clock := newTestManager(t, Config{IdleTTL: time.Hour, MaxBlockTTL: time.Hour})
+	r := newTestRouter(km, RouterConfig{})
+	if _, ok := km.NextAvailable(DefaultPool); ok {
+		t.Fatal("NextAvailable of an empty pool reported a time")
+	}
+	w := doRequest(t, r, http.MethodGet, "/keys/next-available", nil)
+	if got := decodeBody[nextAvailableResponse](t, w).Wait; got != "unknown" {
+		t.Fatalf("wait for an empty pool = %q, want unknown", got)
+	}
+
+	if _, err := km.GenerateKeys(3); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	if at, ok := km.NextAvailable(DefaultPool); !ok || !at.Equal(clock.Now()) {
+		t.Fatalf("NextAvailable with keys available = %v, %v, want now", at, ok)
+	}
+	for _, ttl := range []time.Duration{3 * time.Minute, time.Minute, 2 * time.Minute} {
+		mustLease(t, km, ttl)
+	}
+
+	if at, ok := km.NextAvailable(DefaultPool); !ok || !at.Equal(testEpoch.Add(time.Minute)) {
+		t.Fatalf("NextAvailable = %v, %v, want the earliest expiry %v", at, ok, testEpoch.Add(time.Minute))
+	}
+	clock.Advance(15 * time.Second)
+	w = doRequest(t, r, http.MethodGet, "/keys/next-available", nil)
+	expectStatus(t, w, http.StatusOK)
+	if resp := decodeBody[nextAvailableResponse](t, w); resp.Wait != "45s" || !resp.At.Equal(testEpoch.Add(time.Minute)) {
+		t.Fatalf("GET /keys/next-available = %+v, want 45s until %v", resp, testEpoch.Add(time.Minute))
+	}
+
+	clock.Advance(time.Minute)
+	km.sweep(clock.Now())
+	if at, ok := km.NextAvailable(DefaultPool); !ok || !at.Equal(clock.Now()) {
+		t.Fatalf("NextAvailable once the earliest lease ended = %v, %v, want now", at, ok)
+	}
+	if _, ok := km.NextAvailable("other"); ok {
+		t.Fatal("NextAvailable of a pool without keys reported a time")
+	}
+}
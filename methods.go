@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// methodNotAllowed answers a request for a path that is routed, just not for
+// its method, with 405 and an Allow header listing the methods that are.
+// gin only calls it once r.HandleMethodNotAllowed is set.
+func methodNotAllowed(r *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Allow", strings.Join(allowedMethods(r.Routes(), c.Request.URL.Path), ", "))
+		writeError(c, http.StatusMethodNotAllowed, CodeMethodNotAllowed,
+			fmt.Sprintf("method %s is not allowed on this path", c.Request.Method))
+	}
+}
+
+// allowedMethods returns, sorted, the methods of every route matching path.
+func allowedMethods(routes gin.RoutesInfo, path string) []string {
+	var methods []string
+	for _, route := range routes {
+		if matchRoute(route.Path, path) && !slices.Contains(methods, route.Method) {
+			methods = append(methods, route.Method)
+		}
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+// matchRoute reports whether path matches the gin route pattern, in which
+// ":name" stands for any one non-empty segment and "*name" for the rest of
+// the path.
+func matchRoute(pattern, path string) bool {
+	patternSegs := strings.Split(pattern, "/")
+	pathSegs := strings.Split(path, "/")
+	for i, seg := range patternSegs {
+		if strings.HasPrefix(seg, "*") {
+			return true
+		}
+		if i >= len(pathSegs) {
+			return false
+		}
+		if strings.HasPrefix(seg, ":") {
+			if pathSegs[i] == "" {
+				return false
+			}
+			continue
+		}
+		if seg != pathSegs[i] {
+			return false
+		}
+	}
+	return len(patternSegs) == len(pathSegs)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMethodNotAllowed(t *testing.T) {
+	const token = "s3cret"
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{AdminToken: token})
+
+	for _, tc := range []struct {
+		method, target string
+		allow          string
+	}{
+		{http.MethodPatch, "/keys", "DELETE, GET, POST"},
+		{http.MethodPost, "/keys/some-key", "DELETE, GET, PUT"},
+	} {
+		w := doAdminRequest(t, r, token, tc.method, tc.target)
+		expectError(t, w, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+		if got := w.Header().Get("Allow"); got != tc.allow {
+			t.Errorf("%s %s: Allow = %q, want %q", tc.method, tc.target, got, tc.allow)
+		}
+	}
+}
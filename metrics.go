@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// keyMetrics counts key lifecycle events for a single KeyManager.
+type keyMetrics struct {
+	generated prometheus.Counter
+	leased    prometheus.Counter
+	unblocked prometheus.Counter
+	expired   prometheus.Counter
+	deleted   prometheus.Counter
+	evicted   prometheus.Counter
+
+	// leaseDuration observes how long each lease was held, from BlockedAt
+	// until the key was unblocked, released or reclaimed.
+	leaseDuration prometheus.Histogram
+}
+
+func newKeyMetrics() *keyMetrics {
+	return &keyMetrics{
+		generated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keys_generated_total",
+			Help: "Number of keys generated.",
+		}),
+		leased: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keys_leased_total",
+			Help: "Number of keys handed out by a lease.",
+		}),
+		unblocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keys_unblocked_total",
+			Help: "Number of leased keys explicitly returned to the pool.",
+		}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keys_expired_total",
+			Help: "Number of leases reclaimed after BlockTTL elapsed.",
+		}),
+		deleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keys_deleted_total",
+			Help: "Number of keys removed, either explicitly or by the idle sweep.",
+		}),
+		evicted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "keys_evicted_total",
+			Help: "Number of available keys deleted to make room under MaxKeys.",
+		}),
+		leaseDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "keys_lease_duration_seconds",
+			Help: "How long keys were held before their lease ended.",
+			// 0.5s up to roughly an hour, which covers MaxBlockTTL.
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 14),
+		}),
+	}
+}
+
+func (m *keyMetrics) counters() []prometheus.Counter {
+	return []prometheus.Counter{m.generated, m.leased, m.unblocked, m.expired, m.deleted, m.evicted}
+}
+
+var (
+	keysTotalDesc = prometheus.NewDesc("keys_total",
+		"Number of keys currently managed.", nil, nil)
+	keysAvailableDesc = prometheus.NewDesc("keys_available",
+		"Number of keys currently available for lease.", nil, nil)
+	keysBlockedDesc = prometheus.NewDesc("keys_blocked",
+		"Number of keys currently leased.", nil, nil)
+	keysDeletedDesc = prometheus.NewDesc("keys_soft_deleted",
+		"Number of soft-deleted keys waiting to be purged.", nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (km *KeyManager) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range km.metrics.counters() {
+		c.Describe(ch)
+	}
+	km.metrics.leaseDuration.Describe(ch)
+	ch <- keysTotalDesc
+	ch <- keysAvailableDesc
+	ch <- keysBlockedDesc
+	ch <- keysDeletedDesc
+}
+
+// Collect implements prometheus.Collector. The gauges are read from the live
+// maps under lock so they can never drift from the actual state.
+func (km *KeyManager) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range km.metrics.counters() {
+		c.Collect(ch)
+	}
+	km.metrics.leaseDuration.Collect(ch)
+
+	km.mu.RLock()
+	total, available, blocked, deleted := len(km.keys), km.availableCount(), len(km.blocked), len(km.deleted)
+	km.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(keysTotalDesc, prometheus.GaugeValue, float64(total))
+	ch <- prometheus.MustNewConstMetric(keysAvailableDesc, prometheus.GaugeValue, float64(available))
+	ch <- prometheus.MustNewConstMetric(keysBlockedDesc, prometheus.GaugeValue, float64(blocked))
+	ch <- prometheus.MustNewConstMetric(keysDeletedDesc, prometheus.GaugeValue, float64(deleted))
+}
+
+// unmatchedRoute labels requests that matched no route, whose raw paths could
+// otherwise grow the label set without bound.
+const unmatchedRoute = "unmatched"
+
+// httpMetrics records the count, latency and errors of HTTP requests by
+// route template, such as /keys/:id, rather than by raw path.
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+func newHTTPMetrics(reg prometheus.Registerer) *httpMetrics {
+	m := &httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests handled.",
+		}, []string{"route", "method", "status"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_request_errors_total",
+			Help: "Number of HTTP requests answered with a 4xx or 5xx status.",
+		}, []string{"route", "method", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "How long HTTP requests took to handle.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+	}
+	reg.MustRegister(m.requests, m.errors, m.latency)
+	return m
+}
+
+// middleware observes every request once the rest of the chain has run.
+func (m *httpMetrics) middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	m.requests.WithLabelValues(route, c.Request.Method, status).Inc()
+	if c.Writer.Status() >= 400 {
+		m.errors.WithLabelValues(route, c.Request.Method, status).Inc()
+	}
+	m.latency.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+}
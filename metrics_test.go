@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherValues gathers reg and returns the value of every counter and gauge
+// without labels, by metric name.
+func gatherValues(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) > 0 {
+				continue
+			}
+			switch {
+			case metric.Counter != nil:
+				values[family.GetName()] = metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestKeyMetrics(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(km)
+
+	for i := 0; i < 3; i++ {
+		mustGenerate(t, km)
+	}
+	first := mustLease(t, km, 0)
+	mustLease(t, km, 0)
+	if err := km.UnblockKey(first.KeyID); err != nil {
+		t.Fatalf("UnblockKey: %v", err)
+	}
+	if err := km.DeleteKey(first.KeyID); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+
+	got := gatherValues(t, reg)
+	for name, want := range map[string]float64{
+		"keys_generated_total": 3,
+		"keys_leased_total":    2,
+		"keys_unblocked_total": 1,
+		"keys_deleted_total":   1,
+		"keys_expired_total":   0,
+		"keys_total":           2,
+		"keys_available":       1,
+		"keys_blocked":         1,
+	} {
+		if got[name] != want {
+			t.Errorf("%s = %v, want %v", name, got[name], want)
+		}
+	}
+}
+
+func TestLeaseDurationHistogram(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(km)
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	clock.Advance(3 * time.Second)
+	if err := km.UnblockKey(key); err != nil {
+		t.Fatalf("UnblockKey: %v", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var histogram *dto.Histogram
+	for _, family := range families {
+		if family.GetName() == "keys_lease_duration_seconds" {
+			histogram = family.GetMetric()[0].GetHistogram()
+		}
+	}
+	if histogram == nil {
+		t.Fatal("keys_lease_duration_seconds not gathered")
+	}
+	if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != 3 {
+		t.Fatalf("count %d, sum %v; want one 3s observation", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	// Buckets are cumulative: 3s is above the 2s bound and within 4s.
+	for _, bucket := range histogram.GetBucket() {
+		want := uint64(0)
+		if bucket.GetUpperBound() >= 3 {
+			want = 1
+		}
+		if bucket.GetCumulativeCount() != want {
+			t.Errorf("bucket le=%v counts %d, want %d", bucket.GetUpperBound(), bucket.GetCumulativeCount(), want)
+		}
+	}
+}
+
+func TestHTTPMetricsUseRouteTemplate(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+	key := mustGenerate(t, km)
+	doRequest(t, r, http.MethodGet, "/keys/"+key, nil)
+	doRequest(t, r, http.MethodGet, "/keys/unknown-key", nil)
+	doRequest(t, r, http.MethodGet, "/no-such-route/"+key, nil)
+
+	w := doRequest(t, r, http.MethodGet, "/metrics", nil)
+	expectStatus(t, w, http.StatusOK)
+	body := w.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/keys/:id",status="200"} 1`,
+		`http_requests_total{method="GET",route="/keys/:id",status="404"} 1`,
+		`http_request_errors_total{method="GET",route="/keys/:id",status="404"} 1`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/keys/:id"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+	for _, raw := range []string{key, "unknown-key", "no-such-route"} {
+		if strings.Contains(body, raw) {
+			t.Errorf("metrics contain the raw path segment %q", raw)
+		}
+	}
+}
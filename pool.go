@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// DefaultPool is the name of the pool keys belong to unless one is chosen.
+const DefaultPool = ""
+
+// MaxPoolNameLength is the longest pool name accepted.
+const MaxPoolNameLength = 64
+
+var (
+	ErrInvalidPool     = errors.New("invalid pool name")
+	ErrPoolUnsupported = errors.New("this store only has the default pool")
+)
+
+type poolKey struct{}
+
+// ContextWithPool returns a copy of ctx that makes keys generated with it
+// join pool, and leases taken with it draw only from pool.
+func ContextWithPool(ctx context.Context, pool string) context.Context {
+	return context.WithValue(ctx, poolKey{}, pool)
+}
+
+// poolFromContext returns the pool set by ContextWithPool, or DefaultPool.
+func poolFromContext(ctx context.Context) string {
+	pool, _ := ctx.Value(poolKey{}).(string)
+	return pool
+}
+
+// checkPoolName checks a pool name supplied by a caller. Names follow the
+// same character rules as key ids.
+func checkPoolName(pool string) error {
+	if len(pool) > MaxPoolNameLength {
+		return fmt.Errorf("%w: must be at most %d characters", ErrInvalidPool, MaxPoolNameLength)
+	}
+	if err := checkNameChars(pool); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPool, err)
+	}
+	return nil
+}
+
+// pushAvailable appends key to the available list of its pool and wakes any
+// waiting leases. The caller must hold km.mu.
+func (km *KeyManager) pushAvailable(key string) {
+	pool := km.keys[key].Pool
+	km.available[pool] = append(km.available[pool], key)
+	km.keyAvailable.Broadcast()
+}
+
+// availableCount returns the number of available keys across every pool. The
+// caller must hold km.mu.
+func (km *KeyManager) availableCount() int {
+	n := 0
+	for _, keys := range km.available {
+		n += len(keys)
+	}
+	return n
+}
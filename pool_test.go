@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLeasesNeverCrossPools(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	red := ContextWithPool(context.Background(), "red")
+	blue := ContextWithPool(context.Background(), "blue")
+	generate := func(ctx context.Context) string {
+		t.Helper()
+		key, err := km.GenerateNewKeyCtx(ctx, nil)
+		if err != nil {
+			t.Fatalf("GenerateNewKeyCtx: %v", err)
+		}
+		return key
+	}
+	redKeys := map[string]bool{generate(red): true, generate(red): true}
+	blueKey := generate(blue)
+
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey from the empty default pool: got %v, want ErrNoKeysAvailable", err)
+	}
+	lease, err := km.LeaseKeyCtx(blue, 0)
+	if err != nil {
+		t.Fatalf("LeaseKeyCtx(blue): %v", err)
+	}
+	if lease.KeyID != blueKey {
+		t.Fatalf("leased %q from blue, want %q", lease.KeyID, blueKey)
+	}
+	if _, err := km.LeaseKeyCtx(blue, 0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKeyCtx(blue) with only red keys left: got %v, want ErrNoKeysAvailable", err)
+	}
+
+	// An unblocked key goes back to its own pool.
+	if err := km.UnblockKey(blueKey); err != nil {
+		t.Fatalf("UnblockKey: %v", err)
+	}
+	for range redKeys {
+		lease, err := km.LeaseKeyCtx(red, 0)
+		if err != nil {
+			t.Fatalf("LeaseKeyCtx(red): %v", err)
+		}
+		if !redKeys[lease.KeyID] {
+			t.Fatalf("leased %q from red, want one of %v", lease.KeyID, redKeys)
+		}
+	}
+	if _, err := km.LeaseKeyCtx(red, 0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKeyCtx(red) with only a blue key left: got %v, want ErrNoKeysAvailable", err)
+	}
+	if lease, err := km.LeaseKeyCtx(blue, 0); err != nil || lease.KeyID != blueKey {
+		t.Fatalf("LeaseKeyCtx(blue) after unblock = %q, %v, want %q", lease.KeyID, err, blueKey)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerPprof serves the net/http/pprof profiles under /debug/pprof/. They
+// reveal a good deal about the process, so reads of them need the admin
+// token whenever one is set, whatever ProtectReads says.
+func registerPprof(r gin.IRoutes, adminToken string) {
+	// A single wildcard route, since gin cannot mix a catch-all with the
+	// fixed profile names under the same prefix.
+	handler := func(c *gin.Context) {
+		switch strings.TrimPrefix(c.Param("profile"), "/") {
+		case "cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "trace":
+			pprof.Trace(c.Writer, c.Request)
+		default:
+			// Index also serves the named profiles, such as heap and mutex.
+			pprof.Index(c.Writer, c.Request)
+		}
+	}
+	r.GET("/debug/pprof/*profile", adminAuth(adminToken, true), handler)
+	r.POST("/debug/pprof/*profile", adminAuth(adminToken, true), handler)
+}
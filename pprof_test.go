@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprofDisabledByDefault(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+	for _, target := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		w := doRequest(t, r, http.MethodGet, target, nil)
+		expectStatus(t, w, http.StatusNotFound)
+	}
+}
+
+func TestPprofEnabled(t *testing.T) {
+	const token = "s3cret"
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{EnablePprof: true, AdminToken: token})
+
+	// Profiles need the admin token even though reads are public.
+	w := doRequest(t, r, http.MethodGet, "/debug/pprof/", nil)
+	expectError(t, w, http.StatusUnauthorized, CodeUnauthorized)
+	expectStatus(t, doRequest(t, r, http.MethodGet, "/stats", nil), http.StatusOK)
+
+	for target, want := range map[string]string{
+		"/debug/pprof/":             "goroutine",
+		"/debug/pprof/cmdline":      "keys-generator",
+		"/debug/pprof/heap?debug=1": "heap profile",
+	} {
+		w := doAdminRequest(t, r, token, http.MethodGet, target)
+		expectStatus(t, w, http.StatusOK)
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("GET %s does not mention %q", target, want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrQuotaExceeded = errors.New("client lease quota exceeded")
+
+// ClientIDHeader names the header a caller identifies itself with for
+// per-client lease quotas.
+const ClientIDHeader = "X-Client-Id"
+
+type clientKey struct{}
+
+// ContextWithClient returns a copy of ctx that attributes leases taken with it
+// to client, so they count against that client's quota.
+func ContextWithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// clientFromContext returns the client set by ContextWithClient, or "" for
+// anonymous callers.
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// clientID attributes each request to the client named in ClientIDHeader.
+func clientID(c *gin.Context) {
+	if client := c.GetHeader(ClientIDHeader); client != "" {
+		c.Request = c.Request.WithContext(ContextWithClient(c.Request.Context(), client))
+	}
+	c.Next()
+}
+
+// quotaFor returns how many keys client may hold at once, zero meaning no
+// limit. Anonymous callers are never limited.
+func (km *KeyManager) quotaFor(client string) int {
+	if client == "" {
+		return 0
+	}
+	if quota, ok := km.ClientQuotas[client]; ok {
+		return quota
+	}
+	return km.ClientQuota
+}
+
+// checkQuota returns ErrQuotaExceeded if n more leases would take client past
+// its quota. The caller must hold km.mu.
+func (km *KeyManager) checkQuota(client string, n int) error {
+	if quota := km.quotaFor(client); quota > 0 && km.leasedBy[client]+n > quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// trackLease adjusts the number of leases held by client. The caller must
+// hold km.mu.
+func (km *KeyManager) trackLease(client string, delta int) {
+	if client == "" {
+		return
+	}
+	km.leasedBy[client] += delta
+	if km.leasedBy[client] <= 0 {
+		delete(km.leasedBy, client)
+		km.forgetClient(client)
+	}
+}
+
+// parseClientQuotas parses per-client quotas written as "client:n,client:n".
+func parseClientQuotas(raw string) (map[string]int, error) {
+	quotas := make(map[string]int)
+	for _, entry := range strings.Split(raw, ",") {
+		client, n, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || client == "" {
+			return nil, fmt.Errorf("invalid quota %q, want client:n", entry)
+		}
+		quota, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota for %q: %w", client, err)
+		}
+		quotas[client] = quota
+	}
+	return quotas, nil
+}
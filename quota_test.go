@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientQuota(t *testing.T) {
+	km, _ := newTestManager(t, Config{ClientQuota: 2, ClientQuotas: map[string]int{"big": 3}})
+	if _, err := km.GenerateKeys(10); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	r := newTestRouter(km, RouterConfig{})
+
+	lease := func(client string) *httptest.ResponseRecorder {
+		req := newRequest(t, http.MethodGet, "/keys", nil)
+		if client != "" {
+			req.Header.Set(ClientIDHeader, client)
+		}
+		return serveRequest(r, req)
+	}
+
+	var held []Lease
+	for i := 0; i < 2; i++ {
+		w := lease("small")
+		expectStatus(t, w, http.StatusOK)
+		held = append(held, decodeBody[Lease](t, w))
+	}
+	expectError(t, lease("small"), http.StatusTooManyRequests, CodeQuotaExceeded)
+
+	// Another client, and anonymous callers, are unaffected.
+	for i := 0; i < 3; i++ {
+		expectStatus(t, lease("big"), http.StatusOK)
+	}
+	expectError(t, lease("big"), http.StatusTooManyRequests, CodeQuotaExceeded)
+	expectStatus(t, lease(""), http.StatusOK)
+
+	// Giving a key back frees quota.
+	if err := km.ReleaseKey(held[0].KeyID, held[0].LeaseToken); err != nil {
+		t.Fatalf("ReleaseKey: %v", err)
+	}
+	expectStatus(t, lease("small"), http.StatusOK)
+	expectError(t, lease("small"), http.StatusTooManyRequests, CodeQuotaExceeded)
+
+	// Generated leases count against the quota too.
+	req := newRequest(t, http.MethodPost, "/keys/lease", nil)
+	req.Header.Set(ClientIDHeader, "small")
+	expectError(t, serveRequest(r, req), http.StatusTooManyRequests, CodeQuotaExceeded)
+	req = newRequest(t, http.MethodPost, "/keys/lease", nil)
+	req.Header.Set(ClientIDHeader, "other")
+	expectStatus(t, serveRequest(r, req), http.StatusCreated)
+	if got := km.leasedBy["other"]; got != 1 {
+		t.Fatalf("other holds %d leases, want 1", got)
+	}
+}
+
+func TestParseClientQuotas(t *testing.T) {
+	quotas, err := parseClientQuotas("a:1, b:20")
+	if err != nil {
+		t.Fatalf("parseClientQuotas: %v", err)
+	}
+	if len(quotas) != 2 || quotas["a"] != 1 || quotas["b"] != 20 {
+		t.Fatalf("parsed %v", quotas)
+	}
+	for _, raw := range []string{"a", "a:", ":1", "a:x"} {
+		if _, err := parseClientQuotas(raw); err == nil {
+			t.Errorf("parseClientQuotas(%q) succeeded", raw)
+		}
+	}
+}
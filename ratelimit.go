@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// maxTrackedClients bounds the per-IP limiter table; once exceeded, limiters
+// that have been idle for clientIdleTimeout are dropped.
+const (
+	maxTrackedClients = 10000
+	clientIdleTimeout = 10 * time.Minute
+)
+
+// leaseLimiter hands out token-bucket limiters, either one shared by every
+// caller or one per client IP.
+type leaseLimiter struct {
+	limit rate.Limit
+	burst int
+	perIP bool
+
+	mu      sync.Mutex
+	global  *rate.Limiter
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLeaseLimiter(rps float64, burst int, perIP bool) *leaseLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &leaseLimiter{
+		limit:   rate.Limit(rps),
+		burst:   burst,
+		perIP:   perIP,
+		global:  rate.NewLimiter(rate.Limit(rps), burst),
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+func (l *leaseLimiter) limiter(ip string) *rate.Limiter {
+	if !l.perIP {
+		return l.global
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if cl, ok := l.clients[ip]; ok {
+		cl.lastSeen = now
+		return cl.limiter
+	}
+	if len(l.clients) >= maxTrackedClients {
+		for key, cl := range l.clients {
+			if now.Sub(cl.lastSeen) > clientIdleTimeout {
+				delete(l.clients, key)
+			}
+		}
+	}
+	cl := &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst), lastSeen: now}
+	l.clients[ip] = cl
+	return cl.limiter
+}
+
+// rateLimit rejects requests that exceed l with 429 and a Retry-After header
+// telling the client when a token will be available.
+func rateLimit(l *leaseLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reservation := l.limiter(c.ClientIP()).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeError(c, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
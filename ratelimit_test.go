@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestLeaseRateLimit(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	if _, err := km.GenerateKeys(10); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	// Slow enough that no token is refilled while the test runs.
+	r := newTestRouter(km, RouterConfig{LeaseRate: 0.01, LeaseBurst: 3, LeaseRatePerIP: true})
+
+	lease := func(addr string) int {
+		req := newRequest(t, http.MethodGet, "/keys", nil)
+		req.RemoteAddr = addr
+		w := serveRequest(r, req)
+		if w.Code == http.StatusTooManyRequests {
+			expectError(t, w, http.StatusTooManyRequests, CodeRateLimited)
+			if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry <= 0 {
+				t.Errorf("Retry-After = %q", w.Header().Get("Retry-After"))
+			}
+		}
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := lease("192.0.2.1:1234"); got != http.StatusOK {
+			t.Fatalf("lease %d within the burst: status %d", i, got)
+		}
+	}
+	if got := lease("192.0.2.1:1234"); got != http.StatusTooManyRequests {
+		t.Fatalf("lease past the burst: status %d, want 429", got)
+	}
+	if got := lease("192.0.2.2:1234"); got != http.StatusOK {
+		t.Fatalf("lease from another client: status %d, want 200", got)
+	}
+	if got := km.Stats().Blocked; got != 4 {
+		t.Fatalf("%d keys leased, want 4", got)
+	}
+
+	// Generating a leased key draws on the same budget.
+	req := newRequest(t, http.MethodPost, "/keys/lease", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	expectError(t, serveRequest(r, req), http.StatusTooManyRequests, CodeRateLimited)
+}
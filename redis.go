@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisPrefix namespaces every Redis key written by RedisKeyStore.
+const DefaultRedisPrefix = "keys-generator:"
+
+// RedisKeyStore is a KeyStore backed by Redis, so every instance pointed at
+// the same server shares one pool.
+//
+// Each key's metadata lives in a hash whose Redis TTL is IdleTTL and is
+// refreshed on access, which is how idle keys expire. Available ids are kept
+// in a set and leased ids in a sorted set scored by lease expiry; expired
+// leases are moved back to the available set before every operation that
+// depends on block state, and ids whose metadata has expired are pruned from
+// the available set a batch at a time. The number of keys is not capped, so
+// Config.MaxKeys does not apply.
+type RedisKeyStore struct {
+	KeyLength   int
+	KeyFormat   KeyFormat
+	KeyPrefix   string
+	BlockTTL    time.Duration
+	MinBlockTTL time.Duration
+	MaxBlockTTL time.Duration
+	IdleTTL     time.Duration
+	MaxRenewals int
+	Prefix      string
+	// KeyValidator, when set, vets the ids passed to RegisterKey.
+	KeyValidator func(string) error
+
+	client redis.UniversalClient
+}
+
+func NewRedisKeyStore(client redis.UniversalClient, cfg Config) *RedisKeyStore {
+	if cfg.KeyLength <= 0 {
+		cfg.KeyLength = DefaultKeyLength
+	}
+	if cfg.BlockTTL <= 0 {
+		cfg.BlockTTL = DefaultBlockTTL
+	}
+	if cfg.MinBlockTTL <= 0 {
+		cfg.MinBlockTTL = DefaultMinBlockTTL
+	}
+	if cfg.MaxBlockTTL <= 0 {
+		cfg.MaxBlockTTL = DefaultMaxBlockTTL
+	}
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = DefaultIdleTTL
+	}
+
+	return &RedisKeyStore{
+		KeyLength:    cfg.KeyLength,
+		KeyFormat:    cfg.KeyFormat,
+		KeyPrefix:    cfg.KeyPrefix,
+		BlockTTL:     cfg.BlockTTL,
+		MinBlockTTL:  cfg.MinBlockTTL,
+		MaxBlockTTL:  cfg.MaxBlockTTL,
+		IdleTTL:      cfg.IdleTTL,
+		MaxRenewals:  cfg.MaxRenewals,
+		Prefix:       DefaultRedisPrefix,
+		KeyValidator: cfg.KeyValidator,
+		client:       client,
+	}
+}
+
+func (rs *RedisKeyStore) metaKey(key string) string { return rs.Prefix + "key:" + key }
+func (rs *RedisKeyStore) availableKey() string      { return rs.Prefix + "available" }
+func (rs *RedisKeyStore) blockedKey() string        { return rs.Prefix + "blocked" }
+func (rs *RedisKeyStore) pruneCursorKey() string    { return rs.Prefix + "prune-cursor" }
+
+// redisPruneBatch is how many available ids each reclaim checks for expired
+// metadata, bounding the work added to every operation.
+const redisPruneBatch = 100
+
+// reclaimScript moves leases that expired before the cutoff back into the
+// available set, setting lastAccess and restarting the idle TTL so a key is
+// not reaped the moment it returns. It then scans the next batch of the
+// available set, resuming from the cursor saved by the previous call, and
+// removes ids whose metadata Redis has expired. KEYS: available, blocked,
+// prune cursor. ARGV: cutoff ms, metadata key prefix, idle TTL ms, batch
+// size.
+var reclaimScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], id)
+	local meta = ARGV[2] .. id
+	if redis.call('EXISTS', meta) == 1 then
+		redis.call('HSET', meta, 'isBlocked', '0', 'lastAccess', ARGV[1])
+		redis.call('HDEL', meta, 'expiresAt', 'leaseTTL', 'leaseToken', 'renewals')
+		redis.call('PEXPIRE', meta, ARGV[3])
+		redis.call('SADD', KEYS[1], id)
+	end
+end
+local page = redis.call('SSCAN', KEYS[1], redis.call('GET', KEYS[3]) or '0', 'COUNT', ARGV[4])
+for _, id in ipairs(page[2]) do
+	if redis.call('EXISTS', ARGV[2] .. id) == 0 then
+		redis.call('SREM', KEYS[1], id)
+	end
+end
+if page[1] == '0' then
+	redis.call('DEL', KEYS[3])
+else
+	redis.call('SET', KEYS[3], page[1])
+end
+return #expired
+`)
+
+// leaseScript pops a random available id whose metadata still exists and
+// marks it blocked until the given expiry. KEYS: available, blocked. ARGV:
+// now ms, expiry ms, idle TTL ms, metadata key prefix, lease token.
+var leaseScript = redis.NewScript(`
+while true do
+	local id = redis.call('SPOP', KEYS[1])
+	if not id then
+		return false
+	end
+	local meta = ARGV[4] .. id
+	if redis.call('EXISTS', meta) == 1 then
+		local ttl = tonumber(ARGV[2]) - tonumber(ARGV[1])
+		redis.call('HSET', meta, 'lastAccess', ARGV[1], 'isBlocked', '1', 'blockedAt', ARGV[1], 'expiresAt', ARGV[2], 'leaseTTL', ttl, 'leaseToken', ARGV[5])
+		redis.call('PEXPIRE', meta, ARGV[3])
+		redis.call('ZADD', KEYS[2], ARGV[2], id)
+		return id
+	end
+end
+`)
+
+// unblockScript returns a leased id to the available set, counting it as an
+// access as reclaimScript does. It replies -1 when the key does not exist and
+// 0 when it is not leased. KEYS: available, blocked, metadata. ARGV: id, now
+// ms, idle TTL ms.
+var unblockScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 0 then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	return -1
+end
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[3], 'isBlocked', '0', 'lastAccess', ARGV[2])
+redis.call('HDEL', KEYS[3], 'expiresAt', 'leaseTTL', 'leaseToken', 'renewals')
+redis.call('PEXPIRE', KEYS[3], ARGV[3])
+redis.call('SADD', KEYS[1], ARGV[1])
+return 1
+`)
+
+// releaseScript is unblockScript for the lease holder only, additionally
+// replying -2 when the lease token does not match. KEYS: available, blocked,
+// metadata. ARGV: id, lease token, now ms, idle TTL ms.
+var releaseScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 0 then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	return -1
+end
+if not redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return 0
+end
+if redis.call('HGET', KEYS[3], 'leaseToken') ~= ARGV[2] then
+	return -2
+end
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HSET', KEYS[3], 'isBlocked', '0', 'lastAccess', ARGV[3])
+redis.call('HDEL', KEYS[3], 'expiresAt', 'leaseTTL', 'leaseToken', 'renewals')
+redis.call('PEXPIRE', KEYS[3], ARGV[4])
+redis.call('SADD', KEYS[1], ARGV[1])
+return 1
+`)
+
+// keepAliveScript refreshes a key's last access and idle TTL and, when it is
+// leased, pushes its lease expiry out by the lease's original duration and
+// counts the renewal. It replies -1 when the key does not exist and -2,
+// changing nothing, when the lease has already been renewed the maximum
+// number of times. KEYS: blocked, metadata. ARGV: now ms, idle TTL ms, id,
+// max renewals (0 for no limit).
+var keepAliveScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	return -1
+end
+local leased = redis.call('ZSCORE', KEYS[1], ARGV[3])
+local max = tonumber(ARGV[4])
+if leased and max > 0 and tonumber(redis.call('HGET', KEYS[2], 'renewals') or '0') >= max then
+	return -2
+end
+redis.call('HSET', KEYS[2], 'lastAccess', ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+if leased then
+	local ttl = tonumber(redis.call('HGET', KEYS[2], 'leaseTTL') or '0')
+	local expiry = tonumber(ARGV[1]) + ttl
+	redis.call('ZADD', KEYS[1], expiry, ARGV[3])
+	redis.call('HSET', KEYS[2], 'expiresAt', expiry)
+	redis.call('HINCRBY', KEYS[2], 'renewals', 1)
+	return 1
+end
+return 0
+`)
+
+// reclaim returns expired leases to the available pool and prunes a batch
+// of idle-expired ids from it.
+func (rs *RedisKeyStore) reclaim(ctx context.Context) error {
+	return reclaimScript.Run(ctx, rs.client,
+		[]string{rs.availableKey(), rs.blockedKey(), rs.pruneCursorKey()},
+		time.Now().UnixMilli(), rs.metaKey(""), rs.IdleTTL.Milliseconds(), redisPruneBatch).Err()
+}
+
+func (rs *RedisKeyStore) GenerateNewKey() (string, error) {
+	return rs.GenerateNewKeyWithTags(nil)
+}
+
+func (rs *RedisKeyStore) GenerateNewKeyWithTags(tags map[string]string) (string, error) {
+	return rs.GenerateNewKeyCtx(context.Background(), tags)
+}
+
+func (rs *RedisKeyStore) GenerateNewKeyCtx(ctx context.Context, tags map[string]string) (string, error) {
+	if poolFromContext(ctx) != DefaultPool {
+		return "", ErrPoolUnsupported
+	}
+	if reservationFromContext(ctx) {
+		return "", ErrReservationUnsupported
+	}
+	for {
+		key, err := GenerateFormattedKey(rs.KeyFormat, rs.KeyPrefix, rs.KeyLength)
+		if err != nil {
+			return "", err
+		}
+
+		err = rs.createKey(ctx, key, tags)
+		if errors.Is(err, ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return key, nil
+	}
+}
+
+func (rs *RedisKeyStore) RegisterKey(key string) error {
+	return rs.RegisterKeyCtx(context.Background(), key, nil)
+}
+
+func (rs *RedisKeyStore) RegisterKeyCtx(ctx context.Context, key string, tags map[string]string) error {
+	if err := checkKeyID(key, rs.KeyValidator); err != nil {
+		return err
+	}
+	if poolFromContext(ctx) != DefaultPool {
+		return ErrPoolUnsupported
+	}
+	if reservationFromContext(ctx) {
+		return ErrReservationUnsupported
+	}
+	return rs.createKey(ctx, key, tags)
+}
+
+// createKey claims key and adds it to the available set, returning
+// ErrKeyExists if another caller already holds it.
+func (rs *RedisKeyStore) createKey(ctx context.Context, key string, tags map[string]string) error {
+	var encodedTags []byte
+	if len(tags) > 0 {
+		var err error
+		encodedTags, err = json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	created, err := rs.client.HSetNX(ctx, rs.metaKey(key), "createdAt", time.Now().UnixMilli()).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrKeyExists
+	}
+
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, rs.metaKey(key), "isBlocked", "0")
+		if encodedTags != nil {
+			pipe.HSet(ctx, rs.metaKey(key), "tags", encodedTags)
+		}
+		pipe.PExpire(ctx, rs.metaKey(key), rs.IdleTTL)
+		pipe.SAdd(ctx, rs.availableKey(), key)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisKeyStore) RetreiveAvailableKey() (string, error) {
+	return rs.RetreiveAvailableKeyWithTTL(0)
+}
+
+func (rs *RedisKeyStore) RetreiveAvailableKeyWithTTL(ttl time.Duration) (string, error) {
+	return rs.RetreiveAvailableKeyCtx(context.Background(), ttl)
+}
+
+func (rs *RedisKeyStore) RetreiveAvailableKeyCtx(ctx context.Context, ttl time.Duration) (string, error) {
+	lease, err := rs.LeaseKeyCtx(ctx, ttl)
+	return lease.KeyID, err
+}
+
+func (rs *RedisKeyStore) LeaseKey(ttl time.Duration) (Lease, error) {
+	return rs.LeaseKeyCtx(context.Background(), ttl)
+}
+
+func (rs *RedisKeyStore) LeaseKeyCtx(ctx context.Context, ttl time.Duration) (Lease, error) {
+	if poolFromContext(ctx) != DefaultPool {
+		return Lease{}, ErrPoolUnsupported
+	}
+	if slidingFromContext(ctx) {
+		return Lease{}, ErrSlidingUnsupported
+	}
+	ttl = clampBlockTTL(ttl, rs.BlockTTL, rs.MinBlockTTL, rs.MaxBlockTTL)
+	token, err := GenerateRandomKey(LeaseTokenLength)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	if err := rs.reclaim(ctx); err != nil {
+		return Lease{}, err
+	}
+
+	now := time.Now()
+	key, err := leaseScript.Run(ctx, rs.client,
+		[]string{rs.availableKey(), rs.blockedKey()},
+		now.UnixMilli(), now.Add(ttl).UnixMilli(), rs.IdleTTL.Milliseconds(), rs.metaKey(""), token).Text()
+	if errors.Is(err, redis.Nil) {
+		return Lease{}, ErrNoKeysAvailable
+	}
+	if err != nil {
+		return Lease{}, err
+	}
+	return Lease{KeyID: key, LeaseToken: token}, nil
+}
+
+func (rs *RedisKeyStore) UnblockKey(key string) error {
+	return rs.UnblockKeyCtx(context.Background(), key)
+}
+
+func (rs *RedisKeyStore) UnblockKeyCtx(ctx context.Context, key string) error {
+	if _, ok := versionFromContext(ctx); ok {
+		return ErrVersionUnsupported
+	}
+	if err := rs.reclaim(ctx); err != nil {
+		return err
+	}
+
+	unblocked, err := unblockScript.Run(ctx, rs.client,
+		[]string{rs.availableKey(), rs.blockedKey(), rs.metaKey(key)},
+		key, time.Now().UnixMilli(), rs.IdleTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	switch unblocked {
+	case -1:
+		return ErrKeyNotFound
+	case 0:
+		return ErrKeyNotBlocked
+	}
+	return nil
+}
+
+func (rs *RedisKeyStore) ReleaseKey(key, token string) error {
+	return rs.ReleaseKeyCtx(context.Background(), key, token)
+}
+
+func (rs *RedisKeyStore) ReleaseKeyCtx(ctx context.Context, key, token string) error {
+	if err := rs.reclaim(ctx); err != nil {
+		return err
+	}
+
+	released, err := releaseScript.Run(ctx, rs.client,
+		[]string{rs.availableKey(), rs.blockedKey(), rs.metaKey(key)},
+		key, token, time.Now().UnixMilli(), rs.IdleTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	switch released {
+	case -1:
+		return ErrKeyNotFound
+	case -2:
+		return ErrLeaseNotHeld
+	case 0:
+		return ErrKeyNotBlocked
+	}
+	return nil
+}
+
+func (rs *RedisKeyStore) DeleteKey(key string) error {
+	return rs.DeleteKeyCtx(context.Background(), key)
+}
+
+func (rs *RedisKeyStore) DeleteKeyCtx(ctx context.Context, key string) error {
+	var deleted *redis.IntCmd
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, rs.metaKey(key))
+		pipe.SRem(ctx, rs.availableKey(), key)
+		pipe.ZRem(ctx, rs.blockedKey(), key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if deleted.Val() == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (rs *RedisKeyStore) KeepAlive(key string) error {
+	return rs.KeepAliveCtx(context.Background(), key)
+}
+
+func (rs *RedisKeyStore) KeepAliveCtx(ctx context.Context, key string) error {
+	if _, ok := versionFromContext(ctx); ok {
+		return ErrVersionUnsupported
+	}
+	if err := rs.reclaim(ctx); err != nil {
+		return err
+	}
+
+	result, err := keepAliveScript.Run(ctx, rs.client,
+		[]string{rs.blockedKey(), rs.metaKey(key)},
+		time.Now().UnixMilli(), rs.IdleTTL.Milliseconds(), key, rs.MaxRenewals).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case -1:
+		return ErrKeyNotFound
+	case -2:
+		return ErrRenewalLimit
+	}
+	return nil
+}
+
+func (rs *RedisKeyStore) GetKeyInfo(key string) (KeyMetadata, error) {
+	return rs.GetKeyInfoCtx(context.Background(), key)
+}
+
+func (rs *RedisKeyStore) GetKeyInfoCtx(ctx context.Context, key string) (KeyMetadata, error) {
+	if err := rs.reclaim(ctx); err != nil {
+		return KeyMetadata{}, err
+	}
+
+	fields, err := rs.client.HGetAll(ctx, rs.metaKey(key)).Result()
+	if err != nil {
+		return KeyMetadata{}, err
+	}
+	if len(fields) == 0 {
+		return KeyMetadata{}, ErrKeyNotFound
+	}
+
+	var tags map[string]string
+	if raw := fields["tags"]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &tags); err != nil {
+			return KeyMetadata{}, err
+		}
+	}
+
+	metadata := KeyMetadata{
+		Key:          key,
+		CreationTime: parseMillis(fields["createdAt"]),
+		LastAccess:   parseMillis(fields["lastAccess"]),
+		IsBlocked:    fields["isBlocked"] == "1",
+		BlockedAt:    parseMillis(fields["blockedAt"]),
+		Expiry:       parseMillis(fields["expiresAt"]),
+		Tags:         tags,
+		LeaseTTL:     time.Duration(parseInt(fields["leaseTTL"])) * time.Millisecond,
+		LeaseToken:   fields["leaseToken"],
+		Renewals:     int(parseInt(fields["renewals"])),
+	}
+	return withExpiresIn(metadata, time.Now()), nil
+}
+
+// Ready pings the Redis server.
+func (rs *RedisKeyStore) Ready(ctx context.Context) error {
+	return rs.client.Ping(ctx).Err()
+}
+
+// parseMillis converts a Unix millisecond timestamp stored in Redis back into
+// a time.Time, returning the zero time when the field is unset.
+func parseMillis(raw string) time.Time {
+	ms := parseInt(raw)
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// parseInt parses an integer hash field, treating a missing or malformed
+// value as zero.
+func parseInt(raw string) int64 {
+	n, _ := strconv.ParseInt(raw, 10, 64)
+	return n
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis starts an in-process Redis server and returns it together
+// with a function that opens a new RedisKeyStore on it, standing in for
+// another instance of the service.
+func newTestRedis(t *testing.T, cfg Config) (*miniredis.Miniredis, func() *RedisKeyStore) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	open := func() *RedisKeyStore {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewRedisKeyStore(client, cfg)
+	}
+	return mr, open
+}
+
+func TestRedisKeyStoreSharedPool(t *testing.T) {
+	_, open := newTestRedis(t, Config{})
+	a, b := open(), open()
+
+	key, err := a.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+	if _, err := b.GetKeyInfo(key); err != nil {
+		t.Fatalf("GetKeyInfo on the other instance: %v", err)
+	}
+
+	lease, err := b.LeaseKey(0)
+	if err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+	if lease.KeyID != key {
+		t.Fatalf("leased %q, want %q", lease.KeyID, key)
+	}
+	if _, err := a.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("second lease: got %v, want ErrNoKeysAvailable", err)
+	}
+	info, err := a.GetKeyInfo(key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.IsBlocked {
+		t.Fatal("key leased by one instance is not blocked on the other")
+	}
+
+	if err := a.UnblockKey(key); err != nil {
+		t.Fatalf("UnblockKey: %v", err)
+	}
+	if err := b.UnblockKey(key); !errors.Is(err, ErrKeyNotBlocked) {
+		t.Fatalf("second unblock: got %v, want ErrKeyNotBlocked", err)
+	}
+	if lease, err := b.LeaseKey(0); err != nil || lease.KeyID != key {
+		t.Fatalf("lease after unblock: %q, %v", lease.KeyID, err)
+	}
+}
+
+func TestRedisKeyStoreLeaseExpiry(t *testing.T) {
+	_, open := newTestRedis(t, Config{MinBlockTTL: time.Millisecond})
+	a, b := open(), open()
+
+	key, err := a.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+	if _, err := a.LeaseKey(50 * time.Millisecond); err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Either instance reclaims the expired lease before leasing.
+	lease, err := b.LeaseKey(0)
+	if err != nil {
+		t.Fatalf("LeaseKey after expiry: %v", err)
+	}
+	if lease.KeyID != key {
+		t.Fatalf("leased %q, want the reclaimed %q", lease.KeyID, key)
+	}
+}
+
+func TestRedisKeyStoreIdleExpiry(t *testing.T) {
+	mr, open := newTestRedis(t, Config{IdleTTL: time.Minute})
+	a, b := open(), open()
+
+	idle, err := a.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+	kept, err := a.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+
+	mr.FastForward(45 * time.Second)
+	if err := b.KeepAlive(kept); err != nil {
+		t.Fatalf("KeepAlive: %v", err)
+	}
+	mr.FastForward(30 * time.Second)
+
+	if _, err := b.GetKeyInfo(idle); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo of idle key: got %v, want ErrKeyNotFound", err)
+	}
+	if _, err := a.GetKeyInfo(kept); err != nil {
+		t.Fatalf("GetKeyInfo of kept key: %v", err)
+	}
+	// The expired key's id is skipped rather than leased.
+	lease, err := b.LeaseKey(0)
+	if err != nil || lease.KeyID != kept {
+		t.Fatalf("LeaseKey: %q, %v, want %q", lease.KeyID, err, kept)
+	}
+	if _, err := a.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey: got %v, want ErrNoKeysAvailable", err)
+	}
+}
+
+func TestRedisKeyStorePrunesIdleIDs(t *testing.T) {
+	mr, open := newTestRedis(t, Config{IdleTTL: time.Minute})
+	rs := open()
+
+	var idle []string
+	for i := 0; i < 3*redisPruneBatch; i++ {
+		key, err := rs.GenerateNewKey()
+		if err != nil {
+			t.Fatalf("GenerateNewKey: %v", err)
+		}
+		idle = append(idle, key)
+	}
+	mr.FastForward(30 * time.Second)
+	kept, err := rs.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+	mr.FastForward(31 * time.Second)
+
+	// Each operation prunes a batch, so a few reads clear the whole set.
+	for i := 0; i < 10; i++ {
+		if _, err := rs.GetKeyInfo(kept); err != nil {
+			t.Fatalf("GetKeyInfo of kept key: %v", err)
+		}
+	}
+	members, err := mr.Members(rs.availableKey())
+	if err != nil {
+		t.Fatalf("Members: %v", err)
+	}
+	if len(members) != 1 || members[0] != kept {
+		t.Fatalf("available set holds %d ids, want only %q", len(members), kept)
+	}
+	if mr.Exists(rs.pruneCursorKey()) {
+		t.Fatal("prune cursor left behind after a full scan")
+	}
+}
+
+func TestRedisKeyStoreReturnedKeyIsNotReapedAtOnce(t *testing.T) {
+	mr, open := newTestRedis(t, Config{IdleTTL: time.Minute, MinBlockTTL: time.Millisecond})
+	rs := open()
+
+	key, err := rs.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+	if _, err := rs.LeaseKey(50 * time.Millisecond); err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+	mr.FastForward(50 * time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	// Reading the key reclaims the lease, which restarts the idle TTL.
+	if info, err := rs.GetKeyInfo(key); err != nil || info.IsBlocked {
+		t.Fatalf("after the lease ran out: blocked %v, err %v", info.IsBlocked, err)
+	}
+	if ttl := mr.TTL(rs.metaKey(key)); ttl != time.Minute {
+		t.Fatalf("idle TTL after the lease ended = %v, want %v", ttl, time.Minute)
+	}
+	mr.FastForward(30 * time.Second)
+	if _, err := rs.GetKeyInfo(key); err != nil {
+		t.Fatalf("key reaped within IdleTTL of its lease ending: %v", err)
+	}
+	mr.FastForward(31 * time.Second)
+	if _, err := rs.GetKeyInfo(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo IdleTTL after the lease ended: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestRedisKeyStoreMaxRenewals(t *testing.T) {
+	_, open := newTestRedis(t, Config{MinBlockTTL: time.Millisecond, MaxRenewals: 2})
+	a, b := open(), open()
+
+	key, err := a.GenerateNewKey()
+	if err != nil {
+		t.Fatalf("GenerateNewKey: %v", err)
+	}
+	if _, err := a.LeaseKey(100 * time.Millisecond); err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+
+	// Renewals through either instance count against the same lease.
+	for i, rs := range []*RedisKeyStore{a, b} {
+		if err := rs.KeepAlive(key); err != nil {
+			t.Fatalf("renewal %d: %v", i+1, err)
+		}
+	}
+	before, err := a.GetKeyInfo(key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if before.Renewals != 2 {
+		t.Fatalf("Renewals = %d, want 2", before.Renewals)
+	}
+	if err := b.KeepAlive(key); !errors.Is(err, ErrRenewalLimit) {
+		t.Fatalf("renewal past the limit: got %v, want ErrRenewalLimit", err)
+	}
+	if after, _ := a.GetKeyInfo(key); !after.Expiry.Equal(before.Expiry) {
+		t.Fatalf("rejected renewal moved the expiry from %v to %v", before.Expiry, after.Expiry)
+	}
+
+	// The capped lease runs out and the key comes back with a fresh count.
+	time.Sleep(150 * time.Millisecond)
+	info, err := b.GetKeyInfo(key)
+	if err != nil {
+		t.Fatalf("GetKeyInfo after the lease ran out: %v", err)
+	}
+	if info.IsBlocked || info.Renewals != 0 {
+		t.Fatalf("after the lease ran out: blocked %v, renewals %d", info.IsBlocked, info.Renewals)
+	}
+	if _, err := b.LeaseKey(0); err != nil {
+		t.Fatalf("LeaseKey: %v", err)
+	}
+	if err := a.KeepAlive(key); err != nil {
+		t.Fatalf("renewing a new lease: %v", err)
+	}
+}
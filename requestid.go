@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries the id that ties a request to its log lines. It is
+// taken from the request when the client sets it and echoed on every
+// response.
+const RequestIDHeader = "X-Request-Id"
+
+const (
+	// MaxRequestIDLength bounds client-supplied request ids; longer ones are
+	// replaced with a generated id.
+	MaxRequestIDLength = 128
+	// requestIDLength is the number of random bytes behind a generated id.
+	requestIDLength = 12
+)
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying id as its request id.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the id set by ContextWithRequestID, or "".
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID gives every request an id, the client's own if it sent a usable
+// one in RequestIDHeader, stores it in the request context and sets it on the
+// response.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID(id) {
+		var err error
+		if id, err = GenerateRandomKey(requestIDLength); err != nil {
+			c.Next()
+			return
+		}
+	}
+	c.Request = c.Request.WithContext(ContextWithRequestID(c.Request.Context(), id))
+	c.Header(RequestIDHeader, id)
+	c.Next()
+}
+
+// validRequestID reports whether id is short enough and made only of
+// printable ASCII, so it is safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
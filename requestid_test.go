@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		// echoed reports whether header should be used as the id.
+		echoed bool
+	}{
+		{"generated", "", false},
+		{"supplied", "trace-1234", true},
+		{"too long", strings.Repeat("x", MaxRequestIDLength+1), false},
+		{"unprintable", "bad\nid", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := newLogger(&buf, "info")
+			if err != nil {
+				t.Fatalf("newLogger: %v", err)
+			}
+			km, _ := newTestManager(t, Config{})
+			r := newTestRouter(km, RouterConfig{Logger: logger})
+
+			req := newRequest(t, http.MethodGet, "/keys/unknown-key", nil)
+			if tc.header != "" {
+				req.Header.Set(RequestIDHeader, tc.header)
+			}
+			w := serveRequest(r, req)
+			id := w.Header().Get(RequestIDHeader)
+			if id == "" {
+				t.Fatal("response has no request id")
+			}
+			if (id == tc.header) != tc.echoed {
+				t.Fatalf("request id = %q for header %q, echoed want %v", id, tc.header, tc.echoed)
+			}
+			if got := decodeBody[APIError](t, w).RequestID; got != id {
+				t.Fatalf("error body requestId = %q, want %q", got, id)
+			}
+
+			var logged []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var entry struct {
+					Msg       string `json:"msg"`
+					RequestID string `json:"requestId"`
+				}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("decoding log line %q: %v", line, err)
+				}
+				if entry.Msg == "request" {
+					logged = append(logged, entry.RequestID)
+				}
+			}
+			if len(logged) != 1 || logged[0] != id {
+				t.Fatalf("access log request ids = %q, want [%q]", logged, id)
+			}
+		})
+	}
+}
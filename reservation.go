@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultReservationTTL is how long a reserved key waits for ActivateKey
+// before it joins the available pool by itself.
+const DefaultReservationTTL = 30 * time.Second
+
+var (
+	ErrKeyNotReserved         = errors.New("key is not reserved")
+	ErrReservationUnsupported = errors.New("this store does not support reserved keys")
+)
+
+type reservedKey struct{}
+
+// ContextWithReservation returns a copy of ctx under which new keys start
+// out reserved: they cannot be leased until ActivateKey is called for them
+// or ReservationTTL has passed.
+func ContextWithReservation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reservedKey{}, true)
+}
+
+// reservationFromContext reports whether ctx asks for new keys to start
+// reserved.
+func reservationFromContext(ctx context.Context) bool {
+	reserved, _ := ctx.Value(reservedKey{}).(bool)
+	return reserved
+}
+
+// offerKey makes a newly added key available, or reserves it until
+// ReservationTTL from now if reserve is set. The caller must hold km.mu.
+func (km *KeyManager) offerKey(key string, reserve bool) {
+	if !reserve {
+		km.pushAvailable(key)
+		return
+	}
+	metadata := km.keys[key]
+	metadata.ReservedUntil = km.Clock.Now().Add(km.ReservationTTL)
+	km.putKey(key, metadata)
+	km.reserved[key] = metadata.ReservedUntil
+	km.schedule(key, metadata.ReservedUntil)
+}
+
+// ActivateKey confirms a reserved key, moving it into the available pool
+// before its reservation runs out. It returns ErrKeyNotReserved for a key
+// that is not reserved.
+func (km *KeyManager) ActivateKey(key string) (err error) {
+	defer km.writeThrough(&err)
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if err := km.checkPending(); err != nil {
+		return err
+	}
+	if _, err := km.liveKey(key); err != nil {
+		return err
+	}
+	if _, reserved := km.reserved[key]; !reserved {
+		return ErrKeyNotReserved
+	}
+
+	km.activate(key, km.Clock.Now())
+	km.logger.Debug("activated key", "key", keyFingerprint(key))
+	return nil
+}
+
+// activate ends the reservation on key and makes it available. The caller
+// must hold km.mu.
+func (km *KeyManager) activate(key string, now time.Time) {
+	metadata := km.keys[key]
+	metadata.ReservedUntil = time.Time{}
+	km.putKey(key, metadata)
+	delete(km.reserved, key)
+	km.pushAvailable(key)
+	km.publish(EventActivated, key, now)
+}
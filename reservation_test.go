@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestActivateReservedKey(t *testing.T) {
+	km, clock := newTestManager(t, Config{ReservationTTL: time.Minute, IdleTTL: time.Hour})
+	r := newTestRouter(km, RouterConfig{})
+
+	w := doRequest(t, r, http.MethodPost, "/keys?reserved=true", nil)
+	expectStatus(t, w, http.StatusCreated)
+	created := decodeBody[createdKeyResponse](t, w)
+	if want := testEpoch.Add(time.Minute); !created.ReservedUntil.Equal(want) {
+		t.Fatalf("reservedUntil = %v, want %v", created.ReservedUntil, want)
+	}
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey with only a reserved key: got %v, want ErrNoKeysAvailable", err)
+	}
+
+	clock.Advance(30 * time.Second)
+	w = doRequest(t, r, http.MethodPost, "/keys/"+created.KeyID+"/activate", nil)
+	expectStatus(t, w, http.StatusOK)
+	if lease := mustLease(t, km, 0); lease.KeyID != created.KeyID {
+		t.Fatalf("leased %q, want the activated key %q", lease.KeyID, created.KeyID)
+	}
+	info, err := km.GetKeyInfo(created.KeyID)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.ReservedUntil.IsZero() {
+		t.Fatalf("activated key still reserved until %v", info.ReservedUntil)
+	}
+
+	w = doRequest(t, r, http.MethodPost, "/keys/"+created.KeyID+"/activate", nil)
+	expectError(t, w, http.StatusConflict, CodeKeyNotReserved)
+	w = doRequest(t, r, http.MethodPost, "/keys/unknown-key/activate", nil)
+	expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+}
+
+func TestReservationRunsOut(t *testing.T) {
+	km, clock := newTestManager(t, Config{ReservationTTL: time.Minute, IdleTTL: time.Hour})
+	key, err := km.GenerateNewKeyCtx(ContextWithReservation(context.Background()), nil)
+	if err != nil {
+		t.Fatalf("GenerateNewKeyCtx: %v", err)
+	}
+	if stats := km.Stats(); stats.Reserved != 1 || stats.Available != 0 {
+		t.Fatalf("after reserving: %+v", stats)
+	}
+
+	clock.Advance(59 * time.Second)
+	km.sweep(clock.Now())
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey before the reservation ran out: got %v, want ErrNoKeysAvailable", err)
+	}
+
+	clock.Advance(2 * time.Second)
+	km.sweep(clock.Now())
+	if stats := km.Stats(); stats.Reserved != 0 || stats.Available != 1 {
+		t.Fatalf("after the reservation ran out: %+v", stats)
+	}
+	if lease := mustLease(t, km, 0); lease.KeyID != key {
+		t.Fatalf("leased %q, want the formerly reserved %q", lease.KeyID, key)
+	}
+}
@@ -0,0 +1,1180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"keys-generator/docs"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// RouterConfig holds the HTTP-level settings for NewRouter.
+type RouterConfig struct {
+	// AdminToken, when set, must be presented on every mutating request.
+	AdminToken string
+	// ProtectReads extends the AdminToken check to GET requests.
+	ProtectReads bool
+	// LeaseRate is the sustained number of leases per second allowed on
+	// GET /keys, with bursts of up to LeaseBurst. Zero disables the limit.
+	LeaseRate  float64
+	LeaseBurst int
+	// LeaseRatePerIP gives every client IP its own bucket instead of sharing
+	// one across all callers.
+	LeaseRatePerIP bool
+	// Logger receives the access log. Nil means slog.Default().
+	Logger *slog.Logger
+	// LogRawPaths turns off key redaction in the access log.
+	LogRawPaths bool
+	// RequireIfMatch rejects PUT requests on a key that do not carry the
+	// key's ETag in If-Match. If-Match is honoured whether or not it is set.
+	RequireIfMatch bool
+	// UnblockCreates makes PUT /keys/{id} on an unknown id register it as
+	// an available key, answering 201, instead of failing with 404, for
+	// clients that use it as an upsert. Requests carrying If-Match still
+	// expect the key to exist and are never turned into creates.
+	UnblockCreates bool
+	// MaxBodyBytes caps the size of request bodies; larger ones are
+	// rejected with 413. Zero means DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+	// CORS lets browser dashboards on other origins call the API.
+	CORS CORSConfig
+	// EnablePprof serves runtime profiles under /debug/pprof/.
+	EnablePprof bool
+}
+
+// DefaultMaxBodyBytes is the default cap on request bodies, large enough for
+// an import of tens of thousands of keys.
+const DefaultMaxBodyBytes = 10 << 20
+
+// Request and response bodies, named so they appear in the OpenAPI spec.
+type (
+	generateRequest struct {
+		// KeyID, when set, is used as the key instead of a generated one.
+		KeyID string            `json:"keyId" example:"my-key"`
+		Tags  map[string]string `json:"tags" binding:"dive,keys,required,endkeys"`
+	}
+	batchRequest struct {
+		Count int `json:"count" binding:"required,min=1" example:"100"`
+	}
+	keyIDResponse struct {
+		KeyID string `json:"keyId"`
+	}
+	createdKeyResponse struct {
+		KeyID string `json:"keyId"`
+		KeyMetadata
+	}
+	batchResponse struct {
+		KeyIDs []string `json:"keyIds"`
+	}
+	listResponse struct {
+		Keys   []KeyMetadata `json:"keys"`
+		Total  int           `json:"total"`
+		Offset int           `json:"offset"`
+		Limit  int           `json:"limit"`
+	}
+	messageResponse struct {
+		Message string `json:"message"`
+	}
+	releaseRequest struct {
+		LeaseToken string `json:"leaseToken" binding:"required"`
+	}
+	keepAliveBatchRequest struct {
+		Keys []string `json:"keys" binding:"required,min=1,dive,required"`
+	}
+	// keyResult is the outcome of a batch operation for one key. Code and
+	// Message are set when Status is not 200.
+	keyResult struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	// nextAvailableResponse says when a lease can next succeed. Wait is
+	// "unknown" when no key is leased or cooling down.
+	nextAvailableResponse struct {
+		At   time.Time `json:"at,omitzero"`
+		Wait string    `json:"wait" example:"2.5s"`
+	}
+	historyResponse struct {
+		Events []KeyEvent `json:"events"`
+	}
+	leasesResponse struct {
+		Leases []Lease `json:"leases"`
+	}
+	batchResultResponse struct {
+		Results map[string]keyResult `json:"results"`
+	}
+	// ttlConfig holds durations such as "30s"; a field left out of a PATCH
+	// is not changed.
+	ttlConfig struct {
+		BlockTTL string `json:"blockTTL,omitempty" example:"30s"`
+		IdleTTL  string `json:"idleTTL,omitempty" example:"5m"`
+	}
+	statusRequest struct {
+		Keys []string `json:"keys" binding:"required,min=1,dive,required"`
+	}
+	statusResponse struct {
+		Statuses map[string]KeyStatus `json:"statuses"`
+	}
+	clearResponse struct {
+		Removed int `json:"removed"`
+		// KeyIDs is returned instead of Removed by a dry run.
+		KeyIDs []string `json:"keyIds,omitempty"`
+	}
+	leasedKeyResponse struct {
+		KeyMetadata
+		LeaseToken string `json:"leaseToken"`
+	}
+)
+
+// NewRouter wires the HTTP API to store. Routes that depend on features only
+// the in-memory KeyManager provides are registered when store is one.
+func NewRouter(store KeyStore, cfg RouterConfig) *gin.Engine {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	maxBody := cfg.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBodyBytes
+	}
+
+	reg := prometheus.NewRegistry()
+	httpMetrics := newHTTPMetrics(reg)
+
+	r := gin.New()
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(methodNotAllowed(r))
+	r.Use(requestID, accessLog(logger, !cfg.LogRawPaths), httpMetrics.middleware,
+		recoverPanic(logger), limitBody(maxBody), clientID)
+	if len(cfg.CORS.AllowedOrigins) > 0 {
+		r.Use(cors(cfg.CORS))
+	}
+
+	// The probes are registered ahead of adminAuth so orchestrators can reach
+	// them without a token.
+
+	// @Summary     Liveness probe
+	// @Description Always succeeds while the process is serving requests.
+	// @Tags        health
+	// @Produce     json
+	// @Success     200 {object} messageResponse
+	// @Router      /healthz [get]
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "ok"})
+	})
+
+	// @Summary     Readiness probe
+	// @Description Succeeds once the store is ready to serve requests.
+	// @Tags        health
+	// @Produce     json
+	// @Success     200 {object} messageResponse
+	// @Failure     503 {object} APIError
+	// @Router      /readyz [get]
+	r.GET("/readyz", func(c *gin.Context) {
+		if err := store.Ready(c.Request.Context()); err != nil {
+			writeError(c, http.StatusServiceUnavailable, CodeNotReady, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "ready"})
+	})
+
+	// Releasing is authorised by the lease token rather than the admin token,
+	// so lease holders can give keys back without admin credentials.
+
+	// @Summary     Release a leased key
+	// @Description Returns a key to the pool early. Only the lease holder may
+	// @Description do this, by presenting the token issued with the lease.
+	// @Tags        keys
+	// @Accept      json
+	// @Produce     json
+	// @Param       id   path     string         true "Key id"
+	// @Param       body body     releaseRequest true "Lease token"
+	// @Success     200  {object} messageResponse
+	// @Failure     400  {object} APIError
+	// @Failure     413  {object} APIError
+	// @Failure     403  {object} APIError
+	// @Failure     404  {object} APIError
+	// @Failure     410  {object} APIError
+	// @Failure     409  {object} APIError
+	// @Router      /keys/{id}/release [post]
+	r.POST("/keys/:id/release", validateKeyID, func(c *gin.Context) {
+		var req releaseRequest
+		if !bindJSON(c, &req, false) {
+			return
+		}
+
+		if err := store.ReleaseKeyCtx(c.Request.Context(), c.Param("id"), req.LeaseToken); err != nil {
+			writeStoreError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Key is released"})
+	})
+
+	r.Use(adminAuth(cfg.AdminToken, cfg.ProtectReads))
+
+	// @Summary     Generate a key
+	// @Description Creates a new available key, optionally labelled with tags. With keyId
+	// @Description set that id is created instead, or 409 returned if it already exists.
+	// @Description The response carries the new key's metadata alongside its id.
+	// @Description With reserved set the key is held out of the pool until POST /keys/{id}/activate
+	// @Description confirms it or its reservation runs out.
+	// @Tags        keys
+	// @Accept      json
+	// @Produce     json
+	// @Param       pool query    string          false "Pool to add the key to"
+	// @Param       reserved query bool           false "Keep the key out of the pool until it is activated"
+	// @Param       body body     generateRequest false "Optional key id and tags"
+	// @Success     201  {object} createdKeyResponse
+	// @Failure     400  {object} APIError
+	// @Failure     413  {object} APIError
+	// @Failure     401  {object} APIError
+	// @Failure     409  {object} APIError
+	// @Failure     503  {object} APIError
+	// @Security    BearerAuth
+	// @Router      /keys [post]
+	r.POST("/keys", func(c *gin.Context) {
+		var req generateRequest
+		if !bindJSON(c, &req, true) {
+			return
+		}
+		if !queryPool(c) {
+			return
+		}
+		if c.Query("reserved") == "true" {
+			c.Request = c.Request.WithContext(ContextWithReservation(c.Request.Context()))
+		}
+
+		key := req.KeyID
+		var err error
+		if key != "" {
+			err = store.RegisterKeyCtx(c.Request.Context(), key, req.Tags)
+		} else {
+			key, err = store.GenerateNewKeyCtx(c.Request.Context(), req.Tags)
+		}
+		if err != nil {
+			writeStoreError(c, err)
+			return
+		}
+
+		// The key is created either way; should it vanish before it can be
+		// read back, fall back to reporting just its id.
+		metadata, err := store.GetKeyInfoCtx(c.Request.Context(), key)
+		if err != nil {
+			c.JSON(http.StatusCreated, gin.H{"keyId": key})
+			return
+		}
+		c.JSON(http.StatusCreated, createdKeyResponse{KeyID: key, KeyMetadata: metadata})
+	})
+
+	lease := r.Group("/")
+	if cfg.LeaseRate > 0 {
+		lease.Use(rateLimit(newLeaseLimiter(cfg.LeaseRate, cfg.LeaseBurst, cfg.LeaseRatePerIP)))
+	}
+
+	// @Summary     Lease a key
+	// @Description Blocks a random available key for the requested duration.
+	// @Description The returned lease token is needed to release it early.
+	// @Description With wait set, an empty pool is retried until a key frees up or wait elapses.
+	// @Tags        keys
+	// @Produce     json
+	// @Param       ttl  query    string false "Lease duration, e.g. 30s"
+	// @Param       wait query    string false "How long to wait for a key, e.g. 2s (max 30s)"
+	// @Param       pool query    string false "Pool to lease from"
+	// @Param       sliding query bool false "Renew the lease every time the key is read with GET /keys/{id}"
+	// @Param       X-Client-Id header string false "Client to count the lease against for quotas"
+	// @Success     200  {object} Lease
+	// @Failure     400  {object} APIError
+	// @Failure     404  {object} APIError{details=PoolPressure}
+	// @Header      404  {integer} Retry-After "Seconds until the soonest lease expires"
+	// @Failure     429  {object} APIError
+	// @Failure     503  {object} APIError
+	// @Router      /keys [get]
+	lease.GET("/keys", func(c *gin.Context) {
+		ttl, err := queryTTL(c)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		wait, err := queryWait(c)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if !queryPool(c) {
+			return
+		}
+		if c.Query("sliding") == "true" {
+			c.Request = c.Request.WithContext(ContextWithSlidingExpiry(c.Request.Context()))
+		}
+
+		lease, err := LeaseKeyWait(c.Request.Context(), store, ttl, wait)
+		if err == nil && releaseAbandoned(c.Request.Context(), store, lease, logger) {
+			return
+		}
+		if errors.Is(err, ErrNoKeysAvailable) {
+			if p, ok := store.(pressureReporter); ok {
+				writeNoKeysAvailable(c, err, p.PoolPressure())
+				return
+			}
+		}
+		if err != nil {
+			writeStoreError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, lease)
+	})
+
+	// @Summary Get key metadata
+	// @Tags    keys
+	// @Produce json
+	// @Param   id  path     string true "Key id"
+	// @Success 200 {object} KeyMetadata
+	// @Header  200 {string} ETag "Current version of the key, for If-Match"
+	// @Failure 400 {object} APIError
+	// @Failure 404 {object} APIError
+	// @Router  /keys/{id} [get]
+	r.GET("/keys/:id", validateKeyID, func(c *gin.Context) {
+		key := c.Param("id")
+		metadata, err := store.GetKeyInfoCtx(c.Request.Context(), key)
+		if err != nil {
+			writeStoreError(c, err)
+			return
+		}
+		if metadata.Version > 0 {
+			c.Header("ETag", etag(metadata.Version))
+		}
+		c.JSON(http.StatusOK, metadata)
+	})
+
+	// @Summary  Delete a key
+	// @Tags     keys
+	// @Produce  json
+	// @Param    id  path     string true "Key id"
+	// @Success  200 {object} messageResponse
+	// @Failure  400 {object} APIError
+	// @Failure  401 {object} APIError
+	// @Failure  404 {object} APIError
+	// @Failure  410 {object} APIError
+	// @Security BearerAuth
+	// @Router   /keys/{id} [delete]
+	r.DELETE("/keys/:id", validateKeyID, func(c *gin.Context) {
+		key := c.Param("id")
+		err := store.DeleteKeyCtx(c.Request.Context(), key)
+		if err != nil {
+			writeStoreError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Key is deleted"})
+	})
+
+	// @Summary     Unblock a key
+	// @Description Ends the lease on a key and returns it to the available pool.
+	// @Description If the server is configured to, an unknown id is created as an available key instead of
+	// @Description failing with 404.
+	// @Tags        keys
+	// @Produce     json
+	// @Param       id       path     string true  "Key id"
+	// @Param       If-Match header   string false "ETag from GET /keys/{id}; the key must not have changed since"
+	// @Success     200      {object} messageResponse
+	// @Success     201      {object} messageResponse
+	// @Failure     400      {object} APIError
+	// @Failure     401      {object} APIError
+	// @Failure     404      {object} APIError
+	// @Failure     410      {object} APIError
+	// @Failure     409      {object} APIError
+	// @Failure     412      {object} APIError
+	// @Failure     428      {object} APIError
+	// @Failure     501      {object} APIError
+	// @Security    BearerAuth
+	// @Router      /keys/{id} [put]
+	r.PUT("/keys/:id", validateKeyID, func(c *gin.Context) {
+		if !ifMatch(c, cfg.RequireIfMatch) {
+			return
+		}
+		key := c.Param("id")
+		err := store.UnblockKeyCtx(c.Request.Context(), key)
+		if errors.Is(err, ErrKeyNotFound) && cfg.UnblockCreates && c.GetHeader("If-Match") == "" {
+			err = store.RegisterKeyCtx(c.Request.Context(), key, nil)
+			if err == nil {
+				c.JSON(http.StatusCreated, gin.H{"message": "Key is created"})
+				return
+			}
+			// Someone else created it in the meantime, so unblock
+			// that key after all.
+			if errors.Is(err, ErrKeyExists) {
+				err = store.UnblockKeyCtx(c.Request.Context(), key)
+			}
+		}
+		if err != nil {
+			writeStoreError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Key is unblocked again"})
+	})
+
+	// @Summary     Keep a key alive
+	// @Description Refreshes the key's last access and renews its lease if it is blocked.
+	// @Description Fails with 409 once the lease has been renewed as often as the server allows.
+	// @Tags        keys
+	// @Produce     json
+	// @Param       id       path     string true  "Key id"
+	// @Param       If-Match header   string false "ETag from GET /keys/{id}; the key must not have changed since"
+	// @Success     200      {object} messageResponse
+	// @Failure     400      {object} APIError
+	// @Failure     401      {object} APIError
+	// @Failure     404      {object} APIError
+	// @Failure     409      {object} APIError
+	// @Failure     410      {object} APIError
+	// @Failure     412      {object} APIError
+	// @Failure     428      {object} APIError
+	// @Failure     501      {object} APIError
+	// @Security    BearerAuth
+	// @Router      /keepalive/{id} [put]
+	r.PUT("/keepalive/:id", validateKeyID, func(c *gin.Context) {
+		if !ifMatch(c, cfg.RequireIfMatch) {
+			return
+		}
+		key := c.Param("id")
+		err := store.KeepAliveCtx(c.Request.Context(), key)
+		if err != nil {
+			writeStoreError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Key is alive again"})
+	})
+
+	r.GET("/swagger.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", []byte(docs.SwaggerInfo.ReadDoc()))
+	})
+	r.GET("/swagger/", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", swaggerUI)
+	})
+
+	r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(reg, promhttp.HandlerOpts{})))
+	if cfg.EnablePprof {
+		registerPprof(r, cfg.AdminToken)
+	}
+
+	if km, ok := store.(*KeyManager); ok {
+		reg.MustRegister(km)
+
+		// @Summary  Generate keys in bulk
+		// @Tags     keys
+		// @Accept   json
+		// @Produce  json
+		// @Param    body body     batchRequest true "Number of keys to create"
+		// @Success  201  {object} batchResponse
+		// @Failure  400  {object} APIError
+		// @Failure  413  {object} APIError
+		// @Failure  401  {object} APIError
+		// @Failure  503  {object} APIError
+		// @Security BearerAuth
+		// @Router   /keys/batch [post]
+		r.POST("/keys/batch", func(c *gin.Context) {
+			var req batchRequest
+			if !bindJSON(c, &req, false) {
+				return
+			}
+
+			keys, err := km.GenerateKeys(req.Count)
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusCreated, gin.H{"keyIds": keys})
+		})
+
+		// @Summary     Lease several keys
+		// @Description Leases count keys at once, all or nothing: when fewer are available none
+		// @Description are leased and 404 is returned.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       count query    int    true  "Number of keys to lease"
+		// @Param       ttl   query    string false "Lease duration, e.g. 30s"
+		// @Param       pool  query    string false "Pool to lease from"
+		// @Param       X-Client-Id header string false "Client to count the leases against for quotas"
+		// @Success     200   {object} leasesResponse
+		// @Failure     400   {object} APIError
+		// @Failure     404   {object} APIError{details=PoolPressure}
+		// @Failure     429   {object} APIError
+		// @Failure     503   {object} APIError
+		// @Router      /keys/batch [get]
+		lease.GET("/keys/batch", func(c *gin.Context) {
+			count, err := queryInt(c, "count", 0)
+			if err != nil {
+				writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+			ttl, err := queryTTL(c)
+			if err != nil {
+				writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+			if !queryPool(c) {
+				return
+			}
+
+			leases, err := km.LeaseKeysCtx(c.Request.Context(), ttl, count)
+			if errors.Is(err, ErrNoKeysAvailable) {
+				writeNoKeysAvailable(c, err, km.PoolPressure())
+				return
+			}
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"leases": leases})
+		})
+
+		// @Summary     Keep several keys alive
+		// @Description Does what PUT /keepalive/{id} does for every key in one call. Responds
+		// @Description 207 with a per-key status when any key fails.
+		// @Tags        keys
+		// @Accept      json
+		// @Produce     json
+		// @Param       body body     keepAliveBatchRequest true "Keys to keep alive"
+		// @Success     200  {object} batchResultResponse
+		// @Success     207  {object} batchResultResponse
+		// @Failure     400  {object} APIError
+		// @Failure     413  {object} APIError
+		// @Failure     401  {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keepalive [post]
+		r.POST("/keepalive", func(c *gin.Context) {
+			var req keepAliveBatchRequest
+			if !bindJSON(c, &req, false) {
+				return
+			}
+
+			errs, err := km.KeepAliveMany(req.Keys)
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			status, results := batchResults(errs)
+			c.JSON(status, gin.H{"results": results})
+		})
+
+		// @Summary     Unblock several keys
+		// @Description Ends the lease on every listed key. Each key gets its own result, so
+		// @Description unknown or already available keys do not fail the batch; the status is
+		// @Description 207 if any key failed.
+		// @Tags        keys
+		// @Accept      json
+		// @Produce     json
+		// @Param       body body     keepAliveBatchRequest true "Keys to unblock"
+		// @Success     200  {object} batchResultResponse
+		// @Success     207  {object} batchResultResponse
+		// @Failure     400  {object} APIError
+		// @Failure     413  {object} APIError
+		// @Failure     401  {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/unblock [put]
+		r.PUT("/keys/unblock", func(c *gin.Context) {
+			var req keepAliveBatchRequest
+			if !bindJSON(c, &req, false) {
+				return
+			}
+
+			errs, err := km.UnblockMany(req.Keys)
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			status, results := batchResults(errs)
+			c.JSON(status, gin.H{"results": results})
+		})
+
+		// @Summary     Check several keys
+		// @Description Reports whether each key exists, is leased and when its lease ends.
+		// @Description Unknown keys are included with exists set to false.
+		// @Tags        keys
+		// @Accept      json
+		// @Produce     json
+		// @Param       body body     statusRequest true "Keys to check"
+		// @Success     200  {object} statusResponse
+		// @Failure     400  {object} APIError
+		// @Failure     413  {object} APIError
+		// @Failure     401  {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/status [post]
+		r.POST("/keys/status", func(c *gin.Context) {
+			var req statusRequest
+			if !bindJSON(c, &req, false) {
+				return
+			}
+
+			statuses, err := km.StatusMany(req.Keys)
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"statuses": statuses})
+		})
+
+		// @Summary     Change TTLs at runtime
+		// @Description Sets the default lease duration and the idle TTL without a restart.
+		// @Description Existing leases keep their duration; the idle TTL applies to every key
+		// @Description at once. Responds with the TTLs now in effect.
+		// @Tags        config
+		// @Accept      json
+		// @Produce     json
+		// @Param       body body     ttlConfig true "TTLs to change"
+		// @Success     200  {object} ttlConfig
+		// @Failure     400  {object} APIError
+		// @Failure     401  {object} APIError
+		// @Failure     413  {object} APIError
+		// @Security    BearerAuth
+		// @Router      /config [patch]
+		r.PATCH("/config", func(c *gin.Context) {
+			var req ttlConfig
+			if !bindJSON(c, &req, false) {
+				return
+			}
+
+			var update TTLSettings
+			for _, field := range []struct {
+				name string
+				raw  string
+				dst  *time.Duration
+			}{
+				{"blockTTL", req.BlockTTL, &update.BlockTTL},
+				{"idleTTL", req.IdleTTL, &update.IdleTTL},
+			} {
+				if field.raw == "" {
+					continue
+				}
+				d, err := time.ParseDuration(field.raw)
+				if err != nil || d <= 0 {
+					writeError(c, http.StatusBadRequest, CodeInvalidRequest,
+						fmt.Sprintf("%s must be a positive duration such as 30s", field.name))
+					return
+				}
+				*field.dst = d
+			}
+
+			ttls, err := km.UpdateTTLs(update)
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, ttlConfig{BlockTTL: ttls.BlockTTL.String(), IdleTTL: ttls.IdleTTL.String()})
+		})
+
+		// @Summary     Restore a soft-deleted key
+		// @Description Returns a key deleted within the grace period to the available pool.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       id  path     string true "Key id"
+		// @Success     200 {object} messageResponse
+		// @Failure     400 {object} APIError
+		// @Failure     401 {object} APIError
+		// @Failure     404 {object} APIError
+		// @Failure     409 {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/{id}/restore [post]
+		r.POST("/keys/:id/restore", validateKeyID, func(c *gin.Context) {
+			if err := km.RestoreKey(c.Param("id")); err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Key is restored"})
+		})
+
+		// @Summary     Activate a reserved key
+		// @Description Moves a key created with reserved set into the available pool
+		// @Description without waiting for its reservation to run out.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       id  path     string true "Key id"
+		// @Success     200 {object} messageResponse
+		// @Failure     400 {object} APIError
+		// @Failure     401 {object} APIError
+		// @Failure     404 {object} APIError
+		// @Failure     409 {object} APIError
+		// @Failure     410 {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/{id}/activate [post]
+		r.POST("/keys/:id/activate", validateKeyID, func(c *gin.Context) {
+			if err := km.ActivateKey(c.Param("id")); err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Key is activated"})
+		})
+
+		// @Summary     Force a lease to expire
+		// @Description Reclaims a leased key now, as if its lease had run out.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       id  path     string true "Key id"
+		// @Success     200 {object} messageResponse
+		// @Failure     400 {object} APIError
+		// @Failure     401 {object} APIError
+		// @Failure     404 {object} APIError
+		// @Failure     409 {object} APIError
+		// @Failure     410 {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/{id}/expire [post]
+		r.POST("/keys/:id/expire", validateKeyID, func(c *gin.Context) {
+			if err := km.ForceExpire(c.Param("id")); err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Key is expired"})
+		})
+
+		// @Summary     Rotate a key
+		// @Description Replaces the key with a new id, keeping its metadata and lease.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       id  path     string true "Key id"
+		// @Success     200 {object} keyIDResponse
+		// @Failure     400 {object} APIError
+		// @Failure     401 {object} APIError
+		// @Failure     404 {object} APIError
+		// @Failure     410 {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/{id}/rotate [post]
+		r.POST("/keys/:id/rotate", validateKeyID, func(c *gin.Context) {
+			newKey, err := km.RotateKey(c.Param("id"))
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"keyId": newKey})
+		})
+
+		// @Summary     Generate and lease a key
+		// @Description Creates a new key that is leased to the caller straight away.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       ttl  query    string false "Lease duration, e.g. 30s"
+		// @Param       pool query    string false "Pool to create the key in"
+		// @Param       X-Client-Id header string false "Client to count the lease against for quotas"
+		// @Success     201 {object} leasedKeyResponse
+		// @Failure     400 {object} APIError
+		// @Failure     401 {object} APIError
+		// @Failure     429 {object} APIError
+		// @Failure     503 {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/lease [post]
+		lease.POST("/keys/lease", func(c *gin.Context) {
+			ttl, err := queryTTL(c)
+			if err != nil {
+				writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+			if !queryPool(c) {
+				return
+			}
+
+			metadata, err := km.GenerateLeasedKeyCtx(c.Request.Context(), ttl)
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusCreated, leasedKeyResponse{metadata, metadata.LeaseToken})
+		})
+
+		// Bulk deletion is only offered when an admin token is configured,
+		// so an unauthenticated deployment can never be wiped by accident.
+		if cfg.AdminToken != "" {
+			// @Summary     Delete keys in bulk
+			// @Description Deletes every key matching all of the given filters. At least one
+			// @Description filter is required; all=true instead purges the whole pool. With
+			// @Description dryRun=true nothing is deleted and the ids of the keys that would be
+			// @Description are returned as keyIds instead. Only available when an admin token
+			// @Description is configured.
+			// @Tags        keys
+			// @Produce     json
+			// @Param       tag       query    string false "Delete keys tagged key:value"
+			// @Param       olderThan query    string false "Delete keys created longer ago than this, e.g. 24h"
+			// @Param       all       query    bool   false "Delete every key"
+			// @Param       dryRun    query    bool   false "List the keys that would be deleted instead"
+			// @Success     200       {object} clearResponse
+			// @Failure     400       {object} APIError
+			// @Failure     401       {object} APIError
+			// @Security    BearerAuth
+			// @Router      /keys [delete]
+			r.DELETE("/keys", func(c *gin.Context) {
+				dryRun := c.Query("dryRun") == "true"
+				if c.Query("all") == "true" {
+					if dryRun {
+						c.JSON(http.StatusOK, gin.H{"keyIds": km.GetAllKeyIDs()})
+						return
+					}
+					c.JSON(http.StatusOK, gin.H{"removed": km.Clear()})
+					return
+				}
+
+				match, err := queryDeleteFilter(c, km.Clock.Now())
+				if err != nil {
+					writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+					return
+				}
+				if dryRun {
+					c.JSON(http.StatusOK, gin.H{"keyIds": km.FindWhere(match)})
+					return
+				}
+				removed, err := km.DeleteWhere(match)
+				if err != nil {
+					writeStoreError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"removed": removed})
+			})
+		}
+
+		// The export contains every raw key, so it needs the admin token even
+		// when reads are otherwise public.
+
+		// @Summary  Export every key
+		// @Tags     admin
+		// @Produce  json
+		// @Success  200 {array}  KeyMetadata
+		// @Failure  401 {object} APIError
+		// @Security BearerAuth
+		// @Router   /export [get]
+		r.GET("/export", adminAuth(cfg.AdminToken, true), func(c *gin.Context) {
+			c.JSON(http.StatusOK, km.Export())
+		})
+
+		// @Summary     Import keys
+		// @Description Merges an export into the pool. Existing keys are skipped unless overwrite is set.
+		// @Tags        admin
+		// @Accept      json
+		// @Produce     json
+		// @Param       overwrite query    bool          false "Replace keys that already exist"
+		// @Param       body      body     []KeyMetadata true  "Keys as returned by GET /export"
+		// @Success     200       {object} ImportResult
+		// @Failure     400       {object} APIError
+		// @Failure     413       {object} APIError
+		// @Failure     401       {object} APIError
+		// @Failure     503       {object} APIError
+		// @Security    BearerAuth
+		// @Router      /import [post]
+		r.POST("/import", func(c *gin.Context) {
+			var keys []KeyMetadata
+			if !bindJSON(c, &keys, false) {
+				return
+			}
+
+			result, err := km.Import(keys, c.Query("overwrite") == "true")
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, result)
+		})
+
+		// Like the export, the id list reveals every raw key.
+
+		// @Summary     List key ids
+		// @Description Returns the id of every key that is not soft-deleted, sorted, without
+		// @Description metadata or pagination.
+		// @Tags        keys
+		// @Produce     json
+		// @Success     200 {object} batchResponse
+		// @Failure     401 {object} APIError
+		// @Security    BearerAuth
+		// @Router      /keys/ids [get]
+		r.GET("/keys/ids", adminAuth(cfg.AdminToken, true), func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"keyIds": km.GetAllKeyIDs()})
+		})
+
+		// @Summary Pool statistics
+		// @Tags    stats
+		// @Produce json
+		// @Success 200 {object} Stats
+		// @Router  /stats [get]
+		r.GET("/stats", func(c *gin.Context) {
+			c.JSON(http.StatusOK, km.Stats())
+		})
+
+		// @Summary     Runtime statistics
+		// @Description Reports the server's goroutine count, memory use and number of open
+		// @Description event streams, for spotting leaks.
+		// @Tags        stats
+		// @Produce     json
+		// @Success     200 {object} RuntimeStats
+		// @Router      /debug/stats [get]
+		r.GET("/debug/stats", func(c *gin.Context) {
+			c.JSON(http.StatusOK, km.RuntimeStats())
+		})
+
+		// Every event names its key, so the stream needs the admin token as
+		// well.
+
+		// @Summary     Stream key events
+		// @Description Streams a server-sent event for every key that is generated, leased,
+		// @Description unblocked, expired or deleted. A client too slow to keep up misses
+		// @Description events, and is sent a "dropped" event with how many it missed.
+		// @Tags        events
+		// @Produce     text/event-stream
+		// @Success     200 {object} KeyEvent
+		// @Failure     401 {object} APIError
+		// @Security    BearerAuth
+		// @Router      /events [get]
+		r.GET("/events", adminAuth(cfg.AdminToken, true), func(c *gin.Context) {
+			sub, unsubscribe := km.events.subscribe()
+			defer unsubscribe()
+
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("X-Accel-Buffering", "no")
+			c.Writer.WriteHeaderNow()
+			c.Writer.Flush()
+
+			c.Stream(func(io.Writer) bool {
+				select {
+				case ev, ok := <-sub.C:
+					if !ok {
+						return false
+					}
+					if n := sub.dropped.Swap(0); n > 0 {
+						c.SSEvent("dropped", gin.H{"count": n})
+					}
+					c.SSEvent(ev.Event, ev)
+					return true
+				case <-c.Request.Context().Done():
+					return false
+				}
+			})
+		})
+
+		// @Summary     Next available key
+		// @Description Reports how long until a lease from the pool can succeed: zero when a
+		// @Description key is available, otherwise until the soonest lease or cooldown ends.
+		// @Description wait is "unknown" when no key is leased or cooling down.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       pool query    string false "Pool to check"
+		// @Success     200  {object} nextAvailableResponse
+		// @Failure     400  {object} APIError
+		// @Router      /keys/next-available [get]
+		r.GET("/keys/next-available", func(c *gin.Context) {
+			if !queryPool(c) {
+				return
+			}
+
+			at, ok := km.NextAvailable(poolFromContext(c.Request.Context()))
+			if !ok {
+				c.JSON(http.StatusOK, nextAvailableResponse{Wait: "unknown"})
+				return
+			}
+			wait := max(at.Sub(km.Clock.Now()), 0)
+			c.JSON(http.StatusOK, nextAvailableResponse{At: at, Wait: wait.String()})
+		})
+
+		// @Summary     Key history
+		// @Description Returns the most recent events for a key, oldest first: when it was
+		// @Description generated, leased, kept alive, unblocked and expired. The history is
+		// @Description discarded once the key is deleted for good.
+		// @Tags        keys
+		// @Produce     json
+		// @Param       id  path     string true "Key id"
+		// @Success     200 {object} historyResponse
+		// @Failure     400 {object} APIError
+		// @Failure     404 {object} APIError
+		// @Router      /keys/{id}/events [get]
+		r.GET("/keys/:id/events", validateKeyID, func(c *gin.Context) {
+			events, err := km.KeyHistory(c.Param("id"))
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"events": events})
+		})
+
+		// @Summary  List keys
+		// @Tags     keys
+		// @Produce  json
+		// @Param    offset query    int    false "Number of keys to skip"
+		// @Param    limit  query    int    false "Page size (max 500)"
+		// @Param    state  query    string false "all, blocked, available or deleted"
+		// @Param    tag    query    string false "Filter by tag, as key:value"
+		// @Success  200    {object} listResponse
+		// @Failure  400    {object} APIError
+		// @Failure  401    {object} APIError
+		// @Security BearerAuth
+		// @Router   /keys/list [get]
+		r.GET("/keys/list", adminAuth(cfg.AdminToken, true), func(c *gin.Context) {
+			offset, err := queryInt(c, "offset", 0)
+			if err != nil {
+				writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+			limit, err := queryInt(c, "limit", DefaultListLimit)
+			if err != nil {
+				writeError(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+			if limit > MaxListLimit {
+				limit = MaxListLimit
+			}
+
+			keys, err := km.ListKeysByState(c.DefaultQuery("state", StateAll))
+			if err != nil {
+				writeStoreError(c, err)
+				return
+			}
+			if raw, ok := c.GetQuery("tag"); ok {
+				k, v, found := strings.Cut(raw, ":")
+				if !found || k == "" {
+					writeError(c, http.StatusBadRequest, CodeInvalidRequest, "tag must be of the form key:value")
+					return
+				}
+				keys = filterByTag(keys, k, v)
+			}
+
+			page, total := paginate(keys, offset, limit)
+			c.JSON(http.StatusOK, gin.H{"keys": page, "total": total, "offset": offset, "limit": limit})
+		})
+	}
+
+	return r
+}
+
+// batchResults converts the per-key errors of a batch operation into
+// keyResults. The overall status is 200 when every key succeeded and 207
+// Multi-Status otherwise.
+func batchResults(errs map[string]error) (int, map[string]keyResult) {
+	status := http.StatusOK
+	results := make(map[string]keyResult, len(errs))
+	for key, err := range errs {
+		if err == nil {
+			results[key] = keyResult{Status: http.StatusOK}
+			continue
+		}
+		status = http.StatusMultiStatus
+		keyStatus, code, ok := storeErrorStatus(err)
+		if !ok {
+			keyStatus, code = http.StatusInternalServerError, CodeInternal
+		}
+		results[key] = keyResult{Status: keyStatus, Code: code, Message: err.Error()}
+	}
+	return status, results
+}
+
+// MaxKeyIDLength is the longest :id path parameter the API accepts.
+const MaxKeyIDLength = 256
+
+// validateKeyID rejects requests whose :id parameter is empty or longer than
+// MaxKeyIDLength before they reach the store.
+func validateKeyID(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" || len(id) > MaxKeyIDLength {
+		writeError(c, http.StatusBadRequest, CodeInvalidRequest,
+			fmt.Sprintf("key id must be between 1 and %d characters", MaxKeyIDLength))
+		return
+	}
+	c.Next()
+}
+
+// queryTTL reads the optional ttl query parameter used to request a lease
+// duration. It returns zero when the parameter is absent.
+func queryTTL(c *gin.Context) (time.Duration, error) {
+	raw, ok := c.GetQuery("ttl")
+	if !ok {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("ttl must be a positive duration such as 30s")
+	}
+	return ttl, nil
+}
+
+// queryWait reads the optional wait query parameter, capped at MaxLeaseWait.
+// It returns zero, meaning do not wait, when the parameter is absent.
+func queryWait(c *gin.Context) (time.Duration, error) {
+	raw, ok := c.GetQuery("wait")
+	if !ok {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(raw)
+	if err != nil || wait < 0 {
+		return 0, errors.New("wait must be a non-negative duration such as 2s")
+	}
+	if wait > MaxLeaseWait {
+		wait = MaxLeaseWait
+	}
+	return wait, nil
+}
+
+// queryDeleteFilter builds the predicate for a bulk delete from the tag and
+// olderThan query parameters, matching keys that satisfy every filter given.
+// It fails when neither is present.
+func queryDeleteFilter(c *gin.Context, now time.Time) (func(KeyMetadata) bool, error) {
+	rawTag, hasTag := c.GetQuery("tag")
+	rawAge, hasAge := c.GetQuery("olderThan")
+	if !hasTag && !hasAge {
+		return nil, errors.New("at least one of tag or olderThan is required, or all=true to delete every key")
+	}
+
+	var k, v string
+	if hasTag {
+		var found bool
+		k, v, found = strings.Cut(rawTag, ":")
+		if !found || k == "" {
+			return nil, errors.New("tag must be of the form key:value")
+		}
+	}
+	var cutoff time.Time
+	if hasAge {
+		age, err := time.ParseDuration(rawAge)
+		if err != nil || age < 0 {
+			return nil, errors.New("olderThan must be a non-negative duration such as 24h")
+		}
+		cutoff = now.Add(-age)
+	}
+
+	return func(metadata KeyMetadata) bool {
+		if hasTag {
+			if tag, ok := metadata.Tags[k]; !ok || tag != v {
+				return false
+			}
+		}
+		return !hasAge || metadata.CreationTime.Before(cutoff)
+	}, nil
+}
+
+// queryPool reads the optional pool query parameter into the request context.
+// It writes a 400 and returns false when the name is invalid.
+func queryPool(c *gin.Context) bool {
+	pool := c.Query("pool")
+	if err := checkPoolName(pool); err != nil {
+		writeStoreError(c, err)
+		return false
+	}
+	if pool != DefaultPool {
+		c.Request = c.Request.WithContext(ContextWithPool(c.Request.Context(), pool))
+	}
+	return true
+}
+
+// queryInt reads a non-negative integer query parameter, returning def when
+// it is absent.
+func queryInt(c *gin.Context, name string, def int) (int, error) {
+	raw, ok := c.GetQuery(name)
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter returns NewRouter(store, cfg) with the access log discarded.
+func newTestRouter(store KeyStore, cfg RouterConfig) *gin.Engine {
+	if cfg.Logger == nil {
+		cfg.Logger = discardLogger
+	}
+	return NewRouter(store, cfg)
+}
+
+// newRequest builds a request for target, sending body as JSON unless it is
+// nil. A string body is sent as is.
+func newRequest(t *testing.T, method, target string, body any) *http.Request {
+	t.Helper()
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(body)
+	default:
+		buf, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(buf)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+// serveRequest runs req through h and returns the recorded response.
+func serveRequest(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// doRequest is serveRequest for a request built by newRequest.
+func doRequest(t *testing.T, h http.Handler, method, target string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveRequest(h, newRequest(t, method, target, body))
+}
+
+// decodeBody decodes the JSON body of w into a new T.
+func decodeBody[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return v
+}
+
+// expectStatus fails the test unless w has the given status.
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, status, w.Body.String())
+	}
+}
+
+// expectError fails the test unless w is an APIError with status and code.
+func expectError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	expectStatus(t, w, status)
+	if got := decodeBody[APIError](t, w); got.Code != code {
+		t.Fatalf("code = %q, want %q", got.Code, code)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+
+	w := doRequest(t, r, http.MethodGet, "/keys/list", nil)
+	expectStatus(t, w, http.StatusOK)
+	empty := decodeBody[listResponse](t, w)
+	if empty.Total != 0 || len(empty.Keys) != 0 {
+		t.Fatalf("empty store listed %d of %d keys", len(empty.Keys), empty.Total)
+	}
+
+	var keys []string
+	for i := 0; i < 5; i++ {
+		keys = append(keys, mustGenerate(t, km))
+		clock.Advance(time.Second)
+	}
+
+	for _, tc := range []struct {
+		offset, limit int
+		want          []string
+	}{
+		{0, 10, keys},
+		{0, 5, keys},
+		{0, 2, keys[:2]},
+		{2, 2, keys[2:4]},
+		{4, 2, keys[4:]},
+		{5, 2, nil},
+		{9, 2, nil},
+	} {
+		w := doRequest(t, r, http.MethodGet, fmt.Sprintf("/keys/list?offset=%d&limit=%d", tc.offset, tc.limit), nil)
+		expectStatus(t, w, http.StatusOK)
+		page := decodeBody[listResponse](t, w)
+		if page.Total != len(keys) {
+			t.Errorf("offset %d limit %d: total = %d, want %d", tc.offset, tc.limit, page.Total, len(keys))
+		}
+		var got []string
+		for _, metadata := range page.Keys {
+			got = append(got, metadata.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("offset %d limit %d: keys = %v, want %v", tc.offset, tc.limit, got, tc.want)
+		}
+	}
+
+	w = doRequest(t, r, http.MethodGet, "/keys/list?limit=-1", nil)
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+}
+
+// listedKeys returns the ids GET target lists.
+func listedKeys(t *testing.T, h http.Handler, target string) []string {
+	t.Helper()
+	w := doRequest(t, h, http.MethodGet, target, nil)
+	expectStatus(t, w, http.StatusOK)
+	var ids []string
+	for _, metadata := range decodeBody[listResponse](t, w).Keys {
+		ids = append(ids, metadata.Key)
+	}
+	return ids
+}
+
+func TestListKeysByState(t *testing.T) {
+	km, clock := newTestManager(t, Config{DeleteGracePeriod: time.Hour})
+	r := newTestRouter(km, RouterConfig{})
+
+	blocked := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	clock.Advance(time.Second)
+	available := mustGenerate(t, km)
+	clock.Advance(time.Second)
+	deleted := mustGenerate(t, km)
+	if err := km.DeleteKey(deleted); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{blocked, available, deleted}},
+		{"?state=all", []string{blocked, available, deleted}},
+		{"?state=blocked", []string{blocked}},
+		{"?state=available", []string{available}},
+		{"?state=deleted", []string{deleted}},
+	} {
+		got := listedKeys(t, r, "/keys/list"+tc.query)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q listed %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	w := doRequest(t, r, http.MethodGet, "/keys/list?state=leased", nil)
+	expectError(t, w, http.StatusBadRequest, CodeInvalidState)
+}
+
+func TestGenerateBatch(t *testing.T) {
+	km, _ := newTestManager(t, Config{MaxBatchSize: 10})
+	r := newTestRouter(km, RouterConfig{})
+
+	w := doRequest(t, r, http.MethodPost, "/keys/batch", batchRequest{Count: 10})
+	expectStatus(t, w, http.StatusCreated)
+	created := decodeBody[batchResponse](t, w)
+	if len(created.KeyIDs) != 10 {
+		t.Fatalf("created %d keys, want 10", len(created.KeyIDs))
+	}
+	for _, key := range created.KeyIDs {
+		if _, err := km.GetKeyInfo(key); err != nil {
+			t.Errorf("GetKeyInfo(%q): %v", key, err)
+		}
+	}
+
+	w = doRequest(t, r, http.MethodPost, "/keys/batch", batchRequest{Count: 11})
+	expectError(t, w, http.StatusBadRequest, CodeInvalidBatchSize)
+
+	for _, body := range []string{`{"count":0}`, `{"count":-1}`, `{}`, `{"count":"ten"}`} {
+		w := doRequest(t, r, http.MethodPost, "/keys/batch", body)
+		expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+	}
+	if stats := km.Stats(); stats.Total != 10 {
+		t.Fatalf("rejected batches left %d keys, want 10", stats.Total)
+	}
+}
+
+func TestUnblockKeyStatus(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+	key := mustGenerate(t, km)
+
+	w := doRequest(t, r, http.MethodPut, "/keys/unknown-key", nil)
+	expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+	if msg := decodeBody[APIError](t, w).Message; msg == "" {
+		t.Error("404 has no message")
+	}
+
+	w = doRequest(t, r, http.MethodPut, "/keys/"+key, nil)
+	expectError(t, w, http.StatusConflict, CodeKeyNotBlocked)
+	if msg := decodeBody[APIError](t, w).Message; msg == "" {
+		t.Error("409 has no message")
+	}
+
+	mustLease(t, km, 0)
+	w = doRequest(t, r, http.MethodPut, "/keys/"+key, nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[messageResponse](t, w).Message; got != "Key is unblocked again" {
+		t.Errorf("message = %q", got)
+	}
+}
+
+func TestGenerateWithTags(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+
+	create := func(tags map[string]string) string {
+		t.Helper()
+		w := doRequest(t, r, http.MethodPost, "/keys", generateRequest{Tags: tags})
+		expectStatus(t, w, http.StatusCreated)
+		clock.Advance(time.Second)
+		return decodeBody[createdKeyResponse](t, w).KeyID
+	}
+	prod := create(map[string]string{"env": "prod", "team": "a"})
+	staging := create(map[string]string{"env": "staging"})
+	untagged := create(nil)
+
+	w := doRequest(t, r, http.MethodGet, "/keys/"+prod, nil)
+	expectStatus(t, w, http.StatusOK)
+	if tags := decodeBody[KeyMetadata](t, w).Tags; fmt.Sprint(tags) != "map[env:prod team:a]" {
+		t.Errorf("tags read back as %v", tags)
+	}
+	w = doRequest(t, r, http.MethodGet, "/keys/"+untagged, nil)
+	expectStatus(t, w, http.StatusOK)
+	if tags := decodeBody[KeyMetadata](t, w).Tags; tags != nil {
+		t.Errorf("untagged key has tags %v", tags)
+	}
+
+	for query, want := range map[string][]string{
+		"env:prod":    {prod},
+		"env:staging": {staging},
+		"team:a":      {prod},
+		"team:b":      nil,
+	} {
+		if got := listedKeys(t, r, "/keys/list?tag="+query); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("tag %s listed %v, want %v", query, got, want)
+		}
+		k, v, _ := strings.Cut(query, ":")
+		if got := km.FindByTag(k, v); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("FindByTag(%s) = %v, want %v", query, got, want)
+		}
+	}
+
+	w = doRequest(t, r, http.MethodGet, "/keys/list?tag=env", nil)
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+	w = doRequest(t, r, http.MethodPost, "/keys", `{"tags":{"":"x"}}`)
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+}
+
+func TestExpiresIn(t *testing.T) {
+	km, clock := newTestManager(t, Config{BlockTTL: 20 * time.Second})
+	r := newTestRouter(km, RouterConfig{})
+	key := mustGenerate(t, km)
+
+	expiresIn := func() float64 {
+		t.Helper()
+		w := doRequest(t, r, http.MethodGet, "/keys/"+key, nil)
+		expectStatus(t, w, http.StatusOK)
+		return decodeBody[KeyMetadata](t, w).ExpiresIn
+	}
+	if got := expiresIn(); got != 0 {
+		t.Fatalf("available key has expiresIn %v", got)
+	}
+
+	mustLease(t, km, 0)
+	if got := expiresIn(); got != 20 {
+		t.Fatalf("expiresIn = %v right after leasing, want 20", got)
+	}
+	clock.Advance(5 * time.Second)
+	if got := expiresIn(); got != 15 {
+		t.Fatalf("expiresIn = %v after 5s, want 15", got)
+	}
+	clock.Advance(15 * time.Second)
+	if got := expiresIn(); got != 0 {
+		t.Fatalf("expiresIn = %v once the lease ran out, want 0", got)
+	}
+}
+
+func TestGenerateLeasedKey(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+	pooled := mustGenerate(t, km)
+
+	w := doRequest(t, r, http.MethodPost, "/keys/lease?ttl=30s", nil)
+	expectStatus(t, w, http.StatusCreated)
+	created := decodeBody[leasedKeyResponse](t, w)
+	if created.Key == pooled {
+		t.Fatal("handed out the key already in the pool")
+	}
+	if !created.IsBlocked || !created.Expiry.Equal(clock.Now().Add(30*time.Second)) || created.LeaseToken == "" {
+		t.Fatalf("created key is not leased for 30s: %+v", created)
+	}
+
+	if stats := km.Stats(); stats.Available != 1 || stats.Blocked != 1 {
+		t.Fatalf("Available = %d, Blocked = %d, want 1 each", stats.Available, stats.Blocked)
+	}
+	if lease := mustLease(t, km, 0); lease.KeyID != pooled {
+		t.Fatalf("leased %q, want %q", lease.KeyID, pooled)
+	}
+	if _, err := km.LeaseKey(0); !errors.Is(err, ErrNoKeysAvailable) {
+		t.Fatalf("LeaseKey: got %v, want ErrNoKeysAvailable", err)
+	}
+	if err := km.ReleaseKey(created.Key, created.LeaseToken); err != nil {
+		t.Fatalf("ReleaseKey with the returned token: %v", err)
+	}
+
+	w = doRequest(t, r, http.MethodPost, "/keys/lease?pool=batch", nil)
+	expectStatus(t, w, http.StatusCreated)
+	if created := decodeBody[leasedKeyResponse](t, w); created.Pool != "batch" {
+		t.Fatalf("created key in pool %q, want batch", created.Pool)
+	}
+}
+
+func TestStats(t *testing.T) {
+	km, clock := newTestManager(t, Config{Strategy: StrategyFIFO})
+	r := newTestRouter(km, RouterConfig{})
+
+	stats := func() Stats {
+		t.Helper()
+		w := doRequest(t, r, http.MethodGet, "/stats", nil)
+		expectStatus(t, w, http.StatusOK)
+		return decodeBody[Stats](t, w)
+	}
+	check := func(step string, total, available, blocked int) {
+		t.Helper()
+		got := stats()
+		if got.Total != total || got.Available != available || got.Blocked != blocked {
+			t.Fatalf("after %s: total %d, available %d, blocked %d; want %d, %d, %d",
+				step, got.Total, got.Available, got.Blocked, total, available, blocked)
+		}
+	}
+
+	check("nothing", 0, 0, 0)
+	mustGenerate(t, km)
+	clock.Advance(time.Second)
+	mustGenerate(t, km)
+	last := mustGenerate(t, km)
+	check("generating 3", 3, 3, 0)
+	if got := stats().OldestKey; !got.Equal(testEpoch) {
+		t.Fatalf("oldestKeyCreatedAt = %v, want %v", got, testEpoch)
+	}
+	lease := mustLease(t, km, 0)
+	check("leasing 1", 3, 2, 1)
+	if err := km.DeleteKey(lease.KeyID); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+	check("deleting the leased key", 2, 2, 0)
+	if err := km.DeleteKey(last); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+	check("deleting an available key", 1, 1, 0)
+}
+
+func TestMaxKeys(t *testing.T) {
+	km, _ := newTestManager(t, Config{MaxKeys: 3})
+	r := newTestRouter(km, RouterConfig{})
+
+	var keys []string
+	for i := 0; i < 3; i++ {
+		w := doRequest(t, r, http.MethodPost, "/keys", nil)
+		expectStatus(t, w, http.StatusCreated)
+		keys = append(keys, decodeBody[createdKeyResponse](t, w).KeyID)
+	}
+
+	w := doRequest(t, r, http.MethodPost, "/keys", nil)
+	expectError(t, w, http.StatusServiceUnavailable, CodePoolFull)
+	w = doRequest(t, r, http.MethodPost, "/keys/batch", batchRequest{Count: 1})
+	expectError(t, w, http.StatusServiceUnavailable, CodePoolFull)
+	if got := km.Stats().Total; got != 3 {
+		t.Fatalf("Total = %d at the cap, want 3", got)
+	}
+
+	w = doRequest(t, r, http.MethodDelete, "/keys/"+keys[0], nil)
+	expectStatus(t, w, http.StatusOK)
+	w = doRequest(t, r, http.MethodPost, "/keys", nil)
+	expectStatus(t, w, http.StatusCreated)
+	if got := km.Stats().Total; got != 3 {
+		t.Fatalf("Total = %d after replacing a key, want 3", got)
+	}
+}
+
+func TestValidateKeyID(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+	key := mustGenerate(t, km)
+
+	longest := strings.Repeat("k", MaxKeyIDLength)
+	for _, tc := range []struct {
+		method, target string
+		status         int
+		code           string
+	}{
+		{http.MethodGet, "/keys/" + key, http.StatusOK, ""},
+		{http.MethodGet, "/keys/" + longest, http.StatusNotFound, CodeKeyNotFound},
+		{http.MethodGet, "/keys/" + longest + "k", http.StatusBadRequest, CodeInvalidRequest},
+		{http.MethodPut, "/keys/" + longest + "k", http.StatusBadRequest, CodeInvalidRequest},
+		{http.MethodDelete, "/keys/" + longest + "k", http.StatusBadRequest, CodeInvalidRequest},
+		{http.MethodPut, "/keepalive/" + longest + "k", http.StatusBadRequest, CodeInvalidRequest},
+	} {
+		w := doRequest(t, r, tc.method, tc.target, nil)
+		if tc.code == "" {
+			expectStatus(t, w, tc.status)
+		} else {
+			expectError(t, w, tc.status, tc.code)
+		}
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	km, _ := newTestManager(t, Config{Store: NewFileStore(filepath.Join(dir, "keys.json"))})
+	r := newTestRouter(km, RouterConfig{})
+
+	expectStatus(t, doRequest(t, r, http.MethodGet, "/healthz", nil), http.StatusOK)
+	w := doRequest(t, r, http.MethodGet, "/readyz", nil)
+	expectError(t, w, http.StatusServiceUnavailable, CodeNotReady)
+
+	runBackground(t, km)
+	expectStatus(t, doRequest(t, r, http.MethodGet, "/readyz", nil), http.StatusOK)
+
+	// Losing the store's directory makes the instance unready, but not
+	// unhealthy.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	w = doRequest(t, r, http.MethodGet, "/readyz", nil)
+	expectError(t, w, http.StatusServiceUnavailable, CodeNotReady)
+	expectStatus(t, doRequest(t, r, http.MethodGet, "/healthz", nil), http.StatusOK)
+}
+
+func TestReleaseKey(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	// Lease holders release without admin credentials.
+	r := newTestRouter(km, RouterConfig{AdminToken: "s3cret"})
+	mustGenerate(t, km)
+	lease := mustLease(t, km, 0)
+	target := "/keys/" + lease.KeyID + "/release"
+
+	w := doRequest(t, r, http.MethodPost, target, releaseRequest{LeaseToken: "wrong"})
+	expectError(t, w, http.StatusForbidden, CodeLeaseNotHeld)
+	if info, _ := km.GetKeyInfo(lease.KeyID); !info.IsBlocked {
+		t.Fatal("a wrong token released the key")
+	}
+
+	w = doRequest(t, r, http.MethodPost, "/keys/unknown-key/release", releaseRequest{LeaseToken: lease.LeaseToken})
+	expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+	w = doRequest(t, r, http.MethodPost, target, `{}`)
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+
+	w = doRequest(t, r, http.MethodPost, target, releaseRequest{LeaseToken: lease.LeaseToken})
+	expectStatus(t, w, http.StatusOK)
+	if info, _ := km.GetKeyInfo(lease.KeyID); info.IsBlocked {
+		t.Fatal("key still blocked after release")
+	}
+	// The token dies with the lease.
+	w = doRequest(t, r, http.MethodPost, target, releaseRequest{LeaseToken: lease.LeaseToken})
+	expectError(t, w, http.StatusConflict, CodeKeyNotBlocked)
+}
+
+func TestDeleteKey(t *testing.T) {
+	km, _ := newTestManager(t, Config{Strategy: StrategyFIFO})
+	r := newTestRouter(km, RouterConfig{})
+	leased := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	available := mustGenerate(t, km)
+
+	for _, key := range []string{available, leased} {
+		w := doRequest(t, r, http.MethodDelete, "/keys/"+key, nil)
+		expectStatus(t, w, http.StatusOK)
+		w = doRequest(t, r, http.MethodGet, "/keys/"+key, nil)
+		expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+		w = doRequest(t, r, http.MethodDelete, "/keys/"+key, nil)
+		expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+	}
+	if stats := km.Stats(); stats.Total != 0 || stats.Blocked != 0 || stats.Available != 0 {
+		t.Fatalf("after deleting every key: %+v", stats)
+	}
+}
+
+func TestPurgeKeys(t *testing.T) {
+	const token = "s3cret"
+	km, _ := newTestManager(t, Config{})
+	if _, err := km.GenerateKeys(3); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	mustLease(t, km, 0)
+
+	// Without an admin token there is no way to wipe the pool.
+	open := newTestRouter(km, RouterConfig{})
+	w := doRequest(t, open, http.MethodDelete, "/keys?all=true", nil)
+	expectError(t, w, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+
+	r := newTestRouter(km, RouterConfig{AdminToken: token})
+	w = doRequest(t, r, http.MethodDelete, "/keys?all=true", nil)
+	expectError(t, w, http.StatusUnauthorized, CodeUnauthorized)
+	if got := km.Stats().Total; got != 3 {
+		t.Fatalf("unauthorized purge left %d keys, want 3", got)
+	}
+
+	w = doAdminRequest(t, r, token, http.MethodDelete, "/keys?all=true")
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[clearResponse](t, w).Removed; got != 3 {
+		t.Fatalf("removed = %d, want 3", got)
+	}
+	if got := km.Stats().Total; got != 0 {
+		t.Fatalf("%d keys left after purge", got)
+	}
+}
+
+// doAdminRequest is doRequest with token sent as a bearer token.
+func doAdminRequest(t *testing.T, h http.Handler, token, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := newRequest(t, method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return serveRequest(h, req)
+}
+
+func TestBulkDeleteKeys(t *testing.T) {
+	const token = "s3cret"
+	km, clock := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{AdminToken: token})
+	generate := func(env string) string {
+		t.Helper()
+		key, err := km.GenerateNewKeyWithTags(map[string]string{"env": env})
+		if err != nil {
+			t.Fatalf("GenerateNewKeyWithTags: %v", err)
+		}
+		return key
+	}
+	oldProd, oldDev := generate("prod"), generate("dev")
+	clock.Advance(2 * time.Hour)
+	newProd := generate("prod")
+	clock.Advance(time.Hour)
+
+	for _, target := range []string{"/keys", "/keys?tag=env", "/keys?olderThan=soon"} {
+		w := doAdminRequest(t, r, token, http.MethodDelete, target)
+		expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+	}
+	if got := km.Stats().Total; got != 3 {
+		t.Fatalf("rejected requests left %d keys, want 3", got)
+	}
+
+	w := doAdminRequest(t, r, token, http.MethodDelete, "/keys?tag=env:dev")
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[clearResponse](t, w).Removed; got != 1 {
+		t.Fatalf("deleting by tag removed %d keys, want 1", got)
+	}
+	if _, err := km.GetKeyInfo(oldDev); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo of dev key: got %v, want ErrKeyNotFound", err)
+	}
+
+	w = doAdminRequest(t, r, token, http.MethodDelete, "/keys?olderThan=2h")
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[clearResponse](t, w).Removed; got != 1 {
+		t.Fatalf("deleting by age removed %d keys, want 1", got)
+	}
+	if _, err := km.GetKeyInfo(oldProd); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetKeyInfo of old key: got %v, want ErrKeyNotFound", err)
+	}
+	if _, err := km.GetKeyInfo(newProd); err != nil {
+		t.Fatalf("GetKeyInfo of new key: %v, want it kept", err)
+	}
+}
+
+func TestBulkDeleteDryRun(t *testing.T) {
+	const token = "s3cret"
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{AdminToken: token})
+	var prod []string
+	for _, env := range []string{"prod", "dev", "prod"} {
+		key, err := km.GenerateNewKeyWithTags(map[string]string{"env": env})
+		if err != nil {
+			t.Fatalf("GenerateNewKeyWithTags: %v", err)
+		}
+		if env == "prod" {
+			prod = append(prod, key)
+		}
+	}
+	slices.Sort(prod)
+
+	w := doAdminRequest(t, r, token, http.MethodDelete, "/keys?tag=env:prod&dryRun=true")
+	expectStatus(t, w, http.StatusOK)
+	resp := decodeBody[clearResponse](t, w)
+	found := slices.Sorted(slices.Values(resp.KeyIDs))
+	if !slices.Equal(found, prod) || resp.Removed != 0 {
+		t.Fatalf("dry run = %+v, want keyIds %v and nothing removed", resp, prod)
+	}
+	if got := km.Stats().Total; got != 3 {
+		t.Fatalf("dry run left %d keys, want 3", got)
+	}
+
+	w = doAdminRequest(t, r, token, http.MethodDelete, "/keys?all=true&dryRun=true")
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[clearResponse](t, w).KeyIDs; len(got) != 3 {
+		t.Fatalf("dry run of all=true listed %v, want every key", got)
+	}
+
+	w = doAdminRequest(t, r, token, http.MethodDelete, "/keys?tag=env:prod")
+	expectStatus(t, w, http.StatusOK)
+	resp = decodeBody[clearResponse](t, w)
+	if resp.Removed != 2 || resp.KeyIDs != nil {
+		t.Fatalf("real run = %+v, want 2 removed and no keyIds", resp)
+	}
+	for _, key := range prod {
+		if _, err := km.GetKeyInfo(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("GetKeyInfo(%q) after the real run: got %v, want ErrKeyNotFound", key, err)
+		}
+	}
+	if got := km.Stats().Total; got != 1 {
+		t.Fatalf("real run left %d keys, want 1", got)
+	}
+}
+
+func TestForceExpire(t *testing.T) {
+	km, _ := newTestManager(t, Config{Strategy: StrategyFIFO})
+	r := newTestRouter(km, RouterConfig{})
+	leased := mustGenerate(t, km)
+	available := mustGenerate(t, km)
+	lease := mustLease(t, km, time.Hour)
+
+	w := doRequest(t, r, http.MethodPost, "/keys/"+available+"/expire", nil)
+	expectError(t, w, http.StatusConflict, CodeKeyNotBlocked)
+	w = doRequest(t, r, http.MethodPost, "/keys/unknown-key/expire", nil)
+	expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+
+	w = doRequest(t, r, http.MethodPost, "/keys/"+leased+"/expire", nil)
+	expectStatus(t, w, http.StatusOK)
+	info, err := km.GetKeyInfo(leased)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if info.IsBlocked {
+		t.Fatal("key still blocked after being force-expired")
+	}
+	if err := km.ReleaseKey(leased, lease.LeaseToken); err == nil {
+		t.Fatal("ReleaseKey with the expired lease's token succeeded")
+	}
+	w = doRequest(t, r, http.MethodPost, "/keys/"+leased+"/expire", nil)
+	expectError(t, w, http.StatusConflict, CodeKeyNotBlocked)
+	if stats := km.Stats(); stats.Available != 2 || stats.Blocked != 0 {
+		t.Fatalf("after force-expiring: %+v", stats)
+	}
+}
+
+func TestBulkStatus(t *testing.T) {
+	km, _ := newTestManager(t, Config{BlockTTL: time.Minute, Strategy: StrategyFIFO})
+	r := newTestRouter(km, RouterConfig{})
+	leased := mustGenerate(t, km)
+	available := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	w := doRequest(t, r, http.MethodPost, "/keys/status", statusRequest{
+		Keys: []string{leased, available, "unknown-key"},
+	})
+	expectStatus(t, w, http.StatusOK)
+	statuses := decodeBody[statusResponse](t, w).Statuses
+	if len(statuses) != 3 {
+		t.Fatalf("got %d statuses, want 3: %+v", len(statuses), statuses)
+	}
+	if got := statuses[leased]; !got.Exists || !got.Blocked || got.ExpiresIn != 60 {
+		t.Fatalf("status of leased key = %+v", got)
+	}
+	if got := statuses[available]; !got.Exists || got.Blocked || got.ExpiresIn != 0 {
+		t.Fatalf("status of available key = %+v", got)
+	}
+	if got := statuses["unknown-key"]; got != (KeyStatus{}) {
+		t.Fatalf("status of unknown key = %+v, want it reported as not existing", got)
+	}
+
+	w = doRequest(t, r, http.MethodPost, "/keys/status", statusRequest{Keys: []string{}})
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+}
+
+func TestKeyTimestampsOmittedWhenUnset(t *testing.T) {
+	km, clock := newTestManager(t, Config{Strategy: StrategyFIFO})
+	r := newTestRouter(km, RouterConfig{})
+	leased := mustGenerate(t, km)
+	fresh := mustGenerate(t, km)
+	clock.Advance(time.Second)
+	mustLease(t, km, time.Minute)
+
+	fields := func(key string) map[string]json.RawMessage {
+		t.Helper()
+		w := doRequest(t, r, http.MethodGet, "/keys/"+key, nil)
+		expectStatus(t, w, http.StatusOK)
+		return decodeBody[map[string]json.RawMessage](t, w)
+	}
+
+	got := fields(fresh)
+	for _, field := range []string{"blockedAt", "expiresAt", "lastAccess", "deletedAt", "reservedUntil"} {
+		if raw, ok := got[field]; ok {
+			t.Errorf("never-leased key has %s = %s, want it omitted", field, raw)
+		}
+	}
+	if _, ok := got["createdAt"]; !ok {
+		t.Error("never-leased key has no createdAt")
+	}
+
+	got = fields(leased)
+	for field, want := range map[string]time.Time{
+		"blockedAt": testEpoch.Add(time.Second),
+		"expiresAt": testEpoch.Add(time.Minute + time.Second),
+	} {
+		var at time.Time
+		if err := json.Unmarshal(got[field], &at); err != nil || !at.Equal(want) {
+			t.Errorf("leased key has %s = %s, want %v", field, got[field], want)
+		}
+	}
+}
+
+func TestOversizedBody(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{MaxBodyBytes: 64})
+
+	small := statusRequest{Keys: []string{"key-1"}}
+	expectStatus(t, doRequest(t, r, http.MethodPost, "/keys/status", small), http.StatusOK)
+
+	large := statusRequest{Keys: []string{strings.Repeat("k", 64)}}
+	w := doRequest(t, r, http.MethodPost, "/keys/status", large)
+	expectError(t, w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge)
+	w = doRequest(t, r, http.MethodPost, "/keys", map[string]any{
+		"tags": map[string]string{"note": strings.Repeat("x", 64)},
+	})
+	expectError(t, w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge)
+	if got := km.Stats().Total; got != 0 {
+		t.Fatalf("Total = %d, want the oversized create rejected", got)
+	}
+}
+
+func TestRotateLeasedKey(t *testing.T) {
+	km, clock := newTestManager(t, Config{BlockTTL: time.Minute})
+	r := newTestRouter(km, RouterConfig{})
+	old, err := km.GenerateNewKeyWithTags(map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatalf("GenerateNewKeyWithTags: %v", err)
+	}
+	clock.Advance(time.Second)
+	lease := mustLease(t, km, 0)
+
+	w := doRequest(t, r, http.MethodPost, "/keys/"+old+"/rotate", nil)
+	expectStatus(t, w, http.StatusOK)
+	rotated := decodeBody[keyIDResponse](t, w).KeyID
+	if rotated == "" || rotated == old {
+		t.Fatalf("rotated to %q", rotated)
+	}
+
+	w = doRequest(t, r, http.MethodGet, "/keys/"+old, nil)
+	expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+	info, err := km.GetKeyInfo(rotated)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.IsBlocked || !info.Expiry.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("rotated key lost its lease: %+v", info)
+	}
+	if !info.CreationTime.Equal(testEpoch) || info.Tags["env"] != "prod" {
+		t.Fatalf("rotated key lost its creation time or tags: %+v", info)
+	}
+	if stats := km.Stats(); stats.Total != 1 || stats.Blocked != 1 {
+		t.Fatalf("Stats = %+v, want the one leased key", stats)
+	}
+
+	// The holder's token carries over to the new id.
+	if err := km.ReleaseKey(rotated, lease.LeaseToken); err != nil {
+		t.Fatalf("ReleaseKey: %v", err)
+	}
+	if got := mustLease(t, km, 0).KeyID; got != rotated {
+		t.Fatalf("leased %q, want %q", got, rotated)
+	}
+}
+
+func TestKeepAliveBatch(t *testing.T) {
+	km, clock := newTestManager(t, Config{BlockTTL: 10 * time.Second})
+	r := newTestRouter(km, RouterConfig{})
+	leased := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	available := mustGenerate(t, km)
+	clock.Advance(5 * time.Second)
+
+	w := doRequest(t, r, http.MethodPost, "/keepalive", keepAliveBatchRequest{Keys: []string{leased, available, "unknown-key"}})
+	expectStatus(t, w, http.StatusMultiStatus)
+	results := decodeBody[batchResultResponse](t, w).Results
+	for key, want := range map[string]keyResult{
+		leased:        {Status: http.StatusOK},
+		available:     {Status: http.StatusOK},
+		"unknown-key": {Status: http.StatusNotFound, Code: CodeKeyNotFound},
+	} {
+		got := results[key]
+		if got.Status != want.Status || got.Code != want.Code {
+			t.Errorf("%s: result %+v, want status %d code %q", key, got, want.Status, want.Code)
+		}
+	}
+	// The bad key did not stop the lease from being renewed.
+	if info, _ := km.GetKeyInfo(leased); !info.Expiry.Equal(clock.Now().Add(10 * time.Second)) {
+		t.Errorf("lease expires at %v, want it renewed to %v", info.Expiry, clock.Now().Add(10*time.Second))
+	}
+
+	w = doRequest(t, r, http.MethodPost, "/keepalive", keepAliveBatchRequest{Keys: []string{leased}})
+	expectStatus(t, w, http.StatusOK)
+	for _, body := range []string{`{"keys":[]}`, `{"keys":[""]}`, `{}`} {
+		w := doRequest(t, r, http.MethodPost, "/keepalive", body)
+		expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+	}
+}
+
+func TestUnblockBatch(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+	if _, err := km.GenerateKeys(3); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	first, second := mustLease(t, km, 0).KeyID, mustLease(t, km, 0).KeyID
+	available := mustGenerate(t, km)
+	before := km.Stats()
+
+	w := doRequest(t, r, http.MethodPut, "/keys/unblock", keepAliveBatchRequest{
+		Keys: []string{first, second, available, "unknown-key"},
+	})
+	expectStatus(t, w, http.StatusMultiStatus)
+	results := decodeBody[batchResultResponse](t, w).Results
+	for key, want := range map[string]keyResult{
+		first:         {Status: http.StatusOK},
+		second:        {Status: http.StatusOK},
+		available:     {Status: http.StatusConflict, Code: CodeKeyNotBlocked},
+		"unknown-key": {Status: http.StatusNotFound, Code: CodeKeyNotFound},
+	} {
+		got := results[key]
+		if got.Status != want.Status || got.Code != want.Code {
+			t.Errorf("%s: result %+v, want status %d code %q", key, got, want.Status, want.Code)
+		}
+	}
+
+	// Only the two leased keys rejoin the pool.
+	after := km.Stats()
+	if after.Available-before.Available != 2 || after.Blocked != before.Blocked-2 || after.Total != before.Total {
+		t.Fatalf("pool went from %+v to %+v, want exactly 2 more available", before, after)
+	}
+	if n := km.availableCount(); n != after.Available {
+		t.Fatalf("available index holds %d keys, Stats counts %d", n, after.Available)
+	}
+
+	w = doRequest(t, r, http.MethodPut, "/keys/unblock", keepAliveBatchRequest{Keys: []string{mustLease(t, km, 0).KeyID}})
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestUnblockUnknownKey(t *testing.T) {
+	for _, creates := range []bool{false, true} {
+		t.Run(fmt.Sprintf("UnblockCreates=%v", creates), func(t *testing.T) {
+			km, _ := newTestManager(t, Config{})
+			r := newTestRouter(km, RouterConfig{UnblockCreates: creates})
+
+			w := doRequest(t, r, http.MethodPut, "/keys/new-key", nil)
+			if !creates {
+				expectError(t, w, http.StatusNotFound, CodeKeyNotFound)
+				if got := km.Stats().Total; got != 0 {
+					t.Fatalf("Total = %d, want the unknown id left uncreated", got)
+				}
+				return
+			}
+			expectStatus(t, w, http.StatusCreated)
+			if stats := km.Stats(); stats.Total != 1 || stats.Available != 1 {
+				t.Fatalf("after PUT of an unknown id: %+v, want it created available", stats)
+			}
+			if got := mustLease(t, km, 0).KeyID; got != "new-key" {
+				t.Fatalf("leased %q, want new-key", got)
+			}
+
+			// Once it exists PUT unblocks it as usual.
+			expectStatus(t, doRequest(t, r, http.MethodPut, "/keys/new-key", nil), http.StatusOK)
+			w = doRequest(t, r, http.MethodPut, "/keys/new-key", nil)
+			expectError(t, w, http.StatusConflict, CodeKeyNotBlocked)
+
+			// A conditional PUT never creates.
+			req := newRequest(t, http.MethodPut, "/keys/other-key", nil)
+			req.Header.Set("If-Match", etag(1))
+			expectError(t, serveRequest(r, req), http.StatusNotFound, CodeKeyNotFound)
+		})
+	}
+}
+
+func TestLeaseNotFoundDetails(t *testing.T) {
+	// Retry-After is measured against the wall clock, so use the real one.
+	km := newKeyManager(Config{Logger: discardLogger})
+	r := newTestRouter(km, RouterConfig{})
+
+	w := doRequest(t, r, http.MethodGet, "/keys", nil)
+	expectError(t, w, http.StatusNotFound, CodeNoKeysAvailable)
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Fatalf("Retry-After = %q with nothing leased", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		mustGenerate(t, km)
+	}
+	mustLease(t, km, 30*time.Second)
+	mustLease(t, km, time.Minute)
+
+	w = doRequest(t, r, http.MethodGet, "/keys", nil)
+	expectError(t, w, http.StatusNotFound, CodeNoKeysAvailable)
+	var body struct {
+		Details PoolPressure `json:"details"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if body.Details.Total != 2 || body.Details.Blocked != 2 {
+		t.Fatalf("details = %+v, want 2 keys, both blocked", body.Details)
+	}
+	if w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("Retry-After = %q, want 30 for the lease ending first", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestCreateResponseIncludesMetadata(t *testing.T) {
+	km, clock := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+	clock.Advance(time.Hour)
+
+	w := doRequest(t, r, http.MethodPost, "/keys", generateRequest{Tags: map[string]string{"env": "prod"}})
+	expectStatus(t, w, http.StatusCreated)
+	var created struct {
+		KeyID     string            `json:"keyId"`
+		Key       string            `json:"key"`
+		CreatedAt time.Time         `json:"createdAt"`
+		Tags      map[string]string `json:"tags"`
+		IsBlocked *bool             `json:"isBlocked"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if created.KeyID == "" || created.Key != created.KeyID {
+		t.Fatalf("keyId %q and key %q, want the same new id", created.KeyID, created.Key)
+	}
+	if want := testEpoch.Add(time.Hour); !created.CreatedAt.Equal(want) {
+		t.Fatalf("createdAt = %v, want %v", created.CreatedAt, want)
+	}
+	if fmt.Sprint(created.Tags) != "map[env:prod]" {
+		t.Fatalf("tags = %v, want env=prod", created.Tags)
+	}
+	if created.IsBlocked == nil || *created.IsBlocked {
+		t.Fatalf("isBlocked = %v, want false", created.IsBlocked)
+	}
+
+	info, err := km.GetKeyInfo(created.KeyID)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.CreationTime.Equal(created.CreatedAt) {
+		t.Fatalf("stored creation time %v, response said %v", info.CreationTime, created.CreatedAt)
+	}
+}
+
+func TestRegisterKey(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+
+	w := doRequest(t, r, http.MethodPost, "/keys", generateRequest{KeyID: "my-key", Tags: map[string]string{"env": "prod"}})
+	expectStatus(t, w, http.StatusCreated)
+	created := decodeBody[createdKeyResponse](t, w)
+	if created.KeyID != "my-key" || created.Tags["env"] != "prod" {
+		t.Fatalf("created %+v, want my-key tagged env=prod", created)
+	}
+	if got := mustLease(t, km, 0).KeyID; got != "my-key" {
+		t.Fatalf("leased %q, want the registered key", got)
+	}
+
+	// A duplicate leaves the existing key, and its lease, alone.
+	w = doRequest(t, r, http.MethodPost, "/keys", generateRequest{KeyID: "my-key"})
+	expectError(t, w, http.StatusConflict, CodeKeyExists)
+	if info, _ := km.GetKeyInfo("my-key"); !info.IsBlocked || info.Tags["env"] != "prod" {
+		t.Fatalf("duplicate registration changed the key: %+v", info)
+	}
+
+	for _, body := range []any{nil, generateRequest{}, `{"keyId":""}`} {
+		w = doRequest(t, r, http.MethodPost, "/keys", body)
+		expectStatus(t, w, http.StatusCreated)
+		if key := decodeBody[createdKeyResponse](t, w).KeyID; key == "" || key == "my-key" {
+			t.Fatalf("body %v: generated %q", body, key)
+		}
+	}
+
+	w = doRequest(t, r, http.MethodPost, "/keys", generateRequest{KeyID: "not a key"})
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+	if got := km.Stats().Total; got != 4 {
+		t.Fatalf("Total = %d, want 4", got)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "runtime"
+
+// RuntimeStats is a snapshot of the process's own resource use, for spotting
+// goroutine and memory leaks.
+type RuntimeStats struct {
+	Goroutines int `json:"goroutines"`
+	// HeapAlloc and Sys are in bytes, as reported by runtime.MemStats.
+	HeapAlloc   uint64 `json:"heapAllocBytes"`
+	HeapObjects uint64 `json:"heapObjects"`
+	Sys         uint64 `json:"sysBytes"`
+	NumGC       uint32 `json:"numGC"`
+	// EventSubscribers is the number of open GET /events streams.
+	EventSubscribers int `json:"eventSubscribers"`
+}
+
+// RuntimeStats reports the process's goroutines and memory along with the
+// number of event subscribers. It briefly stops the world to read the memory
+// statistics, so it is meant for occasional polling.
+func (km *KeyManager) RuntimeStats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return RuntimeStats{
+		Goroutines:       runtime.NumGoroutine(),
+		HeapAlloc:        mem.HeapAlloc,
+		HeapObjects:      mem.HeapObjects,
+		Sys:              mem.Sys,
+		NumGC:            mem.NumGC,
+		EventSubscribers: km.events.subscribers(),
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuntimeStatsCountsSubscribers(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	srv := httptest.NewServer(newTestRouter(km, RouterConfig{}))
+	t.Cleanup(srv.Close)
+
+	stats := func() RuntimeStats {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/debug/stats")
+		if err != nil {
+			t.Fatalf("GET /debug/stats: %v", err)
+		}
+		defer resp.Body.Close()
+		var stats RuntimeStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatalf("decoding /debug/stats: %v", err)
+		}
+		return stats
+	}
+	subscribe := func() context.CancelFunc {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /events: %v", err)
+		}
+		return func() {
+			cancel()
+			resp.Body.Close()
+		}
+	}
+
+	if got := stats(); got.EventSubscribers != 0 || got.Goroutines == 0 || got.HeapAlloc == 0 {
+		t.Fatalf("before subscribing: %+v", got)
+	}
+	first, second := subscribe(), subscribe()
+	waitFor(t, "two subscribers", func() bool { return stats().EventSubscribers == 2 })
+	first()
+	waitFor(t, "one subscriber", func() bool { return stats().EventSubscribers == 1 })
+	second()
+	waitFor(t, "no subscribers", func() bool { return stats().EventSubscribers == 0 })
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultListenAddr is the address the server binds when none is configured.
+const DefaultListenAddr = ":8000"
+
+// shutdownTimeout bounds how long in-flight requests get to finish once a
+// shutdown signal arrives.
+const shutdownTimeout = 10 * time.Second
+
+const (
+	// readHeaderTimeout and readTimeout bound how long a client may take to
+	// send its request headers and its whole request, so slow clients
+	// cannot tie up connections. There is no write timeout, as GET /events
+	// streams for as long as the client stays connected.
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+)
+
+// TLSConfig points the server at a certificate and key. MinVersion defaults
+// to TLS 1.2 when zero.
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion uint16
+}
+
+// Enabled reports whether both a certificate and a key were configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// parseTLSVersion maps "1.2" or "1.3" to its crypto/tls constant. An empty
+// string selects TLS 1.2.
+func parseTLSVersion(raw string) (uint16, error) {
+	switch raw {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, want 1.2 or 1.3", raw)
+}
+
+// Run serves handler on ln until ctx is cancelled, then shuts the server down
+// gracefully. It returns nil after a clean shutdown and the serve error
+// otherwise.
+func Run(ctx context.Context, ln net.Listener, handler http.Handler) error {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+	}
+	return serve(ctx, srv, func() error { return srv.Serve(ln) })
+}
+
+// RunTLS is like Run but terminates TLS on ln using the certificate and key
+// in cfg.
+func RunTLS(ctx context.Context, ln net.Listener, handler http.Handler, cfg TLSConfig) error {
+	minVersion := cfg.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		TLSConfig:         &tls.Config{MinVersion: minVersion},
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+	}
+	return serve(ctx, srv, func() error { return srv.ServeTLS(ln, cfg.CertFile, cfg.KeyFile) })
+}
+
+// serve runs start in the background and shuts srv down once ctx is done.
+func serve(ctx context.Context, srv *http.Server, start func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- start()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
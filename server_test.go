@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startServer listens on a free local port, serves on it with run and
+// returns the address it is bound to. The server is shut down when the test
+// ends, and run must then return nil.
+func startServer(t *testing.T, run func(ctx context.Context, ln net.Listener) error) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- run(ctx, ln) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Errorf("server returned %v after shutdown", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("server did not shut down")
+		}
+	})
+	return ln.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	handler := newTestRouter(km, RouterConfig{})
+	addr := startServer(t, func(ctx context.Context, ln net.Listener) error {
+		return Run(ctx, ln, handler)
+	})
+
+	resp, err := http.Post("http://"+addr+"/keys", "application/json", nil)
+	if err != nil {
+		t.Fatalf("POST /keys: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /keys: status %d, want 201", resp.StatusCode)
+	}
+	if got := km.Stats().Total; got != 1 {
+		t.Fatalf("server created %d keys, want 1", got)
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir
+// and returns the TLSConfig for them, along with a pool trusting the
+// certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (TLSConfig, *x509.CertPool) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "keys-generator test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("encoding key: %v", err)
+	}
+
+	cfg := TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	for path, block := range map[string]*pem.Block{
+		cfg.CertFile: {Type: "CERTIFICATE", Bytes: der},
+		cfg.KeyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return cfg, pool
+}
+
+func TestRunTLS(t *testing.T) {
+	tlsCfg, roots := writeSelfSignedCert(t, t.TempDir())
+	tlsCfg.MinVersion = tls.VersionTLS13
+	km, _ := newTestManager(t, Config{})
+	handler := newTestRouter(km, RouterConfig{})
+	addr := startServer(t, func(ctx context.Context, ln net.Listener) error {
+		return RunTLS(ctx, ln, handler, tlsCfg)
+	})
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + addr + "/keys/list")
+	if err != nil {
+		t.Fatalf("GET over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+		t.Fatalf("connection state %+v, want TLS 1.3", resp.TLS)
+	}
+
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    roots,
+		MaxVersion: tls.VersionTLS12,
+	}}}
+	if resp, err := old.Get("https://" + addr + "/keys/list"); err == nil {
+		resp.Body.Close()
+		t.Fatal("TLS 1.2 client connected despite MinVersion 1.3")
+	}
+	resp, err = http.Get("http://" + addr + "/keys/list")
+	if err != nil {
+		t.Fatalf("plain HTTP: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain HTTP got status %d, want 400", resp.StatusCode)
+	}
+}
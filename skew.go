@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// checkClock compares now with the time of the previous sweep. If the clock
+// has gone backwards, which the monotonic readings of time.Now normally rule
+// out but wall-clock times read back from a Store or set on a Clock do not,
+// it logs a warning and pulls in deadlines that now lie further ahead than
+// they ever could have been set, so that no key waits out the skew on top of
+// its lease, cooldown, reservation or grace period. The caller must hold km.mu.
+func (km *KeyManager) checkClock(now time.Time) {
+	last := km.lastSweep
+	km.lastSweep = now
+	if !now.Before(last) {
+		return
+	}
+
+	km.logger.Warn("clock moved backwards", "skew", last.Sub(now))
+	for key, expiry := range km.blocked {
+		metadata := km.keys[key]
+		if limit := now.Add(metadata.LeaseTTL); expiry.After(limit) {
+			metadata.Expiry = limit
+			km.putKey(key, metadata)
+			km.blocked[key] = limit
+		}
+	}
+	for key, until := range km.cooling {
+		if limit := now.Add(km.ReclaimCooldown); until.After(limit) {
+			km.cooling[key] = limit
+		}
+	}
+	for key, until := range km.reserved {
+		if limit := now.Add(km.ReservationTTL); until.After(limit) {
+			metadata := km.keys[key]
+			metadata.ReservedUntil = limit
+			km.putKey(key, metadata)
+			km.reserved[key] = limit
+		}
+	}
+	for key, deletedAt := range km.deleted {
+		if deletedAt.After(now) {
+			metadata := km.keys[key]
+			metadata.DeletedAt = now
+			km.putKey(key, metadata)
+			km.deleted[key] = now
+		}
+	}
+	km.rebuildExpiries()
+}
+
+// elapsed returns how long has passed from since to now, or zero if the
+// clock has moved backwards in between.
+func elapsed(since, now time.Time) time.Duration {
+	return max(now.Sub(since), 0)
+}
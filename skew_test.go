@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseExpiresAfterClockJumpsBack(t *testing.T) {
+	km, clock := newTestManager(t, Config{
+		BlockTTL:        time.Minute,
+		IdleTTL:         24 * time.Hour,
+		ReclaimCooldown: 30 * time.Second,
+		Strategy:        StrategyFIFO,
+	})
+	leased := mustGenerate(t, km)
+	cooling := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	mustLease(t, km, 0)
+	if err := km.ForceExpire(cooling); err != nil {
+		t.Fatalf("ForceExpire: %v", err)
+	}
+	km.sweep(clock.Now())
+
+	// Without the correction both keys would wait an extra hour.
+	clock.Set(testEpoch.Add(-time.Hour))
+	km.sweep(clock.Now())
+	info, err := km.GetKeyInfo(leased)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if want := clock.Now().Add(time.Minute); !info.Expiry.Equal(want) {
+		t.Fatalf("after the jump the lease expires at %v, want %v", info.Expiry, want)
+	}
+
+	clock.Advance(time.Minute + time.Second)
+	km.sweep(clock.Now())
+	// The cooldown has ended, and the lease has run out into a cooldown of
+	// its own.
+	if stats := km.Stats(); stats.Available != 1 || stats.Blocked != 0 || stats.CoolingDown != 1 {
+		t.Fatalf("a minute after the jump: %+v, want one key available and one cooling down", stats)
+	}
+	if lease := mustLease(t, km, 0); lease.KeyID != cooling {
+		t.Fatalf("leased %q, want the key whose cooldown ended %q", lease.KeyID, cooling)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrSlidingUnsupported = errors.New("this store does not support sliding leases")
+
+type slidingKey struct{}
+
+// ContextWithSlidingExpiry returns a copy of ctx under which leases are
+// taken with sliding expiry: every GetKeyInfo of the leased key renews the
+// lease, as KeepAlive would.
+func ContextWithSlidingExpiry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, slidingKey{}, true)
+}
+
+// slidingFromContext reports whether ctx asks for a sliding lease.
+func slidingFromContext(ctx context.Context) bool {
+	sliding, _ := ctx.Value(slidingKey{}).(bool)
+	return sliding
+}
+
+// slide renews the lease on key if it is a sliding lease, returning the
+// possibly updated metadata. Renewals are skipped while the store cannot
+// take more changes or once MaxRenewals is reached, rather than failing the
+// read. The caller must hold km.mu.
+func (km *KeyManager) slide(key string, metadata KeyMetadata, now time.Time) KeyMetadata {
+	if !metadata.Sliding || !metadata.IsBlocked || !km.renewable(metadata) || km.checkPending() != nil {
+		return metadata
+	}
+	if _, deleted := km.deleted[key]; deleted {
+		return metadata
+	}
+
+	metadata.LastAccess = now
+	metadata.Expiry = now.Add(metadata.LeaseTTL)
+	metadata.Renewals++
+	km.putKey(key, metadata)
+	km.blocked[key] = metadata.Expiry
+	km.schedule(key, metadata.Expiry)
+	km.record(EventKeptAlive, key, now)
+	return km.keys[key]
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlidingLeaseOutlivesFixedLease(t *testing.T) {
+	km, clock := newTestManager(t, Config{Strategy: StrategyFIFO})
+	fixed := mustGenerate(t, km)
+	sliding := mustGenerate(t, km)
+	mustLease(t, km, time.Minute)
+	if _, err := km.LeaseKeyCtx(ContextWithSlidingExpiry(context.Background()), time.Minute); err != nil {
+		t.Fatalf("LeaseKeyCtx: %v", err)
+	}
+	blocked := func(key string) bool {
+		t.Helper()
+		info, err := km.GetKeyInfo(key)
+		if err != nil {
+			t.Fatalf("GetKeyInfo: %v", err)
+		}
+		return info.IsBlocked
+	}
+
+	// Reading both keys renews only the sliding lease.
+	clock.Advance(40 * time.Second)
+	blocked(fixed)
+	blocked(sliding)
+	clock.Advance(40 * time.Second)
+	km.sweep(clock.Now())
+	if blocked(fixed) {
+		t.Fatal("fixed lease outlived its TTL")
+	}
+	info, err := km.GetKeyInfo(sliding)
+	if err != nil {
+		t.Fatalf("GetKeyInfo: %v", err)
+	}
+	if !info.IsBlocked || info.Renewals != 2 {
+		t.Fatalf("sliding lease after two reads: blocked %v, renewals %d", info.IsBlocked, info.Renewals)
+	}
+
+	// Left unread, the sliding lease runs out a TTL after the last read.
+	clock.Advance(time.Minute + time.Second)
+	km.sweep(clock.Now())
+	if blocked(sliding) {
+		t.Fatal("sliding lease outlived a TTL without reads")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Store persists a snapshot of every managed key so state survives restarts.
+type Store interface {
+	Load() (map[string]KeyMetadata, error)
+	Save(map[string]KeyMetadata) error
+}
+
+// Pinger is implemented by stores that can check their backend is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// FileStore is a Store that keeps the snapshot as a JSON document on disk.
+type FileStore struct {
+	Path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// Load reads the snapshot from disk. A missing file is treated as an empty
+// store.
+func (fs *FileStore) Load() (map[string]KeyMetadata, error) {
+	data, err := os.ReadFile(fs.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]KeyMetadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]KeyMetadata)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Ping checks that the directory holding the snapshot exists.
+func (fs *FileStore) Ping(ctx context.Context) error {
+	info, err := os.Stat(filepath.Dir(fs.Path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(fs.Path))
+	}
+	return nil
+}
+
+// Save writes the snapshot to a temporary file and renames it over the
+// previous one, so a crash mid-write never leaves a truncated store behind.
+func (fs *FileStore) Save(keys map[string]KeyMetadata) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.Path), filepath.Base(fs.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.Path)
+}
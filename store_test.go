@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStoreMissingFile(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "keys.json"))
+	keys, err := fs.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Load of a missing file returned %d keys", len(keys))
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "keys.json"))
+	want := map[string]KeyMetadata{
+		"available": {
+			Key:          "available",
+			CreationTime: testEpoch,
+			LastAccess:   testEpoch.Add(time.Minute),
+			Tags:         map[string]string{"env": "prod"},
+			Version:      2,
+		},
+		"blocked": {
+			Key:          "blocked",
+			CreationTime: testEpoch,
+			IsBlocked:    true,
+			BlockedAt:    testEpoch.Add(time.Minute),
+			Expiry:       testEpoch.Add(6 * time.Minute),
+			Version:      3,
+		},
+	}
+	if err := fs.Save(want); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	got, err := fs.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load = %+v, want %+v", got, want)
+	}
+}
+
+func TestKeyManagerReloadsFromFileStore(t *testing.T) {
+	fs := NewFileStore(filepath.Join(t.TempDir(), "keys.json"))
+	km, _ := newTestManager(t, Config{Store: fs})
+	blocked := mustGenerate(t, km)
+	mustLease(t, km, time.Hour)
+	available, err := km.GenerateNewKeyWithTags(map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatalf("GenerateNewKeyWithTags: %v", err)
+	}
+	if err := km.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	restarted, _ := newTestManager(t, Config{Store: fs})
+	if got := restarted.GetAllKeyIDs(); len(got) != 2 {
+		t.Fatalf("reloaded %d keys, want 2", len(got))
+	}
+	info, err := restarted.GetKeyInfo(blocked)
+	if err != nil {
+		t.Fatalf("GetKeyInfo(blocked): %v", err)
+	}
+	if !info.IsBlocked || !info.Expiry.Equal(testEpoch.Add(time.Hour)) {
+		t.Fatalf("reloaded lease: blocked %v, expiry %v", info.IsBlocked, info.Expiry)
+	}
+	info, err = restarted.GetKeyInfo(available)
+	if err != nil {
+		t.Fatalf("GetKeyInfo(available): %v", err)
+	}
+	if info.IsBlocked || info.Tags["env"] != "prod" {
+		t.Fatalf("reloaded available key: %+v", info)
+	}
+	if lease := mustLease(t, restarted, 0); lease.KeyID != available {
+		t.Fatalf("leased %q after reload, want %q", lease.KeyID, available)
+	}
+}
+
+// flakyStore is an in-memory Store whose Save fails while failing is set.
+type flakyStore struct {
+	mu      sync.Mutex
+	failing bool
+	saved   map[string]KeyMetadata
+}
+
+func (s *flakyStore) Load() (map[string]KeyMetadata, error) {
+	return nil, nil
+}
+
+func (s *flakyStore) Save(keys map[string]KeyMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("backend down")
+	}
+	s.saved = keys
+	return nil
+}
+
+func (s *flakyStore) setFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+// stored returns the metadata of key as last saved.
+func (s *flakyStore) stored(key string) (KeyMetadata, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata, ok := s.saved[key]
+	return metadata, ok
+}
+
+func TestPendingWritesReplayAfterRecovery(t *testing.T) {
+	store := &flakyStore{}
+	km, _ := newTestManager(t, Config{Store: store, MaxPendingWrites: 2})
+	runBackground(t, km)
+
+	first := mustGenerate(t, km)
+	store.setFailing(true)
+	if err := km.Flush(); err == nil {
+		t.Fatal("Flush succeeded against a failing store")
+	}
+	if err := km.Ready(context.Background()); err == nil {
+		t.Fatal("Ready succeeded with a failing store")
+	}
+	second := mustGenerate(t, km)
+	if _, err := km.GenerateNewKey(); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("GenerateNewKey with a full buffer = %v, want ErrStoreUnavailable", err)
+	}
+
+	store.setFailing(false)
+	if err := km.Flush(); err != nil {
+		t.Fatalf("Flush after recovery: %v", err)
+	}
+	if err := km.Ready(context.Background()); err != nil {
+		t.Fatalf("Ready after recovery: %v", err)
+	}
+	for _, key := range []string{first, second} {
+		if _, ok := store.stored(key); !ok {
+			t.Fatalf("key %q was not replayed to the store", key)
+		}
+	}
+	mustGenerate(t, km)
+}
+
+func TestWriteThrough(t *testing.T) {
+	store := &flakyStore{}
+	km, _ := newTestManager(t, Config{Store: store, WriteThrough: true})
+
+	key := mustGenerate(t, km)
+	if _, ok := store.stored(key); !ok {
+		t.Fatal("generated key was not saved before GenerateNewKey returned")
+	}
+
+	store.setFailing(true)
+	_, err := km.LeaseKey(0)
+	if !errors.Is(err, ErrNotPersisted) {
+		t.Fatalf("LeaseKey with a failing store: got %v, want ErrNotPersisted", err)
+	}
+	// The lease itself stands, and is saved by the next successful flush.
+	if info, _ := km.GetKeyInfo(key); !info.IsBlocked {
+		t.Fatal("lease was undone by the failed flush")
+	}
+	if saved, _ := store.stored(key); saved.IsBlocked {
+		t.Fatal("failing store holds the lease")
+	}
+
+	store.setFailing(false)
+	other := mustGenerate(t, km)
+	if saved, _ := store.stored(key); !saved.IsBlocked {
+		t.Fatal("lease was not saved once the store recovered")
+	}
+	if _, ok := store.stored(other); !ok {
+		t.Fatal("key generated after recovery was not saved")
+	}
+}
+
+func TestPeriodicFlush(t *testing.T) {
+	store := &flakyStore{}
+	km, _ := newTestManager(t, Config{Store: store, FlushInterval: 10 * time.Millisecond})
+
+	key := mustGenerate(t, km)
+	if _, ok := store.stored(key); ok {
+		t.Fatal("key was saved before any flush without WriteThrough")
+	}
+
+	store.setFailing(true)
+	if _, err := km.LeaseKey(0); err != nil {
+		t.Fatalf("LeaseKey with a failing store and no WriteThrough: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		km.PersistTask(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitFor(t, "a periodic flush to fail", func() bool {
+		km.mu.RLock()
+		defer km.mu.RUnlock()
+		return km.storeErr != nil
+	})
+	store.setFailing(false)
+	waitFor(t, "a periodic flush to save the lease", func() bool {
+		saved, _ := store.stored(key)
+		return saved.IsBlocked
+	})
+}
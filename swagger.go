@@ -0,0 +1,21 @@
+package main
+
+// swaggerUI is a minimal Swagger UI page that renders /swagger.json.
+var swaggerUI = []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Keys Generator API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = function () {
+      SwaggerUIBundle({ url: "/swagger.json", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`)
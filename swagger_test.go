@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSwaggerServed(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+
+	w := doRequest(t, r, http.MethodGet, "/swagger.json", nil)
+	expectStatus(t, w, http.StatusOK)
+	var spec struct {
+		Swagger string                     `json:"swagger"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("decoding /swagger.json: %v", err)
+	}
+	if spec.Swagger != "2.0" {
+		t.Errorf("swagger = %q, want 2.0", spec.Swagger)
+	}
+	for _, path := range []string{"/keys", "/keys/{id}", "/keepalive/{id}"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("spec does not document %s", path)
+		}
+	}
+
+	w = doRequest(t, r, http.MethodGet, "/swagger/", nil)
+	expectStatus(t, w, http.StatusOK)
+	if !strings.Contains(w.Body.String(), `url: "/swagger.json"`) {
+		t.Error("/swagger/ does not load /swagger.json")
+	}
+}
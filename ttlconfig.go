@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidTTL = errors.New("invalid TTL")
+
+// TTLSettings are the TTLs that can be changed while the manager is running.
+type TTLSettings struct {
+	BlockTTL time.Duration
+	IdleTTL  time.Duration
+}
+
+// TTLs returns the current BlockTTL and IdleTTL.
+func (km *KeyManager) TTLs() TTLSettings {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return TTLSettings{BlockTTL: km.BlockTTL, IdleTTL: km.IdleTTL}
+}
+
+// UpdateTTLs changes BlockTTL and IdleTTL at runtime; a zero field is left as
+// it is. BlockTTL must lie within [MinBlockTTL, MaxBlockTTL] and IdleTTL must
+// be positive. A new BlockTTL applies to leases taken from now on, while
+// existing leases keep the duration they were granted. A new IdleTTL applies
+// to every key straight away, measured from its last activity as usual.
+func (km *KeyManager) UpdateTTLs(update TTLSettings) (TTLSettings, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if update.BlockTTL != 0 && (update.BlockTTL < km.MinBlockTTL || update.BlockTTL > km.MaxBlockTTL) {
+		return TTLSettings{}, fmt.Errorf("%w: blockTTL must be between %s and %s",
+			ErrInvalidTTL, km.MinBlockTTL, km.MaxBlockTTL)
+	}
+	if update.IdleTTL < 0 {
+		return TTLSettings{}, fmt.Errorf("%w: idleTTL must be positive", ErrInvalidTTL)
+	}
+
+	if update.BlockTTL != 0 {
+		km.BlockTTL = update.BlockTTL
+	}
+	if update.IdleTTL != 0 && update.IdleTTL != km.IdleTTL {
+		km.IdleTTL = update.IdleTTL
+		// Idle deadlines already in the heap were computed with the old
+		// IdleTTL; a shorter one would otherwise only take effect late.
+		km.rebuildExpiries()
+		km.nudge()
+	}
+	km.logger.Info("updated TTLs", "blockTTL", km.BlockTTL, "idleTTL", km.IdleTTL)
+
+	return TTLSettings{BlockTTL: km.BlockTTL, IdleTTL: km.IdleTTL}, nil
+}
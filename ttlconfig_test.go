@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRuntimeBlockTTLChange(t *testing.T) {
+	km, clock := newTestManager(t, Config{BlockTTL: time.Minute, IdleTTL: time.Hour, Strategy: StrategyFIFO})
+	r := newTestRouter(km, RouterConfig{})
+	before := mustGenerate(t, km)
+	after := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	w := doRequest(t, r, http.MethodPatch, "/config", ttlConfig{BlockTTL: "5m"})
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[ttlConfig](t, w).BlockTTL; got != "5m0s" {
+		t.Fatalf("PATCH /config reported blockTTL %q, want 5m0s", got)
+	}
+	w = doRequest(t, r, http.MethodPatch, "/config", ttlConfig{BlockTTL: "-1s"})
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+	mustLease(t, km, 0)
+
+	expiries := map[string]time.Duration{before: time.Minute, after: 5 * time.Minute}
+	for key, ttl := range expiries {
+		info, err := km.GetKeyInfo(key)
+		if err != nil {
+			t.Fatalf("GetKeyInfo: %v", err)
+		}
+		if want := testEpoch.Add(ttl); !info.Expiry.Equal(want) {
+			t.Fatalf("lease expires at %v, want %v", info.Expiry, want)
+		}
+	}
+
+	clock.Advance(2 * time.Minute)
+	km.sweep(clock.Now())
+	if stats := km.Stats(); stats.Blocked != 1 || stats.Available != 1 {
+		t.Fatalf("two minutes later: %+v, want only the later lease still held", stats)
+	}
+}
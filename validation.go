@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError describes one request body field that failed validation.
+type FieldError struct {
+	Field string `json:"field"`
+	// Rule is the binding rule that failed, or "type" and "unknown" for
+	// fields of the wrong type or that the endpoint does not accept.
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+func init() {
+	// Report fields by their JSON names rather than the Go ones.
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// bindJSON decodes the request body into obj and checks it against its
+// binding tags. Unknown fields are rejected. With optional set an empty body
+// is accepted as the zero value. On failure it writes a 400 whose details list
+// the offending fields and returns false.
+func bindJSON(c *gin.Context, obj any, optional bool) bool {
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(obj)
+	switch {
+	case errors.Is(err, io.EOF) && optional:
+		err = nil
+	case err == nil && dec.More():
+		err = errors.New("unexpected data after JSON body")
+	}
+	if err == nil {
+		err = binding.Validator.ValidateStruct(obj)
+	}
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(c, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+			fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit))
+		return false
+	}
+	apiErr := APIError{Code: CodeInvalidRequest, Message: err.Error()}
+	if fields := fieldErrors(err); len(fields) > 0 {
+		apiErr.Message = "request body failed validation"
+		apiErr.Details = fields
+	}
+	abortWithAPIError(c, http.StatusBadRequest, apiErr)
+	return false
+}
+
+// limitBody caps every request body at n bytes. Reads past the cap fail with
+// *http.MaxBytesError, which bindJSON reports as 413.
+func limitBody(n int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+		c.Next()
+	}
+}
+
+// fieldErrors breaks err down into the fields it concerns, or returns nil if
+// it is not about particular fields, such as a syntax error.
+func fieldErrors(err error) []FieldError {
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		fields := make([]FieldError, 0, len(verrs))
+		for _, fe := range verrs {
+			// Drop the request type from the namespace.
+			_, field, _ := strings.Cut(fe.Namespace(), ".")
+			fields = append(fields, FieldError{Field: field, Rule: fe.Tag(), Param: fe.Param()})
+		}
+		return fields
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return []FieldError{{Field: typeErr.Field, Rule: "type", Param: typeErr.Type.String()}}
+	}
+	// encoding/json has no error type for unknown fields.
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return []FieldError{{Field: strings.Trim(name, `"`), Rule: "unknown"}}
+	}
+	return nil
+}
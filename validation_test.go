@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestBindJSONRejectsBadPayloads(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{})
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		fields []FieldError
+	}{
+		{"malformed", `{"count":`, nil},
+		{"not an object", `[1]`, []FieldError{{Field: "", Rule: "type", Param: "main.batchRequest"}}},
+		{"trailing data", `{"count":1} {"count":2}`, nil},
+		{"missing field", `{}`, []FieldError{{Field: "count", Rule: "required"}}},
+		{"out of range", `{"count":0}`, []FieldError{{Field: "count", Rule: "required"}}},
+		{"wrong type", `{"count":"1"}`, []FieldError{{Field: "count", Rule: "type", Param: "int"}}},
+		{"extra field", `{"count":1,"pool":"x"}`, []FieldError{{Field: "pool", Rule: "unknown"}}},
+	} {
+		w := doRequest(t, r, http.MethodPost, "/keys/batch", tc.body)
+		expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+		details := decodeBody[struct {
+			Details []FieldError `json:"details"`
+		}](t, w).Details
+		if fmt.Sprint(details) != fmt.Sprint(tc.fields) {
+			t.Errorf("%s: details %+v, want %+v", tc.name, details, tc.fields)
+		}
+	}
+	if got := km.Stats().Total; got != 0 {
+		t.Fatalf("rejected payloads created %d keys", got)
+	}
+
+	// An optional body may be left out entirely, but not be partial.
+	expectStatus(t, doRequest(t, r, http.MethodPost, "/keys", nil), http.StatusCreated)
+	w := doRequest(t, r, http.MethodPost, "/keys", `{"keyId":`)
+	expectError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+}
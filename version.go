@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrVersionMismatch    = errors.New("key has been modified since the given version")
+	ErrVersionUnsupported = errors.New("this store does not track key versions")
+)
+
+type versionKey struct{}
+
+// ContextWithVersion returns a copy of ctx under which mutations that honour
+// it only go ahead if the key is still at version, failing with
+// ErrVersionMismatch otherwise.
+func ContextWithVersion(ctx context.Context, version uint64) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+// versionFromContext returns the version set by ContextWithVersion, if any.
+func versionFromContext(ctx context.Context) (uint64, bool) {
+	version, ok := ctx.Value(versionKey{}).(uint64)
+	return version, ok
+}
+
+// checkVersion returns ErrVersionMismatch if ctx expects key to be at a
+// version it no longer is. Keys that do not exist pass, leaving the caller to
+// report that. The caller must hold km.mu.
+func (km *KeyManager) checkVersion(ctx context.Context, key string) error {
+	version, ok := versionFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if metadata, exists := km.keys[key]; exists && metadata.Version != version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// etag formats version as a strong entity tag.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// ifMatch reads the If-Match header into the request context so the store
+// can compare it with the key's version. "*" matches any version. When
+// required is set a request without the header is rejected with 428. It
+// writes the error and returns false when the request cannot proceed.
+func ifMatch(c *gin.Context, required bool) bool {
+	raw := c.GetHeader("If-Match")
+	if raw == "" || raw == "*" {
+		if raw == "" && required {
+			writeError(c, http.StatusPreconditionRequired, CodeMissingIfMatch,
+				"If-Match is required, use the ETag from GET /keys/{id}")
+			return false
+		}
+		return true
+	}
+
+	version, err := strconv.ParseUint(strings.Trim(raw, `"`), 10, 64)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, CodeInvalidRequest, "If-Match must be an ETag returned by GET /keys/{id}")
+		return false
+	}
+	c.Request = c.Request.WithContext(ContextWithVersion(c.Request.Context(), version))
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIfMatch(t *testing.T) {
+	km, _ := newTestManager(t, Config{})
+	r := newTestRouter(km, RouterConfig{RequireIfMatch: true})
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+	currentETag := func() string {
+		t.Helper()
+		w := doRequest(t, r, http.MethodGet, "/keys/"+key, nil)
+		expectStatus(t, w, http.StatusOK)
+		return w.Header().Get("ETag")
+	}
+	unblock := func(ifMatch string) *httptest.ResponseRecorder {
+		req := newRequest(t, http.MethodPut, "/keys/"+key, nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		return serveRequest(r, req)
+	}
+
+	expectError(t, unblock(""), http.StatusPreconditionRequired, CodeMissingIfMatch)
+
+	// A heartbeat from the holder moves the key on, so the earlier ETag no
+	// longer matches.
+	stale := currentETag()
+	req := newRequest(t, http.MethodPut, "/keepalive/"+key, nil)
+	req.Header.Set("If-Match", stale)
+	expectStatus(t, serveRequest(r, req), http.StatusOK)
+	expectError(t, unblock(stale), http.StatusPreconditionFailed, CodeVersionMismatch)
+	if info, err := km.GetKeyInfo(key); err != nil || !info.IsBlocked {
+		t.Fatalf("after a conflicting unblock: blocked %v, err %v, want the key still leased", info.IsBlocked, err)
+	}
+
+	expectStatus(t, unblock(currentETag()), http.StatusOK)
+	if info, err := km.GetKeyInfo(key); err != nil || info.IsBlocked {
+		t.Fatalf("after a matching unblock: blocked %v, err %v, want the key available", info.IsBlocked, err)
+	}
+}
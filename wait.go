@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// MaxLeaseWait caps how long a single lease request may wait for a key
+	// to become available.
+	MaxLeaseWait = 30 * time.Second
+
+	// leaseRetryMin and leaseRetryMax bound the pause between attempts while
+	// waiting for a key.
+	leaseRetryMin = 10 * time.Millisecond
+	leaseRetryMax = 250 * time.Millisecond
+)
+
+// waitingLeaser is implemented by stores that can block until a key becomes
+// available instead of being polled.
+type waitingLeaser interface {
+	LeaseKeyWait(ctx context.Context, ttl, wait time.Duration) (Lease, error)
+}
+
+// LeaseKeyWait leases a key from store like LeaseKeyCtx, but when the pool is
+// empty it waits for up to wait before giving up with ErrNoKeysAvailable.
+// Stores that implement waitingLeaser are asked to wait themselves; others
+// are retried with exponential, jittered backoff so that many waiting clients
+// do not hammer the store in lockstep.
+func LeaseKeyWait(ctx context.Context, store KeyStore, ttl, wait time.Duration) (Lease, error) {
+	if w, ok := store.(waitingLeaser); ok {
+		return w.LeaseKeyWait(ctx, ttl, wait)
+	}
+
+	deadline := time.Now().Add(wait)
+	backoff := leaseRetryMin
+
+	for {
+		lease, err := store.LeaseKeyCtx(ctx, ttl)
+		if !errors.Is(err, ErrNoKeysAvailable) {
+			return lease, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return Lease{}, err
+		}
+		pause := backoff/2 + rand.N(backoff)
+		if pause > remaining {
+			pause = remaining
+		}
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Lease{}, ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > leaseRetryMax {
+			backoff = leaseRetryMax
+		}
+	}
+}
+
+// releaseAbandoned gives lease back if ctx, the context of the request that
+// took it, ended by the time the lease was granted, as it does when the
+// client disconnects while waiting for a key. Nobody is left to receive the
+// lease, so the key would otherwise stay blocked until it expired. It reports
+// whether the lease was abandoned.
+func releaseAbandoned(ctx context.Context, store KeyStore, lease Lease, logger *slog.Logger) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	err := store.ReleaseKeyCtx(context.WithoutCancel(ctx), lease.KeyID, lease.LeaseToken)
+	logger.Info("released lease abandoned by client", "requestId", requestIDFromContext(ctx),
+		"key", keyFingerprint(lease.KeyID), "error", err)
+	return true
+}
+
+// RetreiveAvailableKeyWait is RetreiveAvailableKeyCtx, but waits for up to
+// wait for a key when the pool is empty.
+func (km *KeyManager) RetreiveAvailableKeyWait(ctx context.Context, ttl, wait time.Duration) (string, error) {
+	lease, err := km.LeaseKeyWait(ctx, ttl, wait)
+	return lease.KeyID, err
+}
+
+// LeaseKeyWait is LeaseKeyCtx, but when the pool is empty it sleeps on
+// km.keyAvailable until a key is generated or released, wait elapses
+// (ErrNoKeysAvailable) or ctx is done (ctx.Err()). A caller whose ctx ends
+// while it waits gives up its place without leasing anything, even if a key
+// frees up at the same moment.
+func (km *KeyManager) LeaseKeyWait(ctx context.Context, ttl, wait time.Duration) (_ Lease, err error) {
+	defer km.writeThrough(&err)
+
+	token, err := GenerateRandomKey(LeaseTokenLength)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	// sync.Cond cannot watch a context, so wake every waiter when this one
+	// gives up; the others simply go back to sleep.
+	stop := context.AfterFunc(waitCtx, func() {
+		km.mu.Lock()
+		km.keyAvailable.Broadcast()
+		km.mu.Unlock()
+	})
+	defer stop()
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	ttl = clampBlockTTL(ttl, km.BlockTTL, km.MinBlockTTL, km.MaxBlockTTL)
+	if err := km.checkPending(); err != nil {
+		return Lease{}, err
+	}
+
+	client := clientFromContext(ctx)
+	if err := km.checkQuota(client, 1); err != nil {
+		return Lease{}, err
+	}
+	if err := km.checkMaxBlocked(1); err != nil {
+		return Lease{}, err
+	}
+	pool := poolFromContext(ctx)
+	sliding := slidingFromContext(ctx)
+	km.addWaiter(pool, client)
+	defer km.removeWaiter(pool, client)
+	for km.claimable(pool, client) == 0 {
+		if err := ctx.Err(); err != nil {
+			return Lease{}, err
+		}
+		if lease, err := km.leaseGenerated(pool, ttl, token, client, sliding); !errors.Is(err, ErrNoKeysAvailable) {
+			return lease, err
+		}
+		if waitCtx.Err() != nil {
+			return Lease{}, ErrNoKeysAvailable
+		}
+		km.keyAvailable.Wait()
+		// The client, or other callers, may have taken leases while this
+		// one slept.
+		if err := km.checkQuota(client, 1); err != nil {
+			return Lease{}, err
+		}
+		if err := km.checkMaxBlocked(1); err != nil {
+			return Lease{}, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return Lease{}, err
+	}
+	return km.leaseNext(pool, ttl, token, client, sliding), nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waiters returns how many LeaseKeyWait callers km has waiting.
+func waiters(km *KeyManager) int {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	n := 0
+	for _, count := range km.waiting {
+		n += count
+	}
+	return n
+}
+
+// pollingStore hides KeyManager.LeaseKeyWait, so LeaseKeyWait falls back to
+// polling it as it does stores that cannot wait themselves.
+type pollingStore struct {
+	KeyStore
+}
+
+// leaseAsync runs LeaseKeyWait on store in the background.
+func leaseAsync(ctx context.Context, store KeyStore, wait time.Duration) <-chan Lease {
+	leases := make(chan Lease, 1)
+	go func() {
+		lease, _ := LeaseKeyWait(ctx, store, 0, wait)
+		leases <- lease
+	}()
+	return leases
+}
+
+func TestWaiterGetsUnblockedKey(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		store func(*KeyManager) KeyStore
+	}{
+		{"waiting", func(km *KeyManager) KeyStore { return km }},
+		{"polling", func(km *KeyManager) KeyStore { return pollingStore{km} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			km := newKeyManager(Config{Logger: discardLogger})
+			key := mustGenerate(t, km)
+			mustLease(t, km, 0)
+
+			leases := leaseAsync(context.Background(), tc.store(km), 5*time.Second)
+			if tc.name == "waiting" {
+				waitFor(t, "the lease to wait", func() bool { return waiters(km) == 1 })
+			} else {
+				time.Sleep(3 * leaseRetryMin)
+			}
+			if err := km.UnblockKey(key); err != nil {
+				t.Fatalf("UnblockKey: %v", err)
+			}
+
+			select {
+			case lease := <-leases:
+				if lease.KeyID != key {
+					t.Fatalf("waiter leased %q, want the unblocked %q", lease.KeyID, key)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("waiter did not get the unblocked key")
+			}
+			if info, _ := km.GetKeyInfo(key); !info.IsBlocked {
+				t.Fatal("key handed to the waiter is not blocked")
+			}
+		})
+	}
+}
+
+func TestWaitGivesUp(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger})
+	for _, store := range []KeyStore{km, pollingStore{km}} {
+		start := time.Now()
+		_, err := LeaseKeyWait(context.Background(), store, 0, 50*time.Millisecond)
+		if !errors.Is(err, ErrNoKeysAvailable) {
+			t.Fatalf("%T: got %v, want ErrNoKeysAvailable", store, err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+			t.Fatalf("%T: gave up after %v, want about 50ms", store, elapsed)
+		}
+	}
+}
+
+func TestWaitersWakeOnGenerate(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger})
+	first := leaseAsync(context.Background(), km, 5*time.Second)
+	second := leaseAsync(context.Background(), km, 5*time.Second)
+	waitFor(t, "both leases to wait", func() bool { return waiters(km) == 2 })
+
+	key := mustGenerate(t, km)
+	var got Lease
+	select {
+	case got = <-first:
+	case got = <-second:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no waiter woke for the generated key")
+	}
+	if got.KeyID != key {
+		t.Fatalf("waiter leased %q, want the generated %q", got.KeyID, key)
+	}
+
+	// A batch wakes the waiter that is left.
+	keys, err := km.GenerateKeys(2)
+	if err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	select {
+	case got = <-first:
+	case got = <-second:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the second waiter did not wake for the batch")
+	}
+	if got.KeyID != keys[0] && got.KeyID != keys[1] {
+		t.Fatalf("waiter leased %q, want one of %v", got.KeyID, keys)
+	}
+}
+
+// waitAsync runs km.LeaseKeyWait in the background, reporting its error.
+func waitAsync(ctx context.Context, km *KeyManager, wait time.Duration) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		_, err := km.LeaseKeyWait(ctx, 0, wait)
+		errs <- err
+	}()
+	return errs
+}
+
+// waitResults collects the outcome of each waiter, counting how many leased
+// a key and how many were refused with refusal.
+func waitResults(t *testing.T, refusal error, results ...<-chan error) (leased, refused int) {
+	t.Helper()
+	for _, errs := range results {
+		select {
+		case err := <-errs:
+			switch {
+			case err == nil:
+				leased++
+			case errors.Is(err, refusal):
+				refused++
+			default:
+				t.Fatalf("waiter got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("waiter did not return")
+		}
+	}
+	return leased, refused
+}
+
+func TestWaitersRecheckQuota(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger, ClientQuota: 1})
+	ctx := ContextWithClient(context.Background(), "client")
+	first := waitAsync(ctx, km, 5*time.Second)
+	second := waitAsync(ctx, km, 5*time.Second)
+	waitFor(t, "both leases to wait", func() bool { return waiters(km) == 2 })
+
+	if _, err := km.GenerateKeys(2); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	if leased, refused := waitResults(t, ErrQuotaExceeded, first, second); leased != 1 || refused != 1 {
+		t.Fatalf("%d waiters leased and %d were refused, want one each", leased, refused)
+	}
+	if stats := km.Stats(); stats.Blocked != 1 {
+		t.Fatalf("%d keys blocked, want 1", stats.Blocked)
+	}
+}
+
+func TestWaitersRecheckMaxBlocked(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger, MaxBlocked: 2})
+	var errs []<-chan error
+	for i := 0; i < 3; i++ {
+		errs = append(errs, waitAsync(context.Background(), km, 5*time.Second))
+	}
+	waitFor(t, "all leases to wait", func() bool { return waiters(km) == 3 })
+
+	if _, err := km.GenerateKeys(3); err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	if leased, refused := waitResults(t, ErrTooManyLeases, errs...); leased != 2 || refused != 1 {
+		t.Fatalf("%d waiters leased and %d were refused, want 2 and 1", leased, refused)
+	}
+	if stats := km.Stats(); stats.Blocked != 2 {
+		t.Fatalf("%d keys blocked, want 2", stats.Blocked)
+	}
+}
+
+func TestCanceledWaiterLeasesNothing(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger})
+	key := mustGenerate(t, km)
+	held := mustLease(t, km, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := km.LeaseKeyWait(ctx, 0, 5*time.Second)
+		errs <- err
+	}()
+	waitFor(t, "the lease to wait", func() bool { return waiters(km) == 1 })
+
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("canceled waiter got %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("canceled waiter did not return")
+	}
+	if n := waiters(km); n != 0 {
+		t.Fatalf("%d waiters left after cancel, want 0", n)
+	}
+
+	// The key freed after the cancel is still there for the next caller.
+	if err := km.ReleaseKey(key, held.LeaseToken); err != nil {
+		t.Fatalf("ReleaseKey: %v", err)
+	}
+	if stats := km.Stats(); stats.Available != 1 || stats.Blocked != 0 {
+		t.Fatalf("after cancel and release: %+v, want the key available", stats)
+	}
+}
+
+func TestReleaseAbandoned(t *testing.T) {
+	km := newKeyManager(Config{Logger: discardLogger})
+	mustGenerate(t, km)
+	lease := mustLease(t, km, 0)
+
+	if releaseAbandoned(context.Background(), km, lease, discardLogger) {
+		t.Fatal("lease for a live request reported abandoned")
+	}
+	if stats := km.Stats(); stats.Blocked != 1 {
+		t.Fatalf("live lease was released: %+v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !releaseAbandoned(ctx, km, lease, discardLogger) {
+		t.Fatal("lease for a canceled request not reported abandoned")
+	}
+	if stats := km.Stats(); stats.Available != 1 || stats.Blocked != 0 {
+		t.Fatalf("abandoned lease kept the key: %+v", stats)
+	}
+}
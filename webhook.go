@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// webhookTimeout bounds a single delivery attempt.
+	webhookTimeout = 5 * time.Second
+	// webhookAttempts is how many times a delivery is tried before giving up.
+	webhookAttempts = 3
+	// webhookBackoff is the delay before the first retry; it doubles after
+	// every failed attempt.
+	webhookBackoff = 500 * time.Millisecond
+)
+
+// Key lifecycle event names.
+const (
+	EventGenerated = "generated"
+	EventLeased    = "leased"
+	EventUnblocked = "unblocked"
+	EventExpired   = "expired"
+	EventDeleted   = "deleted"
+	// EventActivated is published when a reserved key joins the available
+	// pool, whether confirmed or because its reservation ran out.
+	EventActivated = "activated"
+	// EventKeptAlive is only recorded in a key's history, not streamed,
+	// since heartbeating clients send so many.
+	EventKeptAlive = "kept_alive"
+)
+
+// KeyEvent describes something that happened to a key.
+type KeyEvent struct {
+	Event string    `json:"event"`
+	Key   string    `json:"key"`
+	At    time.Time `json:"at"`
+}
+
+// webhookNotifier POSTs key events to a configured URL.
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	backoff time.Duration
+	logger  *slog.Logger
+}
+
+func newWebhookNotifier(url string, logger *slog.Logger) *webhookNotifier {
+	return &webhookNotifier{
+		url:     url,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: webhookBackoff,
+		logger:  logger,
+	}
+}
+
+// Notify delivers ev in the background so callers are never held up by a
+// slow or unreachable endpoint. Failures are logged once all attempts have
+// been used.
+func (wn *webhookNotifier) Notify(ev KeyEvent) {
+	go func() {
+		if err := wn.deliver(ev); err != nil {
+			wn.logger.Warn("delivering webhook",
+				"event", ev.Event, "key", keyFingerprint(ev.Key), "err", err)
+		}
+	}()
+}
+
+func (wn *webhookNotifier) deliver(ev KeyEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	backoff := wn.backoff
+	for attempt := 1; ; attempt++ {
+		err = wn.post(body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (wn *webhookNotifier) post(body []byte) error {
+	resp, err := wn.client.Post(wn.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebhookReceiver starts a server that answers the first fail requests
+// with 500 and sends the events of later ones on the returned channel.
+func newWebhookReceiver(t *testing.T, fail int32) (*httptest.Server, <-chan KeyEvent) {
+	t.Helper()
+	events := make(chan KeyEvent, 16)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var ev KeyEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		events <- ev
+	}))
+	t.Cleanup(srv.Close)
+	return srv, events
+}
+
+// nextEvent returns the next event named name from events, skipping others.
+func nextEvent(t *testing.T, events <-chan KeyEvent, name string) KeyEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Event == name {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event delivered", name)
+		}
+	}
+}
+
+func TestWebhookExpiredEvent(t *testing.T) {
+	srv, events := newWebhookReceiver(t, 0)
+	km, clock := newTestManager(t, Config{WebhookURL: srv.URL, BlockTTL: 10 * time.Second})
+	key := mustGenerate(t, km)
+	mustLease(t, km, 0)
+
+	clock.Advance(11 * time.Second)
+	km.sweep(clock.Now())
+
+	ev := nextEvent(t, events, EventExpired)
+	if ev.Key != key || !ev.At.Equal(clock.Now()) {
+		t.Fatalf("expired event = %+v, want key %q at %v", ev, key, clock.Now())
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	srv, events := newWebhookReceiver(t, webhookAttempts-1)
+	wn := newWebhookNotifier(srv.URL, discardLogger)
+	wn.backoff = time.Millisecond
+
+	wn.Notify(KeyEvent{Event: EventDeleted, Key: "k", At: testEpoch})
+	if ev := nextEvent(t, events, EventDeleted); ev.Key != "k" {
+		t.Fatalf("delivered %+v", ev)
+	}
+}